@@ -0,0 +1,170 @@
+package filecache
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrBadArchive is returned by Import when the archive is not a valid
+// cache export.
+var ErrBadArchive = errors.New("invalid cache archive")
+
+// Export writes the entries accepted by filter (all of them when filter is
+// nil) to w as a tar archive, e.g. to seed the cache of CI machines with
+// Import. Each entry is stored as a <hash>.meta file immediately followed
+// by its <hash>.data file. Data is exported as stored on disk (compressed
+// when a codec is in use). Wrap w with a compressor if needed.
+func (c *FileCacheFS) Export(w io.Writer, filter func(Entry) bool) error {
+	tw := tar.NewWriter(w)
+	for _, e := range c.snapshot(filter) {
+		if err := c.exportEntry(tw, e.Key); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// exportEntry writes a single entry. The data file is opened under the lock
+// so that it matches the metadata even if the entry is replaced while being
+// copied.
+func (c *FileCacheFS) exportEntry(tw *tar.Writer, key string) error {
+	h := hashKey(key)
+
+	c.lock()
+	m, ok := c.index[h]
+	if !ok {
+		// removed since the snapshot
+		c.unlock()
+		return nil
+	}
+	meta := *m
+	f, err := os.Open(c.dataPath(h))
+	c.unlock()
+	if err != nil {
+		// data vanished from disk: nothing worth exporting
+		return nil
+	}
+	defer f.Close()
+
+	mb, err := json.Marshal(&meta)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, h+".meta", int64(len(mb)), meta.LastAccess); err != nil {
+		return err
+	}
+	if _, err := tw.Write(mb); err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, h+".data", meta.diskSize(), meta.LastAccess); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, meta.diskSize())
+	return err
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, mod time.Time) error {
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o644,
+		ModTime:  mod,
+	})
+}
+
+// Import reads an archive produced by Export and stores its entries,
+// replacing existing entries with the same key. Every entry is verified
+// against its checksum before being stored. It returns the number of
+// entries imported.
+func (c *FileCacheFS) Import(r io.Reader) (int, error) {
+	tr := tar.NewReader(r)
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if !strings.HasSuffix(hdr.Name, ".meta") {
+			return n, fmt.Errorf("%w: unexpected %s", ErrBadArchive, hdr.Name)
+		}
+
+		var m entryMeta
+		if err := json.NewDecoder(io.LimitReader(tr, hdr.Size)).Decode(&m); err != nil {
+			return n, fmt.Errorf("%w: %s: %v", ErrBadArchive, hdr.Name, err)
+		}
+		if m.Key == "" {
+			return n, fmt.Errorf("%w: %s: empty key", ErrBadArchive, hdr.Name)
+		}
+		h := hashKey(m.Key)
+		if path.Base(hdr.Name) != h+".meta" {
+			return n, fmt.Errorf("%w: %s does not match its key", ErrBadArchive, hdr.Name)
+		}
+
+		hdr, err = tr.Next()
+		if err != nil || path.Base(hdr.Name) != h+".data" {
+			return n, fmt.Errorf("%w: missing data for %s", ErrBadArchive, m.Key)
+		}
+		if err := c.importEntry(h, &m, tr); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// importEntry copies the data of an imported entry to disk, verifies it and
+// adds the entry to the index.
+func (c *FileCacheFS) importEntry(h string, m *entryMeta, r io.Reader) error {
+	if err := c.ensureEntryDir(h); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(c.entryDir(h), h+".data.*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	sum := sha256.New()
+	var written int64
+	// same mode as the data files written by StreamPut
+	err = f.Chmod(0o644)
+	if err == nil {
+		written, err = io.Copy(io.MultiWriter(f, sum), r)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && written != m.diskSize() {
+		err = fmt.Errorf("%w: size mismatch for %s", ErrBadArchive, m.Key)
+	}
+	if err == nil && m.Checksum != "" && hex.EncodeToString(sum.Sum(nil)) != m.Checksum {
+		err = fmt.Errorf("%w: checksum mismatch for %s", ErrBadArchive, m.Key)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	m.Checksum = hex.EncodeToString(sum.Sum(nil))
+
+	c.lock()
+	defer c.unlock()
+	if err := os.Rename(tmp, c.dataPath(h)); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := c.writeMeta(h, m); err != nil {
+		return err
+	}
+	return c.insertLocked(h, m)
+}
@@ -0,0 +1,88 @@
+package filecache
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	src, err := NewWithOptions(t.TempDir(), Options{Codec: GzipCodec{}})
+	if err != nil {
+		t.Fatalf("NewWithOptions failed: %v", err)
+	}
+	big := strings.Repeat("payload ", 200)
+	if err := src.Put("keep/1", []byte(big)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	putAll(t, src, "keep/2", "skip/1")
+
+	var archive bytes.Buffer
+	if err := src.Export(&archive, KeyPrefix("keep/")); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	dst, err := NewWithOptions(t.TempDir(), Options{ShardWidth: 2})
+	if err != nil {
+		t.Fatalf("NewWithOptions failed: %v", err)
+	}
+	n, err := dst.Import(&archive)
+	if err != nil || n != 2 {
+		t.Fatalf("Import = %d, %v; want 2", n, err)
+	}
+	if got, err := dst.Get("keep/1"); err != nil || string(got) != big {
+		t.Errorf("Get(keep/1) returned %d bytes, %v", len(got), err)
+	}
+	if got, err := dst.Get("keep/2"); err != nil || string(got) != "v:keep/2" {
+		t.Errorf("Get(keep/2) = %q, %v", got, err)
+	}
+	if _, err := dst.Get("skip/1"); err != ErrNotFound {
+		t.Errorf("skip/1 must not be exported, got %v", err)
+	}
+	if rep, _ := dst.Verify(); !rep.OK() {
+		t.Errorf("imported cache does not verify: %+v", rep)
+	}
+	info, err := os.Stat(dst.dataPath(hashKey("keep/1")))
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o644 {
+		t.Errorf("imported data file mode = %v, want %v", perm, os.FileMode(0o644))
+	}
+}
+
+func TestImportRejectsTamperedData(t *testing.T) {
+	src, _ := setupTempCache(t)
+	putAll(t, src, "k")
+
+	var archive bytes.Buffer
+	if err := src.Export(&archive, nil); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	// flip the data payload ("v:k") keeping its size
+	tampered := bytes.Replace(archive.Bytes(), []byte("v:k"), []byte("v:X"), 1)
+
+	dst, _ := setupTempCache(t)
+	if _, err := dst.Import(bytes.NewReader(tampered)); !errors.Is(err, ErrBadArchive) {
+		t.Errorf("Import err = %v, want ErrBadArchive", err)
+	}
+	if len(keysOf(dst, nil)) != 0 {
+		t.Errorf("tampered entry must not be imported")
+	}
+}
+
+func TestImportRejectsForeignFiles(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	_ = tw.WriteHeader(&tar.Header{Name: "../../etc/passwd", Size: 1, Mode: 0o644})
+	_, _ = tw.Write([]byte("x"))
+	_ = tw.Close()
+
+	dst, _ := setupTempCache(t)
+	if _, err := dst.Import(&archive); !errors.Is(err, ErrBadArchive) {
+		t.Errorf("Import err = %v, want ErrBadArchive", err)
+	}
+}
@@ -0,0 +1,73 @@
+package filecache
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Codec compresses entries on disk. Implementations must be safe for
+// concurrent use; each call to NewWriter/NewReader handles a single entry.
+//
+// The codec name is stored in the entry metadata, so entries written with a
+// codec can still be read after the cache is reopened without it, as long
+// as the codec is known (see Options.Codec and the built-in GzipCodec).
+type Codec interface {
+	// Name identifies the codec in entry metadata. It must be stable.
+	Name() string
+	// NewWriter returns a writer compressing into w. Closing it must flush
+	// any pending data but not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader returns a reader decompressing r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// GzipCodec compresses entries with gzip at the given Level
+// (gzip.DefaultCompression when zero).
+type GzipCodec struct {
+	Level int
+}
+
+func (GzipCodec) Name() string { return "gzip" }
+
+func (g GzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	level := g.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (GzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// codecFor returns the codec able to decode entries written with name.
+func (c *FileCacheFS) codecFor(name string) (Codec, error) {
+	if c.codec != nil && c.codec.Name() == name {
+		return c.codec, nil
+	}
+	if name == (GzipCodec{}).Name() {
+		return GzipCodec{}, nil
+	}
+	return nil, fmt.Errorf("filecache: unknown codec %q", name)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// nopWriteCloser adapts a writer for entries stored without codec.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,104 @@
+package filecache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGzipCodecRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewWithOptions(dir, Options{Codec: GzipCodec{}})
+	if err != nil {
+		t.Fatalf("NewWithOptions failed: %v", err)
+	}
+
+	data := []byte(strings.Repeat(`{"name":"value"},`, 500))
+	if err := cache.Put("json", data); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := cache.StreamPut("stream", bytes.NewReader(data)); err != nil {
+		t.Fatalf("StreamPut failed: %v", err)
+	}
+
+	for _, k := range []string{"json", "stream"} {
+		got, err := cache.Get(k)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("Get(%s) returned %d bytes, %v", k, len(got), err)
+		}
+	}
+
+	stats, _ := cache.Stats()
+	if stats.TotalBytes != int64(2*len(data)) {
+		t.Errorf("TotalBytes = %d, want %d", stats.TotalBytes, 2*len(data))
+	}
+	if stats.DiskBytes <= 0 || stats.DiskBytes >= stats.TotalBytes/5 {
+		t.Errorf("DiskBytes = %d, expected strong compression of %d", stats.DiskBytes, stats.TotalBytes)
+	}
+	fi, err := os.Stat(filepath.Join(dir, hashKey("json")+".data"))
+	if err != nil {
+		t.Fatalf("stat data: %v", err)
+	}
+	if fi.Size()*2 != stats.DiskBytes {
+		t.Errorf("data file is %d bytes, DiskBytes = %d", fi.Size(), stats.DiskBytes)
+	}
+
+	// entries stay readable once the codec is no longer configured
+	if err := cache.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	plain, err := New(dir)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if got, err := plain.Get("json"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Get without codec returned %d bytes, %v", len(got), err)
+	}
+}
+
+func TestCodecLimitsUseDiskSize(t *testing.T) {
+	cache, err := NewWithOptions(t.TempDir(), Options{Codec: GzipCodec{}})
+	if err != nil {
+		t.Fatalf("NewWithOptions failed: %v", err)
+	}
+	// 10 entries of 10 KiB each compress to a few dozen bytes
+	cache.ConfigureLimits(0, 4096)
+	data := bytes.Repeat([]byte("a"), 10*1024)
+	for i := 0; i < 10; i++ {
+		if err := cache.Put(fmt.Sprintf("k%d", i), data); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if stats, _ := cache.Stats(); stats.Count != 10 {
+		t.Errorf("Count = %d, want 10: limit must apply to on-disk size", stats.Count)
+	}
+}
+
+func TestCodecCorruptedPayload(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewWithOptions(dir, Options{Codec: GzipCodec{}})
+	if err != nil {
+		t.Fatalf("NewWithOptions failed: %v", err)
+	}
+	if err := cache.Put("k", []byte("hello hello hello")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// rewrite data and metadata consistently with a non-gzip payload: the
+	// checksum passes, decoding must not
+	h := hashKey("k")
+	garbage := []byte("not gzip at all")
+	if err := os.WriteFile(filepath.Join(dir, h+".data"), garbage, 0o644); err != nil {
+		t.Fatalf("write data: %v", err)
+	}
+	m := cache.index[h]
+	m.DiskSize = int64(len(garbage))
+	m.Checksum = checksum(garbage)
+
+	if _, err := cache.Get("k"); err != ErrCorrupted {
+		t.Errorf("Get err = %v, want ErrCorrupted", err)
+	}
+}
@@ -0,0 +1,92 @@
+package filecache
+
+import (
+	"iter"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Entry describes a cached item.
+type Entry struct {
+	Key        string    `json:"key"`
+	Size       int64     `json:"size"`      // logical (uncompressed) size
+	DiskSize   int64     `json:"disk_size"` // size of the data file
+	LastAccess time.Time `json:"last_access"`
+	Checksum   string    `json:"checksum,omitempty"` // hex sha256 of the data file
+	Codec      string    `json:"codec,omitempty"`    // codec name, empty if stored as is
+}
+
+func (m *entryMeta) entry() Entry {
+	return Entry{
+		Key:        m.Key,
+		Size:       m.Size,
+		DiskSize:   m.diskSize(),
+		LastAccess: m.LastAccess,
+		Checksum:   m.Checksum,
+		Codec:      m.Codec,
+	}
+}
+
+// KeyPrefix returns a filter matching entries whose key starts with prefix.
+func KeyPrefix(prefix string) func(Entry) bool {
+	return func(e Entry) bool {
+		return strings.HasPrefix(e.Key, prefix)
+	}
+}
+
+// Entries returns an iterator over the entries accepted by filter (all of
+// them when filter is nil), ordered by key. The iterator works on a
+// snapshot taken when iteration starts, so the cache can be modified while
+// iterating.
+func (c *FileCacheFS) Entries(filter func(Entry) bool) iter.Seq[Entry] {
+	return func(yield func(Entry) bool) {
+		for _, e := range c.snapshot(filter) {
+			if !yield(e) {
+				return
+			}
+		}
+	}
+}
+
+// snapshot returns the entries accepted by filter, ordered by key.
+func (c *FileCacheFS) snapshot(filter func(Entry) bool) []Entry {
+	c.lock()
+	out := make([]Entry, 0, len(c.index))
+	for _, m := range c.index {
+		e := m.entry()
+		if filter == nil || filter(e) {
+			out = append(out, e)
+		}
+	}
+	c.unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// DeleteFunc removes every entry accepted by filter and returns how many
+// were removed.
+func (c *FileCacheFS) DeleteFunc(filter func(Entry) bool) (int, error) {
+	if filter == nil {
+		return 0, nil
+	}
+	c.lock()
+	defer c.unlock()
+
+	n := 0
+	for h, m := range c.index {
+		if filter(m.entry()) {
+			c.removeLocked(h)
+			n++
+		}
+	}
+	c.maybeCompact()
+	return n, nil
+}
+
+// DeletePrefix removes every entry whose key starts with prefix and returns
+// how many were removed.
+func (c *FileCacheFS) DeletePrefix(prefix string) (int, error) {
+	return c.DeleteFunc(KeyPrefix(prefix))
+}
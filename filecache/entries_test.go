@@ -0,0 +1,75 @@
+package filecache
+
+import (
+	"slices"
+	"testing"
+)
+
+func putAll(t *testing.T, c *FileCacheFS, keys ...string) {
+	t.Helper()
+	for _, k := range keys {
+		if err := c.Put(k, []byte("v:"+k)); err != nil {
+			t.Fatalf("Put %s failed: %v", k, err)
+		}
+	}
+}
+
+func keysOf(c *FileCacheFS, filter func(Entry) bool) []string {
+	var out []string
+	for e := range c.Entries(filter) {
+		out = append(out, e.Key)
+	}
+	return out
+}
+
+func TestEntriesFiltering(t *testing.T) {
+	cache, _ := setupTempCache(t)
+	putAll(t, cache, "https://b.example/x", "https://a.example/2", "https://a.example/1")
+
+	all := keysOf(cache, nil)
+	want := []string{"https://a.example/1", "https://a.example/2", "https://b.example/x"}
+	if !slices.Equal(all, want) {
+		t.Errorf("Entries(nil) = %v, want %v", all, want)
+	}
+
+	if got := keysOf(cache, KeyPrefix("https://a.example/")); !slices.Equal(got, want[:2]) {
+		t.Errorf("Entries(prefix) = %v, want %v", got, want[:2])
+	}
+
+	for e := range cache.Entries(KeyPrefix("https://b.")) {
+		if e.Size != int64(len("v:"+e.Key)) || e.DiskSize != e.Size || e.Checksum == "" {
+			t.Errorf("unexpected entry %+v", e)
+		}
+	}
+
+	// early stop
+	n := 0
+	for range cache.Entries(nil) {
+		n++
+		break
+	}
+	if n != 1 {
+		t.Errorf("iteration did not stop")
+	}
+}
+
+func TestDeletePrefixAndFunc(t *testing.T) {
+	cache, _ := setupTempCache(t)
+	putAll(t, cache, "api/users/1", "api/users/2", "api/orders/1", "static/logo")
+
+	n, err := cache.DeletePrefix("api/users/")
+	if err != nil || n != 2 {
+		t.Fatalf("DeletePrefix = %d, %v; want 2", n, err)
+	}
+	if _, err := cache.Get("api/users/1"); err != ErrNotFound {
+		t.Errorf("expected api/users/1 to be deleted, got %v", err)
+	}
+
+	n, err = cache.DeleteFunc(func(e Entry) bool { return e.Key == "static/logo" })
+	if err != nil || n != 1 {
+		t.Fatalf("DeleteFunc = %d, %v; want 1", n, err)
+	}
+	if got := keysOf(cache, nil); !slices.Equal(got, []string{"api/orders/1"}) {
+		t.Errorf("remaining keys = %v", got)
+	}
+}
@@ -1,6 +1,7 @@
 package filecache
 
 import (
+	"bytes"
 	"container/heap"
 	"crypto/sha256"
 	"encoding/hex"
@@ -16,16 +17,40 @@ import (
 // File-backed cache suitable for CLI tools. It stores each item as two
 // files in a directory: <hash>.data and <hash>.meta (JSON). Keys are
 // arbitrary strings (e.g. request URLs). All operations are concurrent-safe.
+//
+// With Options.ShardWidth the files are spread over subdirectories named
+// after the leading hex chars of the hash, which keeps directories small
+// when the cache holds hundreds of thousands of entries.
+//
+// With Options.Codec the data files are compressed; metadata keep both the
+// logical and the on-disk size.
+//
+// A compacted index log (index.log) mirrors the metadata of every entry so
+// that New does not need to read each .meta file at startup. The .meta files
+// remain the source of truth used to rebuild the index when the log is
+// missing or damaged.
+//
+// Every entry carries a sha256 checksum of its data, verified on Get. Files
+// orphaned by interrupted writes are swept when the cache is opened, and
+// Verify/Repair run a full consistency check on demand.
+//
+// Several processes may share the same directory: every operation holds an
+// advisory lock on <dir>/lock and first replays the index log records
+// appended by the other processes, so all of them see the same entries and
+// enforce limits on the same totals. Get takes the lock in shared mode, so
+// reads run in parallel within and across processes.
 
 var (
 	ErrNotFound   = errors.New("item not found")
 	ErrInvalidKey = errors.New("invalid key")
+	ErrCorrupted  = errors.New("corrupted item")
 )
 
 // Stats contains aggregate statistics for the cache.
 type Stats struct {
 	Count      int       `json:"count"`
-	TotalBytes int64     `json:"total_bytes"`
+	TotalBytes int64     `json:"total_bytes"` // logical (uncompressed) bytes
+	DiskBytes  int64     `json:"disk_bytes"`  // bytes used on disk
 	LastAccess time.Time `json:"last_access"` // most recent access among all items
 }
 
@@ -34,6 +59,17 @@ type entryMeta struct {
 	Key        string    `json:"key"`
 	Size       int64     `json:"size"`
 	LastAccess time.Time `json:"last_access"`
+	Checksum   string    `json:"checksum,omitempty"`  // hex sha256 of the data file
+	Codec      string    `json:"codec,omitempty"`     // codec name, empty if stored as is
+	DiskSize   int64     `json:"disk_size,omitempty"` // data file size when Codec is set
+}
+
+// diskSize returns the size of the data file.
+func (m *entryMeta) diskSize() int64 {
+	if m.Codec == "" {
+		return m.Size
+	}
+	return m.DiskSize
 }
 
 // FileCacheFS is the file-backed cache.
@@ -43,50 +79,128 @@ type FileCacheFS struct {
 	index    map[string]*entryMeta // map[hash]meta
 	maxItems int
 	maxBytes int64
-	curBytes int64
+	curBytes int64 // on-disk bytes
 	pq       priorityQueue
+
+	shardWidth int         // leading hash chars used as subdirectory, 0 = flat
+	codec      Codec       // compression applied on write, nil = none
+	flock      *fileLock   // cross-process lock
+	logf       *os.File    // index log opened for append
+	logInfo    os.FileInfo // identity of the index log replayed in memory
+	logOffset  int64       // bytes of the index log replayed in memory
+	logRecords int         // records in the index log, used to trigger compaction
+
+	lockErrOnce sync.Once // reports the first failure to take the file lock
+	closed      bool      // set by Close
+
+	atimeMu sync.Mutex
+	atimes  map[string]time.Time // map[hash]access time, not yet in the index
 }
 
+// accessFlushThreshold is the number of pending access times that makes Get
+// record them in the index log.
+const accessFlushThreshold = 64
+
 // New returns a FileCacheFS that stores cache files under dir. It will
 // create the directory if missing.
 func New(dir string) (*FileCacheFS, error) {
+	return NewWithOptions(dir, Options{})
+}
+
+// NewWithOptions is like New but lets the caller choose the directory
+// layout. An existing cache written with a different layout is reorganized
+// in place on open.
+func NewWithOptions(dir string, opts Options) (*FileCacheFS, error) {
 	if dir == "" {
 		return nil, ErrInvalidKey
 	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return nil, err
 	}
 	c := &FileCacheFS{
-		dir:   dir,
-		index: make(map[string]*entryMeta),
+		dir:        dir,
+		shardWidth: opts.ShardWidth,
+		codec:      opts.Codec,
+		index:      make(map[string]*entryMeta),
 	}
+	fl, err := openFileLock(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, err
+	}
+	c.flock = fl
+
+	c.mu.Lock()
+	c.checkLock(c.flock.lock())
+	defer c.unlock()
 	// load existing entries
 	if err := c.loadIndex(); err != nil {
+		_ = c.flock.close()
+		return nil, err
+	}
+	// drop leftovers of writes interrupted by a crash
+	if err := c.sweepOrphans(); err != nil {
+		_ = c.flock.close()
 		return nil, err
 	}
-	// initialize heap (already populated by loadIndex)
-	heap.Init(&c.pq)
+	c.maybeCompact()
 	return c, nil
 }
 
-// ConfigureLimits sets maximum items and bytes. Zero means unlimited.
-func (c *FileCacheFS) ConfigureLimits(maxItems int, maxBytes int64) {
+// Close compacts the index log and releases the underlying file handles,
+// including the lock file. The cache must not be used after Close; calling
+// Close again does nothing.
+func (c *FileCacheFS) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	c.checkLock(c.flock.lock())
+	_ = c.syncLocked()
+	c.flushAccessLocked()
+	var err error
+	if c.logf != nil {
+		err = c.compactIndex()
+	}
+	if c.logf != nil {
+		if cerr := c.logf.Close(); err == nil {
+			err = cerr
+		}
+		c.logf = nil
+	}
+	_ = c.flock.unlock()
+	if cerr := c.flock.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ConfigureLimits sets maximum items and bytes. Zero means unlimited.
+// The bytes limit applies to the on-disk size of the entries.
+func (c *FileCacheFS) ConfigureLimits(maxItems int, maxBytes int64) {
+	c.lock()
+	defer c.unlock()
 	c.maxItems = maxItems
 	c.maxBytes = maxBytes
 	// enforce in case limits are lower than current usage
 	c.enforceLimits()
 }
 
-// Index returns a copy of the current index (hash -> entryMeta copy).
+// Index returns a copy of the current index (hash -> Entry).
 // This is handy for debugging / listing contents.
-func (c *FileCacheFS) Index() map[string]entryMeta {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	out := make(map[string]entryMeta, len(c.index))
+//
+// Deprecated: use Entries, which also supports filtering.
+func (c *FileCacheFS) Index() map[string]Entry {
+	c.lock()
+	defer c.unlock()
+	out := make(map[string]Entry, len(c.index))
 	for h, m := range c.index {
-		out[h] = *m
+		out[h] = m.entry()
 	}
 	return out
 }
@@ -102,123 +216,172 @@ func hashKey(key string) string {
 }
 
 func (c *FileCacheFS) dataPath(hash string) string {
-	return filepath.Join(c.dir, hash+".data")
+	return filepath.Join(c.entryDir(hash), hash+".data")
 }
 func (c *FileCacheFS) metaPath(hash string) string {
-	return filepath.Join(c.dir, hash+".meta")
-}
-
-// loadIndex scans the directory and loads existing .meta files.
-func (c *FileCacheFS) loadIndex() error {
-	entries, err := os.ReadDir(c.dir)
-	if err != nil {
-		return err
-	}
-	for _, e := range entries {
-		name := e.Name()
-		if filepath.Ext(name) != ".meta" {
-			continue
-		}
-		full := filepath.Join(c.dir, name)
-		b, err := os.ReadFile(full)
-		if err != nil {
-			// skip malformed entries
-			continue
-		}
-		var m entryMeta
-		if err := json.Unmarshal(b, &m); err != nil {
-			continue
-		}
-		hash := name[:len(name)-len(".meta")]
-		// keep pointer copy
-		mm := m
-		c.index[hash] = &mm
-		c.curBytes += mm.Size
-		heap.Push(&c.pq, &pqItem{hash: hash, lastAccess: mm.LastAccess.UnixNano()})
-	}
-	return nil
+	return filepath.Join(c.entryDir(hash), hash+".meta")
 }
 
 // Put stores bytes for key. It's atomic: write to temp then rename.
 func (c *FileCacheFS) Put(key string, data []byte) error {
-	if key == "" {
-		return ErrInvalidKey
-	}
-	h := hashKey(key)
-	dataPath := c.dataPath(h)
-	metaPath := c.metaPath(h)
-
-	// write data to temp
-	tmpData := dataPath + ".tmp"
-	if err := os.WriteFile(tmpData, data, 0o644); err != nil {
-		return err
-	}
-	if err := os.Rename(tmpData, dataPath); err != nil {
-		_ = os.Remove(tmpData)
-		return err
-	}
-
-	m := &entryMeta{Key: key, Size: int64(len(data)), LastAccess: time.Now()}
-	mb, _ := json.Marshal(m)
-	tmpMeta := metaPath + ".tmp"
-	if err := os.WriteFile(tmpMeta, mb, 0o644); err != nil {
-		return err
-	}
-	if err := os.Rename(tmpMeta, metaPath); err != nil {
-		_ = os.Remove(tmpMeta)
-		return err
-	}
+	return c.StreamPut(key, bytes.NewReader(data))
+}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// insertLocked adds (or replaces) an entry in the index and records it in
+// the index log. Callers must hold the cache lock.
+func (c *FileCacheFS) insertLocked(h string, m *entryMeta) error {
 	// adjust curBytes if replacing existing
 	if old, ok := c.index[h]; ok {
-		c.curBytes -= old.Size
+		c.curBytes -= old.diskSize()
 	}
 	c.index[h] = m
-	c.curBytes += m.Size
+	c.curBytes += m.diskSize()
 	heap.Push(&c.pq, &pqItem{hash: h, lastAccess: m.LastAccess.UnixNano()})
+	err := c.logPut(h, m)
 	c.enforceLimits()
-	return nil
+	c.maybeCompact()
+	return err
+}
+
+// removeLocked deletes an entry from disk and from the index.
+// Callers must hold the cache lock.
+func (c *FileCacheFS) removeLocked(h string) {
+	m, ok := c.index[h]
+	if !ok {
+		return
+	}
+	_ = os.Remove(c.dataPath(h))
+	_ = os.Remove(c.metaPath(h))
+	delete(c.index, h)
+	c.curBytes -= m.diskSize()
+	_ = c.logDel(h)
 }
 
 // Get returns the cached bytes for key. It updates LastAccess.
+// If the data on disk does not match the recorded size or checksum, the
+// entry is removed and ErrCorrupted is returned.
+//
+// Gets hold the lock in shared mode and do not write to disk: access times
+// are kept in memory and recorded in the index log in batches, by the next
+// operation that takes the exclusive lock or once enough of them pile up.
 func (c *FileCacheFS) Get(key string) ([]byte, error) {
 	if key == "" {
 		return nil, ErrInvalidKey
 	}
 	h := hashKey(key)
 
-	c.mu.RLock()
+	// the lock is held while reading so that another process cannot replace
+	// the files under our feet
+	b, ok, err := c.getShared(h, key)
+	if !ok {
+		b, err = c.getExclusive(h, key)
+	}
+	if err == nil && c.touch(h) {
+		c.lock()
+		c.unlock()
+	}
+	return b, err
+}
+
+// getShared reads the entry holding the shared lock. It returns false when
+// the read must be repeated under the exclusive lock, because the index is
+// not current or the entry is damaged and has to be removed.
+func (c *FileCacheFS) getShared(h, key string) ([]byte, bool, error) {
+	if !c.rlock() {
+		return nil, false, nil
+	}
+	defer c.runlock()
+	b, damaged, err := c.readLocked(h, key)
+	return b, !damaged, err
+}
+
+// getExclusive reads the entry holding the exclusive lock and removes it
+// when damaged.
+func (c *FileCacheFS) getExclusive(h, key string) ([]byte, error) {
+	c.lock()
+	defer c.unlock()
+	b, damaged, err := c.readLocked(h, key)
+	if damaged {
+		c.removeLocked(h)
+	}
+	return b, err
+}
+
+// readLocked reads and verifies the data of an entry without changing the
+// cache. It reports whether the entry is damaged and should be removed.
+// Callers must hold the cache lock, at least in shared mode.
+func (c *FileCacheFS) readLocked(h, key string) ([]byte, bool, error) {
 	m, ok := c.index[h]
-	c.mu.RUnlock()
 	if !ok {
-		return nil, ErrNotFound
+		return nil, false, ErrNotFound
 	}
 
-	dataPath := c.dataPath(h)
-	b, err := os.ReadFile(dataPath)
+	b, err := os.ReadFile(c.dataPath(h))
+	if err == nil {
+		// the index may be ahead of a damaged .meta file: the meta is still
+		// the source of truth used when the index gets rebuilt.
+		var dm *entryMeta
+		dm, err = readMeta(c.metaPath(h))
+		if err == nil && dm.Key != key {
+			err = ErrNotFound
+		}
+	}
 	if err != nil {
-		// file may be missing on disk — treat as not found and remove index
-		c.mu.Lock()
-		delete(c.index, h)
-		c.mu.Unlock()
-		return nil, ErrNotFound
+		// files may be missing or damaged on disk — treat as not found and
+		// remove from index
+		return nil, true, ErrNotFound
 	}
+	if verifyData(m, b) != "" {
+		return nil, true, ErrCorrupted
+	}
+	if m.Codec != "" {
+		b, err = c.decode(m, b)
+		if err != nil {
+			return nil, errors.Is(err, ErrCorrupted), err
+		}
+	}
+	return b, false, nil
+}
 
-	// update last access
-	now := time.Now()
-	c.mu.Lock()
-	m.LastAccess = now
-	// write meta atomically (best-effort)
-	if mb, err := json.Marshal(m); err == nil {
-		_ = os.WriteFile(c.metaPath(h)+".tmp", mb, 0o644)
-		_ = os.Rename(c.metaPath(h)+".tmp", c.metaPath(h))
+// touch records an access to h, to be applied by flushAccessLocked. It
+// reports whether enough accesses are pending to be worth a flush.
+func (c *FileCacheFS) touch(h string) bool {
+	c.atimeMu.Lock()
+	defer c.atimeMu.Unlock()
+	if c.atimes == nil {
+		c.atimes = make(map[string]time.Time)
 	}
-	heap.Push(&c.pq, &pqItem{hash: h, lastAccess: m.LastAccess.UnixNano()})
-	c.mu.Unlock()
+	c.atimes[h] = time.Now()
+	return len(c.atimes) >= accessFlushThreshold
+}
+
+// flushAccessLocked applies the pending access times to the index and
+// appends them to the index log with a single write. The .meta files are
+// left alone: they only matter when the index is rebuilt from scratch.
+// Callers must hold the cache lock.
+func (c *FileCacheFS) flushAccessLocked() {
+	c.atimeMu.Lock()
+	atimes := c.atimes
+	c.atimes = nil
+	c.atimeMu.Unlock()
 
-	return b, nil
+	recs := make([]indexRecord, 0, len(atimes))
+	for h, at := range atimes {
+		m, ok := c.index[h]
+		// skip entries removed or replaced since they were read
+		if !ok || !at.After(m.LastAccess) {
+			continue
+		}
+		m.LastAccess = at
+		heap.Push(&c.pq, &pqItem{hash: h, lastAccess: at.UnixNano()})
+		mm := *m
+		recs = append(recs, indexRecord{Op: opPut, Hash: h, Meta: &mm})
+	}
+	if len(recs) == 0 {
+		return
+	}
+	_ = c.appendIndex(recs...)
+	c.maybeCompact()
 }
 
 // Del removes the cached item for key.
@@ -227,49 +390,43 @@ func (c *FileCacheFS) Del(key string) error {
 		return ErrInvalidKey
 	}
 	h := hashKey(key)
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	m, ok := c.index[h]
-	if !ok {
+	c.lock()
+	defer c.unlock()
+	if _, ok := c.index[h]; !ok {
 		return ErrNotFound
 	}
-	_ = os.Remove(c.dataPath(h))
-	_ = os.Remove(c.metaPath(h))
-	delete(c.index, h)
-	c.curBytes -= m.Size
+	c.removeLocked(h)
+	c.maybeCompact()
 	return nil
 }
 
 // Clean removes all cached items from disk and clears the index.
 func (c *FileCacheFS) Clean() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	entries, err := os.ReadDir(c.dir)
-	if err != nil {
-		return err
-	}
-	for _, e := range entries {
-		name := e.Name()
+	c.lock()
+	defer c.unlock()
+	err := c.walkFiles(func(path, name string) {
 		if filepath.Ext(name) == ".data" || filepath.Ext(name) == ".meta" {
-			_ = os.Remove(filepath.Join(c.dir, name))
+			_ = os.Remove(path)
 		}
+	})
+	if err != nil {
+		return err
 	}
-	c.index = make(map[string]*entryMeta)
-	c.curBytes = 0
-	c.pq = priorityQueue{}
-	heap.Init(&c.pq)
-	return nil
+	c.removeEmptyShards()
+	c.resetIndex()
+	return c.compactIndex()
 }
 
 // Stats computes and returns basic statistics.
 func (c *FileCacheFS) Stats() (Stats, error) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	c.lock()
+	defer c.unlock()
 	var s Stats
 	var last time.Time
 	for _, m := range c.index {
 		s.Count++
 		s.TotalBytes += m.Size
+		s.DiskBytes += m.diskSize()
 		if m.LastAccess.After(last) {
 			last = m.LastAccess
 		}
@@ -284,25 +441,89 @@ func (c *FileCacheFS) StreamPut(key string, r io.Reader) error {
 		return ErrInvalidKey
 	}
 	h := hashKey(key)
-	dataPath := c.dataPath(h)
-	metaPath := c.metaPath(h)
-	tmp := dataPath + ".tmp"
-	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err := c.ensureEntryDir(h); err != nil {
+		return err
+	}
+	// the temp name is unique so that processes writing the same key at the
+	// same time do not clobber each other; the data is written without
+	// holding the lock and only the renames happen under it.
+	f, err := os.CreateTemp(c.entryDir(h), h+".data.*.tmp")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	written, err := io.Copy(f, r)
+	tmp := f.Name()
+	// CreateTemp uses mode 0600: data files get the same mode as the .meta
+	// files and the index log, so that the directory can be shared
+	err = f.Chmod(0o644)
+	sum := sha256.New()
+	disk := &countingWriter{w: io.MultiWriter(f, sum)}
+	var w io.WriteCloser = nopWriteCloser{disk}
+	if err == nil && c.codec != nil {
+		w, err = c.codec.NewWriter(disk)
+	}
+	var written int64
+	if err == nil {
+		written, err = io.Copy(w, r)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
 		_ = os.Remove(tmp)
 		return err
 	}
-	if err := os.Rename(tmp, dataPath); err != nil {
+	m := &entryMeta{
+		Key:        key,
+		Size:       written,
+		LastAccess: time.Now(),
+		Checksum:   hex.EncodeToString(sum.Sum(nil)),
+	}
+	if c.codec != nil {
+		m.Codec = c.codec.Name()
+		m.DiskSize = disk.n
+	}
+
+	c.lock()
+	defer c.unlock()
+	if err := os.Rename(tmp, c.dataPath(h)); err != nil {
 		_ = os.Remove(tmp)
 		return err
 	}
-	m := &entryMeta{Key: key, Size: written, LastAccess: time.Now()}
-	mb, _ := json.Marshal(m)
+	if err := c.writeMeta(h, m); err != nil {
+		return err
+	}
+	return c.insertLocked(h, m)
+}
+
+// decode returns the logical content of an entry stored with a codec.
+func (c *FileCacheFS) decode(m *entryMeta, b []byte) ([]byte, error) {
+	codec, err := c.codecFor(m.Codec)
+	if err != nil {
+		return nil, err
+	}
+	r, err := codec.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	defer r.Close()
+	out, err := io.ReadAll(r)
+	if err != nil || int64(len(out)) != m.Size {
+		return nil, ErrCorrupted
+	}
+	return out, nil
+}
+
+// writeMeta atomically replaces the .meta file of h.
+// Callers must hold the cache lock.
+func (c *FileCacheFS) writeMeta(h string, m *entryMeta) error {
+	mb, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	metaPath := c.metaPath(h)
 	tmpMeta := metaPath + ".tmp"
 	if err := os.WriteFile(tmpMeta, mb, 0o644); err != nil {
 		return err
@@ -311,16 +532,6 @@ func (c *FileCacheFS) StreamPut(key string, r io.Reader) error {
 		_ = os.Remove(tmpMeta)
 		return err
 	}
-
-	c.mu.Lock()
-	if old, ok := c.index[h]; ok {
-		c.curBytes -= old.Size
-	}
-	c.index[h] = m
-	c.curBytes += written
-	heap.Push(&c.pq, &pqItem{hash: h, lastAccess: m.LastAccess.UnixNano()})
-	c.enforceLimits()
-	c.mu.Unlock()
 	return nil
 }
 
@@ -344,10 +555,7 @@ func (c *FileCacheFS) enforceLimits() {
 			continue
 		}
 		// remove actual entry
-		_ = os.Remove(c.dataPath(old.hash))
-		_ = os.Remove(c.metaPath(old.hash))
-		delete(c.index, old.hash)
-		c.curBytes -= m.Size
+		c.removeLocked(old.hash)
 	}
 }
 
@@ -197,3 +197,60 @@ func TestConcurrentAccess(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestGetBatchesAccessTimes(t *testing.T) {
+	cache, dir := setupTempCache(t)
+
+	if err := cache.Put("k", []byte("v")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	before := cache.Index()[hashKey("k")].LastAccess
+	logPath := filepath.Join(dir, indexFile)
+	fi, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		if _, err := cache.Get("k"); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+	}
+	if after, _ := os.Stat(logPath); after.Size() != fi.Size() {
+		t.Errorf("index log grew from %d to %d bytes on Get", fi.Size(), after.Size())
+	}
+
+	// the next exclusive operation records the access time
+	after := cache.Index()[hashKey("k")].LastAccess
+	if !after.After(before) {
+		t.Fatalf("LastAccess = %v, want after %v", after, before)
+	}
+
+	if err := cache.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	reopened, err := New(dir)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer reopened.Close()
+	if got := reopened.Index()[hashKey("k")].LastAccess; !got.Equal(after) {
+		t.Errorf("LastAccess after reopen = %v, want %v", got, after)
+	}
+}
+
+func TestPutCreatesSharedDataFiles(t *testing.T) {
+	cache, _ := setupTempCache(t)
+	if err := cache.Put("k", []byte("v")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	info, err := os.Stat(cache.dataPath(hashKey("k")))
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	// other users sharing the directory must be able to read the entries
+	if perm := info.Mode().Perm(); perm != 0o644 {
+		t.Errorf("data file mode = %v, want %v", perm, os.FileMode(0o644))
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package filecache
+
+// fileLock is a no-op on platforms without flock: only in-process locking
+// applies there.
+type fileLock struct{}
+
+func openFileLock(path string) (*fileLock, error) {
+	return &fileLock{}, nil
+}
+
+func (l *fileLock) lock() error    { return nil }
+func (l *fileLock) unlock() error  { return nil }
+func (l *fileLock) rlock() error   { return nil }
+func (l *fileLock) runlock() error { return nil }
+func (l *fileLock) close() error   { return nil }
@@ -0,0 +1,71 @@
+//go:build unix
+
+package filecache
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// fileLock is an advisory lock (flock) on a file shared by all processes
+// using the same cache directory. It is held exclusively by writers and in
+// shared mode by readers.
+type fileLock struct {
+	f *os.File
+
+	// flock applies to the open file, not to the goroutine: the readers of
+	// this process share a single LOCK_SH, taken by the first one and
+	// released by the last one.
+	mu      sync.Mutex
+	readers int
+}
+
+func openFileLock(path string) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileLock{f: f}, nil
+}
+
+func (l *fileLock) lock() error {
+	return l.flock(syscall.LOCK_EX)
+}
+
+func (l *fileLock) unlock() error {
+	return l.flock(syscall.LOCK_UN)
+}
+
+func (l *fileLock) rlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.readers++
+	if l.readers > 1 {
+		return nil
+	}
+	return l.flock(syscall.LOCK_SH)
+}
+
+func (l *fileLock) runlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.readers--
+	if l.readers > 0 {
+		return nil
+	}
+	return l.flock(syscall.LOCK_UN)
+}
+
+func (l *fileLock) close() error {
+	return l.f.Close()
+}
+
+func (l *fileLock) flock(how int) error {
+	for {
+		err := syscall.Flock(int(l.f.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package filecache
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The index is an append-only log of JSON records stored in the cache
+// directory. The first line is a header carrying the format version; every
+// following line records either the current metadata of an entry ("put") or
+// its removal ("del"). Replaying the log rebuilds the in-memory index without
+// touching the individual .meta files.
+//
+// The log grows with every access, so it is periodically compacted: the
+// current index is written to a temp file as one "put" per entry and renamed
+// over the old log.
+
+const (
+	indexFile    = "index.log"
+	indexVersion = 1
+
+	// compactMinRecords is the minimum number of log records before a
+	// compaction is considered at all.
+	compactMinRecords = 1024
+)
+
+const (
+	opHeader = "hdr"
+	opPut    = "put"
+	opDel    = "del"
+)
+
+var (
+	errCorruptIndex  = errors.New("corrupt index")
+	errLayoutChanged = errors.New("layout changed")
+)
+
+// indexRecord is a single line of the index log.
+type indexRecord struct {
+	Op      string     `json:"op"`
+	Version int        `json:"version,omitempty"`
+	Shard   int        `json:"shard,omitempty"`
+	Hash    string     `json:"hash,omitempty"`
+	Meta    *entryMeta `json:"meta,omitempty"`
+}
+
+func (c *FileCacheFS) indexPath() string {
+	return filepath.Join(c.dir, indexFile)
+}
+
+// loadIndex loads the index log. When the log is missing or corrupt, or it
+// was written with a different directory layout, it falls back to a full
+// directory scan (moving files where the current layout expects them) and
+// rewrites a fresh, compacted log.
+func (c *FileCacheFS) loadIndex() error {
+	torn, err := c.readIndexLog()
+	if err == nil {
+		if torn || c.needsCompaction() {
+			return c.compactIndex()
+		}
+		return c.openIndexLog()
+	}
+
+	c.resetIndex()
+	if err := c.scanDir(); err != nil {
+		return err
+	}
+	return c.compactIndex()
+}
+
+// readIndexLog replays the index log into memory. It reports torn == true
+// when the last line was only partially written (e.g. after a crash), in
+// which case that line is ignored.
+func (c *FileCacheFS) readIndexLog() (torn bool, err error) {
+	f, err := os.Open(c.indexPath())
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	n, torn, err := c.replay(f, true)
+	if err != nil {
+		return false, err
+	}
+	c.logInfo = fi
+	c.logOffset = n
+	return torn, nil
+}
+
+// replay applies the complete records read from r and returns the number of
+// bytes they span. When header is true the first record must be a valid
+// header matching the current layout.
+func (c *FileCacheFS) replay(r io.Reader, header bool) (n int64, torn bool, err error) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			torn = len(bytes.TrimSpace(line)) > 0
+			break
+		}
+		if err != nil {
+			return n, false, err
+		}
+
+		var rec indexRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return n, false, errCorruptIndex
+		}
+		if header {
+			if rec.Op != opHeader || rec.Version != indexVersion {
+				return n, false, errCorruptIndex
+			}
+			if rec.Shard != c.shardWidth {
+				return n, false, errLayoutChanged
+			}
+			header = false
+		} else {
+			if err := c.applyRecord(rec); err != nil {
+				return n, false, err
+			}
+			c.logRecords++
+		}
+		n += int64(len(line))
+	}
+	if header {
+		// empty file or torn header
+		return n, false, errCorruptIndex
+	}
+	return n, torn, nil
+}
+
+// syncLocked replays the records appended to the index log by other
+// processes since the last call. When the log was replaced (by a compaction
+// or a Clean in another process) the whole index is reloaded.
+// Callers must hold the cache lock.
+func (c *FileCacheFS) syncLocked() error {
+	fi, err := os.Stat(c.indexPath())
+	if err != nil || c.logInfo == nil || !os.SameFile(fi, c.logInfo) || fi.Size() < c.logOffset {
+		return c.reloadIndex()
+	}
+	if fi.Size() == c.logOffset {
+		return nil
+	}
+
+	f, err := os.Open(c.indexPath())
+	if err != nil {
+		return c.reloadIndex()
+	}
+	defer f.Close()
+	if _, err := f.Seek(c.logOffset, io.SeekStart); err != nil {
+		return c.reloadIndex()
+	}
+	n, torn, err := c.replay(f, false)
+	if err != nil {
+		return c.reloadIndex()
+	}
+	c.logOffset += n
+	if torn {
+		// a writer crashed halfway: rewrite the log before appending to it
+		return c.compactIndex()
+	}
+	return nil
+}
+
+// reloadIndex discards the in-memory index and loads it again from disk.
+func (c *FileCacheFS) reloadIndex() error {
+	if c.logf != nil {
+		_ = c.logf.Close()
+		c.logf = nil
+	}
+	c.resetIndex()
+	return c.loadIndex()
+}
+
+// applyRecord replays a single log record on the in-memory index.
+func (c *FileCacheFS) applyRecord(rec indexRecord) error {
+	switch rec.Op {
+	case opPut:
+		if rec.Hash == "" || rec.Meta == nil {
+			return errCorruptIndex
+		}
+		if old, ok := c.index[rec.Hash]; ok {
+			c.curBytes -= old.diskSize()
+		}
+		m := *rec.Meta
+		c.index[rec.Hash] = &m
+		c.curBytes += m.diskSize()
+		heap.Push(&c.pq, &pqItem{hash: rec.Hash, lastAccess: m.LastAccess.UnixNano()})
+	case opDel:
+		if old, ok := c.index[rec.Hash]; ok {
+			c.curBytes -= old.diskSize()
+			delete(c.index, rec.Hash)
+		}
+	default:
+		return errCorruptIndex
+	}
+	return nil
+}
+
+// scanDir rebuilds the index reading every .meta file in the directory and
+// its shard subdirectories. Entry files found outside the place expected by
+// the current layout are moved there, which migrates a cache between flat
+// and sharded layouts in place. Malformed entries are skipped.
+func (c *FileCacheFS) scanDir() error {
+	type found struct{ path, name string }
+	var files []found
+	// collect first: relocating while walking could visit a file twice
+	err := c.walkFiles(func(path, name string) {
+		files = append(files, found{path, name})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		ext := filepath.Ext(f.name)
+		if ext != ".data" && ext != ".meta" {
+			continue
+		}
+		hash := strings.TrimSuffix(f.name, ext)
+		path, err := c.relocate(f.path, hash, f.name)
+		if err != nil || ext != ".meta" {
+			continue
+		}
+		m, err := readMeta(path)
+		if err != nil {
+			continue
+		}
+		c.index[hash] = m
+		c.curBytes += m.diskSize()
+		c.pq = append(c.pq, &pqItem{hash: hash, lastAccess: m.LastAccess.UnixNano()})
+	}
+	c.removeEmptyShards()
+	heap.Init(&c.pq)
+	return nil
+}
+
+// resetIndex drops any in-memory state, e.g. after a failed log replay.
+func (c *FileCacheFS) resetIndex() {
+	c.index = make(map[string]*entryMeta)
+	c.curBytes = 0
+	c.pq = priorityQueue{}
+	c.logRecords = 0
+	c.logInfo = nil
+	c.logOffset = 0
+}
+
+func (c *FileCacheFS) openIndexLog() error {
+	f, err := os.OpenFile(c.indexPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	c.logf = f
+	return nil
+}
+
+// appendIndex writes records at the end of the log. Callers must hold
+// the cache lock.
+func (c *FileCacheFS) appendIndex(recs ...indexRecord) error {
+	if c.logf == nil {
+		if err := c.openIndexLog(); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	// a single write keeps the records contiguous
+	n, err := c.logf.Write(buf.Bytes())
+	c.logOffset += int64(n)
+	if err != nil {
+		return err
+	}
+	c.logRecords += len(recs)
+	return nil
+}
+
+func (c *FileCacheFS) logPut(hash string, m *entryMeta) error {
+	mm := *m
+	return c.appendIndex(indexRecord{Op: opPut, Hash: hash, Meta: &mm})
+}
+
+func (c *FileCacheFS) logDel(hash string) error {
+	return c.appendIndex(indexRecord{Op: opDel, Hash: hash})
+}
+
+// needsCompaction reports whether the log holds enough stale records to be
+// worth rewriting.
+func (c *FileCacheFS) needsCompaction() bool {
+	return c.logRecords > compactMinRecords && c.logRecords > 2*len(c.index)
+}
+
+// maybeCompact compacts the log when needed. Callers must hold
+// the cache lock.
+// Compaction is best-effort: on failure the current log keeps being used.
+func (c *FileCacheFS) maybeCompact() {
+	if c.needsCompaction() {
+		_ = c.compactIndex()
+	}
+}
+
+// compactIndex rewrites the log with one record per live entry.
+// Callers must hold the cache lock.
+func (c *FileCacheFS) compactIndex() error {
+	tmp := c.indexPath() + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	err = c.writeSnapshot(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	if c.logf != nil {
+		_ = c.logf.Close()
+		c.logf = nil
+	}
+	if err := os.Rename(tmp, c.indexPath()); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	c.logRecords = len(c.index)
+	if err := c.openIndexLog(); err != nil {
+		return err
+	}
+	fi, err := c.logf.Stat()
+	if err != nil {
+		return err
+	}
+	c.logInfo = fi
+	c.logOffset = fi.Size()
+	return nil
+}
+
+// writeSnapshot writes the header followed by one "put" per live entry.
+func (c *FileCacheFS) writeSnapshot(f *os.File) error {
+	bw := bufio.NewWriter(f)
+	enc := json.NewEncoder(bw)
+	hdr := indexRecord{Op: opHeader, Version: indexVersion, Shard: c.shardWidth}
+	if err := enc.Encode(hdr); err != nil {
+		return err
+	}
+	for h, m := range c.index {
+		if err := enc.Encode(indexRecord{Op: opPut, Hash: h, Meta: m}); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func readMeta(path string) (*entryMeta, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m entryMeta
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
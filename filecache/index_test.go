@@ -0,0 +1,129 @@
+package filecache
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer f.Close()
+	n := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		n++
+	}
+	return n
+}
+
+func TestIndexReloadedOnNew(t *testing.T) {
+	cache, dir := setupTempCache(t)
+
+	for i := 0; i < 5; i++ {
+		if err := cache.Put(fmt.Sprintf("k%d", i), []byte("v")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := cache.Del("k0"); err != nil {
+		t.Fatalf("Del failed: %v", err)
+	}
+
+	cache2, err := New(dir)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	stats, _ := cache2.Stats()
+	if stats.Count != 4 {
+		t.Errorf("Count = %d, want 4", stats.Count)
+	}
+	if stats.TotalBytes != 4 {
+		t.Errorf("TotalBytes = %d, want 4", stats.TotalBytes)
+	}
+	if _, err := cache2.Get("k0"); err == nil {
+		t.Errorf("Expected k0 to stay deleted after reload")
+	}
+}
+
+func TestIndexRebuiltWhenMissingOrCorrupt(t *testing.T) {
+	for name, damage := range map[string]func(path string) error{
+		"missing": os.Remove,
+		"corrupt": func(path string) error {
+			return os.WriteFile(path, []byte("garbage\n{}\n"), 0o644)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cache, dir := setupTempCache(t)
+			if err := cache.Put("a", []byte("aa")); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			if err := cache.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			if err := damage(filepath.Join(dir, indexFile)); err != nil {
+				t.Fatalf("damage index: %v", err)
+			}
+
+			cache2, err := New(dir)
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+			got, err := cache2.Get("a")
+			if err != nil || string(got) != "aa" {
+				t.Errorf("Get = %q, %v; want %q", got, err, "aa")
+			}
+			// the rebuilt index is compacted: header + one entry
+			if n := countLines(t, filepath.Join(dir, indexFile)); n < 2 {
+				t.Errorf("index has %d lines, want at least 2", n)
+			}
+		})
+	}
+}
+
+func TestIndexIgnoresTornTail(t *testing.T) {
+	cache, dir := setupTempCache(t)
+	if err := cache.Put("a", []byte("aa")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, indexFile), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("open index: %v", err)
+	}
+	_, _ = f.WriteString(`{"op":"put","hash":"abc","me`)
+	f.Close()
+
+	cache2, err := New(dir)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if len(cache2.Index()) != 1 {
+		t.Errorf("Index has %d entries, want 1", len(cache2.Index()))
+	}
+	if _, err := cache2.Get("a"); err != nil {
+		t.Errorf("Get a failed: %v", err)
+	}
+}
+
+func TestIndexCompaction(t *testing.T) {
+	cache, dir := setupTempCache(t)
+	if err := cache.Put("a", []byte("aa")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	for i := 0; i < 3*compactMinRecords; i++ {
+		if _, err := cache.Get("a"); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+	}
+
+	if n := countLines(t, filepath.Join(dir, indexFile)); n > compactMinRecords+2 {
+		t.Errorf("index has %d lines, expected compaction", n)
+	}
+}
@@ -0,0 +1,173 @@
+package filecache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// orphanGrace is how old a file must be before it is considered orphaned.
+// Younger files may belong to a write still in progress.
+const orphanGrace = 10 * time.Minute
+
+// Reasons reported in Damage.
+const (
+	DamageMissingData = "missing data"
+	DamageMissingMeta = "missing meta"
+	DamageBadMeta     = "unreadable meta"
+	DamageSize        = "size mismatch"
+	DamageChecksum    = "checksum mismatch"
+)
+
+// Damage describes an index entry that failed verification.
+type Damage struct {
+	Hash   string `json:"hash"`
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+// Report is the outcome of Verify and Repair.
+type Report struct {
+	Checked int      `json:"checked"` // number of index entries checked
+	Damaged []Damage `json:"damaged"` // entries failing verification
+	Orphans []string `json:"orphans"` // paths of files not belonging to any entry
+}
+
+// OK reports whether no damage and no orphans were found.
+func (r Report) OK() bool {
+	return len(r.Damaged) == 0 && len(r.Orphans) == 0
+}
+
+// Verify checks every entry against its files on disk (meta, size and
+// checksum) and looks for orphaned files. It does not modify the cache.
+func (c *FileCacheFS) Verify() (Report, error) {
+	return c.check(false)
+}
+
+// Repair runs the same checks as Verify and removes damaged entries and
+// orphaned files. The returned report lists what was removed.
+func (c *FileCacheFS) Repair() (Report, error) {
+	return c.check(true)
+}
+
+func (c *FileCacheFS) check(repair bool) (Report, error) {
+	c.lock()
+	defer c.unlock()
+
+	var rep Report
+	for h, m := range c.index {
+		rep.Checked++
+		if reason := c.verifyEntry(h, m); reason != "" {
+			rep.Damaged = append(rep.Damaged, Damage{Hash: h, Key: m.Key, Reason: reason})
+		}
+	}
+
+	orphans, _, err := c.findOrphans(time.Now().Add(-orphanGrace))
+	if err != nil {
+		return rep, err
+	}
+	rep.Orphans = orphans
+
+	if repair {
+		for _, d := range rep.Damaged {
+			c.removeLocked(d.Hash)
+		}
+		for _, p := range rep.Orphans {
+			_ = os.Remove(p)
+		}
+		c.removeEmptyShards()
+		c.maybeCompact()
+	}
+	return rep, nil
+}
+
+// verifyEntry returns a non-empty reason when the entry is damaged.
+func (c *FileCacheFS) verifyEntry(h string, m *entryMeta) string {
+	dm, err := readMeta(c.metaPath(h))
+	switch {
+	case os.IsNotExist(err):
+		return DamageMissingMeta
+	case err != nil || dm.Key != m.Key:
+		return DamageBadMeta
+	}
+
+	b, err := os.ReadFile(c.dataPath(h))
+	if err != nil {
+		return DamageMissingData
+	}
+	return verifyData(m, b)
+}
+
+// verifyData checks the content b of a data file against the size and
+// checksum recorded in m. Entries written before checksums were introduced
+// only get a size check.
+func verifyData(m *entryMeta, b []byte) string {
+	if int64(len(b)) != m.diskSize() {
+		return DamageSize
+	}
+	if m.Checksum != "" && checksum(b) != m.Checksum {
+		return DamageChecksum
+	}
+	return ""
+}
+
+// findOrphans lists files older than cutoff that do not belong to a live
+// entry: leftover .tmp files and .data/.meta files with no index entry.
+// It also returns the set of hashes having a .data file on disk.
+// Callers must hold the cache lock.
+func (c *FileCacheFS) findOrphans(cutoff time.Time) ([]string, map[string]struct{}, error) {
+	var out []string
+	data := make(map[string]struct{}, len(c.index))
+	err := c.walkFiles(func(path, name string) {
+		ext := filepath.Ext(name)
+		switch ext {
+		case ".tmp":
+		case ".data", ".meta":
+			h := strings.TrimSuffix(name, ext)
+			if ext == ".data" {
+				data[h] = struct{}{}
+			}
+			if _, ok := c.index[h]; ok {
+				return
+			}
+		default:
+			return
+		}
+		// only stat candidates, most files are skipped by name alone
+		fi, err := os.Stat(path)
+		if err != nil || fi.ModTime().After(cutoff) {
+			return
+		}
+		out = append(out, path)
+	})
+	return out, data, err
+}
+
+// sweepOrphans removes orphaned files left behind by interrupted writes
+// and drops index entries whose data file vanished. It only lists
+// directory names, so it stays cheap on large caches.
+// Callers must hold the cache lock.
+func (c *FileCacheFS) sweepOrphans() error {
+	orphans, data, err := c.findOrphans(time.Now().Add(-orphanGrace))
+	if err != nil {
+		return err
+	}
+	for _, p := range orphans {
+		_ = os.Remove(p)
+	}
+	for h := range c.index {
+		if _, ok := data[h]; !ok {
+			c.removeLocked(h)
+		}
+	}
+	return nil
+}
+
+// checksum returns the hex sha256 of b.
+func checksum(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,129 @@
+package filecache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func makeOld(t *testing.T, path string) {
+	t.Helper()
+	old := time.Now().Add(-2 * orphanGrace)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("chtimes %s: %v", path, err)
+	}
+}
+
+func TestGetDetectsCorruptedData(t *testing.T) {
+	cache, dir := setupTempCache(t)
+	if err := cache.Put("k", []byte("hello")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// same size, different content
+	dataPath := filepath.Join(dir, hashKey("k")+".data")
+	if err := os.WriteFile(dataPath, []byte("HELLO"), 0o644); err != nil {
+		t.Fatalf("write data: %v", err)
+	}
+
+	if _, err := cache.Get("k"); err != ErrCorrupted {
+		t.Errorf("Get err = %v, want ErrCorrupted", err)
+	}
+	if _, err := os.Stat(dataPath); !os.IsNotExist(err) {
+		t.Errorf("expected corrupted data to be removed, got %v", err)
+	}
+	if _, err := cache.Get("k"); err != ErrNotFound {
+		t.Errorf("second Get err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestOrphansSweptOnNew(t *testing.T) {
+	cache, dir := setupTempCache(t)
+	if err := cache.Put("live", []byte("v")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	orphans := []string{
+		filepath.Join(dir, hashKey("a")+".data.tmp"),
+		filepath.Join(dir, hashKey("b")+".data"),
+		filepath.Join(dir, hashKey("c")+".meta"),
+	}
+	for _, p := range orphans {
+		if err := os.WriteFile(p, []byte("x"), 0o644); err != nil {
+			t.Fatalf("write orphan: %v", err)
+		}
+		makeOld(t, p)
+	}
+	fresh := filepath.Join(dir, hashKey("d")+".data.tmp")
+	if err := os.WriteFile(fresh, []byte("x"), 0o644); err != nil {
+		t.Fatalf("write tmp: %v", err)
+	}
+
+	if _, err := New(dir); err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	for _, p := range orphans {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("expected orphan %s to be removed, got %v", filepath.Base(p), err)
+		}
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("recent tmp file must be kept (write in progress): %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, hashKey("live")+".data")); err != nil {
+		t.Errorf("live entry removed: %v", err)
+	}
+}
+
+func TestVerifyAndRepair(t *testing.T) {
+	cache, dir := setupTempCache(t)
+	for _, k := range []string{"ok", "truncated", "nometa"} {
+		if err := cache.Put(k, []byte("payload")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := os.Truncate(filepath.Join(dir, hashKey("truncated")+".data"), 3); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, hashKey("nometa")+".meta")); err != nil {
+		t.Fatalf("remove meta: %v", err)
+	}
+	orphan := filepath.Join(dir, hashKey("gone")+".meta.tmp")
+	if err := os.WriteFile(orphan, []byte("{}"), 0o644); err != nil {
+		t.Fatalf("write orphan: %v", err)
+	}
+	makeOld(t, orphan)
+
+	rep, err := cache.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if rep.Checked != 3 || len(rep.Damaged) != 2 || len(rep.Orphans) != 1 {
+		t.Fatalf("unexpected report: %+v", rep)
+	}
+	reasons := map[string]string{}
+	for _, d := range rep.Damaged {
+		reasons[d.Key] = d.Reason
+	}
+	if reasons["truncated"] != DamageSize || reasons["nometa"] != DamageMissingMeta {
+		t.Errorf("unexpected reasons: %v", reasons)
+	}
+	if len(cache.Index()) != 3 {
+		t.Errorf("Verify must not modify the cache")
+	}
+
+	if _, err := cache.Repair(); err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	rep, err = cache.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if !rep.OK() || rep.Checked != 1 {
+		t.Errorf("expected clean cache after Repair, got %+v", rep)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("expected orphan to be removed, got %v", err)
+	}
+}
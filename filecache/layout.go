@@ -0,0 +1,105 @@
+package filecache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxShardWidth caps the fan-out to 16^4 = 65536 subdirectories.
+const maxShardWidth = 4
+
+// entryDir returns the directory holding the files of hash.
+func (c *FileCacheFS) entryDir(hash string) string {
+	if c.shardWidth == 0 || len(hash) < c.shardWidth {
+		return c.dir
+	}
+	return filepath.Join(c.dir, hash[:c.shardWidth])
+}
+
+// ensureEntryDir creates the shard directory of hash if needed.
+func (c *FileCacheFS) ensureEntryDir(hash string) error {
+	if c.shardWidth == 0 {
+		return nil
+	}
+	return os.MkdirAll(c.entryDir(hash), 0o755)
+}
+
+// isShardDir reports whether name looks like a shard directory created by
+// any supported layout.
+func isShardDir(name string) bool {
+	if len(name) == 0 || len(name) > maxShardWidth {
+		return false
+	}
+	return isHex(name)
+}
+
+func isHex(s string) bool {
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// walkFiles calls fn for every regular file in the cache directory and in
+// its shard subdirectories, whatever the layout they were written with.
+func (c *FileCacheFS) walkFiles(fn func(path, name string)) error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() {
+			fn(filepath.Join(c.dir, name), name)
+			continue
+		}
+		if !isShardDir(name) {
+			continue
+		}
+		sub := filepath.Join(c.dir, name)
+		files, err := os.ReadDir(sub)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if !f.IsDir() {
+				fn(filepath.Join(sub, f.Name()), f.Name())
+			}
+		}
+	}
+	return nil
+}
+
+// relocate moves the file at path to where the current layout expects it.
+// It returns the final path.
+func (c *FileCacheFS) relocate(path, hash, name string) (string, error) {
+	want := filepath.Join(c.entryDir(hash), name)
+	if want == path {
+		return path, nil
+	}
+	if err := c.ensureEntryDir(hash); err != nil {
+		return path, err
+	}
+	if err := os.Rename(path, want); err != nil {
+		return path, err
+	}
+	return want, nil
+}
+
+// removeEmptyShards drops shard subdirectories left empty, e.g. after a
+// migration to a different layout or a Clean.
+func (c *FileCacheFS) removeEmptyShards() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() && isShardDir(e.Name()) {
+			// os.Remove fails on non-empty directories, which is what we want
+			_ = os.Remove(filepath.Join(c.dir, e.Name()))
+		}
+	}
+}
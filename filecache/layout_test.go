@@ -0,0 +1,87 @@
+package filecache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShardedLayout(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewWithOptions(dir, Options{ShardWidth: 2})
+	if err != nil {
+		t.Fatalf("NewWithOptions failed: %v", err)
+	}
+
+	if err := cache.Put("k", []byte("v")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	h := hashKey("k")
+	for _, ext := range []string{".data", ".meta"} {
+		if _, err := os.Stat(filepath.Join(dir, h[:2], h+ext)); err != nil {
+			t.Errorf("expected %s under shard dir: %v", ext, err)
+		}
+	}
+
+	if err := cache.Clean(); err != nil {
+		t.Fatalf("Clean failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, h[:2])); !os.IsNotExist(err) {
+		t.Errorf("expected shard dir to be removed by Clean, got %v", err)
+	}
+}
+
+func TestMigrateFlatToSharded(t *testing.T) {
+	flat, dir := setupTempCache(t)
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		if err := flat.Put(keys[i], []byte(keys[i])); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := flat.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	sharded, err := NewWithOptions(dir, Options{ShardWidth: 1})
+	if err != nil {
+		t.Fatalf("NewWithOptions failed: %v", err)
+	}
+	for _, k := range keys {
+		got, err := sharded.Get(k)
+		if err != nil || string(got) != k {
+			t.Errorf("Get(%s) = %q, %v", k, got, err)
+		}
+		h := hashKey(k)
+		if _, err := os.Stat(filepath.Join(dir, h[:1], h+".data")); err != nil {
+			t.Errorf("expected %s to be moved in shard dir: %v", k, err)
+		}
+	}
+	if err := sharded.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// and back to flat
+	back, err := New(dir)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if n := len(back.Index()); n != len(keys) {
+		t.Errorf("Index has %d entries, want %d", n, len(keys))
+	}
+	h := hashKey(keys[0])
+	if _, err := os.Stat(filepath.Join(dir, h+".data")); err != nil {
+		t.Errorf("expected data back in flat layout: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, h[:1])); !os.IsNotExist(err) {
+		t.Errorf("expected empty shard dir to be removed, got %v", err)
+	}
+}
+
+func TestInvalidShardWidth(t *testing.T) {
+	if _, err := NewWithOptions(t.TempDir(), Options{ShardWidth: 5}); err != ErrInvalidOptions {
+		t.Errorf("err = %v, want ErrInvalidOptions", err)
+	}
+}
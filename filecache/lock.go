@@ -0,0 +1,62 @@
+package filecache
+
+import (
+	"os"
+
+	"github.com/lucasepe/x/log"
+)
+
+// lockFile is the name of the file used for cross-process locking.
+const lockFile = "lock"
+
+// lock acquires the in-process mutex and the cross-process file lock, then
+// brings the in-memory index up to date with the changes made by other
+// processes sharing the directory and applies the pending access times.
+func (c *FileCacheFS) lock() {
+	c.mu.Lock()
+	c.checkLock(c.flock.lock())
+	_ = c.syncLocked()
+	c.flushAccessLocked()
+}
+
+// unlock releases the locks acquired by lock.
+func (c *FileCacheFS) unlock() {
+	_ = c.flock.unlock()
+	c.mu.Unlock()
+}
+
+// rlock acquires the in-process mutex and the cross-process file lock in
+// shared mode, so that readers do not exclude each other. It reports
+// whether the in-memory index is current: syncing it with the log requires
+// the exclusive lock, so when other processes changed the cache the locks
+// are released and rlock returns false.
+func (c *FileCacheFS) rlock() bool {
+	c.mu.RLock()
+	c.checkLock(c.flock.rlock())
+	fi, err := os.Stat(c.indexPath())
+	if err != nil || c.logInfo == nil || !os.SameFile(fi, c.logInfo) || fi.Size() != c.logOffset {
+		c.runlock()
+		return false
+	}
+	return true
+}
+
+// runlock releases the locks acquired by rlock.
+func (c *FileCacheFS) runlock() {
+	_ = c.flock.runlock()
+	c.mu.RUnlock()
+}
+
+// checkLock reports the first failure to acquire the file lock. Advisory
+// locks are not available everywhere (e.g. on some network filesystems):
+// in that case only in-process locking applies, and processes sharing the
+// directory may see each other's partial changes.
+func (c *FileCacheFS) checkLock(err error) {
+	if err == nil {
+		return
+	}
+	c.lockErrOnce.Do(func() {
+		log.E("unable to lock cache directory, cross-process locking disabled",
+			log.String("dir", c.dir), log.Err("err", err))
+	})
+}
@@ -0,0 +1,158 @@
+package filecache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Two FileCacheFS on the same directory stand in for two processes: each
+// one has its own index, lock file descriptor and log handle.
+func openShared(t *testing.T) (*FileCacheFS, *FileCacheFS) {
+	t.Helper()
+	a, dir := setupTempCache(t)
+	b, err := New(dir)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return a, b
+}
+
+func TestSharedDirSeesOtherWriters(t *testing.T) {
+	a, b := openShared(t)
+
+	if err := a.Put("k", []byte("from a")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	got, err := b.Get("k")
+	if err != nil || string(got) != "from a" {
+		t.Fatalf("b.Get = %q, %v", got, err)
+	}
+
+	if err := b.Del("k"); err != nil {
+		t.Fatalf("Del failed: %v", err)
+	}
+	if _, err := a.Get("k"); err != ErrNotFound {
+		t.Errorf("a.Get after b.Del err = %v, want ErrNotFound", err)
+	}
+
+	// a compaction (here through Clean) replaces the log under b's feet
+	if err := b.Put("x", []byte("1")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := a.Clean(); err != nil {
+		t.Fatalf("Clean failed: %v", err)
+	}
+	if s, _ := b.Stats(); s.Count != 0 {
+		t.Errorf("b.Stats().Count = %d after a.Clean, want 0", s.Count)
+	}
+}
+
+func TestSharedDirConsistentLimits(t *testing.T) {
+	a, b := openShared(t)
+	a.ConfigureLimits(3, 0)
+
+	for i := 0; i < 3; i++ {
+		if err := b.Put(fmt.Sprintf("b%d", i), []byte("v")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	// a sees b's entries, so its own Put must evict one of them
+	if err := a.Put("a0", []byte("v")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	for _, c := range []*FileCacheFS{a, b} {
+		if s, _ := c.Stats(); s.Count != 3 {
+			t.Errorf("Stats().Count = %d, want 3", s.Count)
+		}
+	}
+}
+
+func TestSharedDirConcurrentWriters(t *testing.T) {
+	a, b := openShared(t)
+
+	var wg sync.WaitGroup
+	for i, c := range []*FileCacheFS{a, b, a, b} {
+		wg.Add(1)
+		go func(i int, c *FileCacheFS) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				k := fmt.Sprintf("k-%d", j%10)
+				_ = c.Put(k, []byte(fmt.Sprintf("v-%d-%d", i, j)))
+				_, _ = c.Get(k)
+				if j%7 == 0 {
+					_ = c.Del(k)
+				}
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	ia, ib := a.Index(), b.Index()
+	if len(ia) != len(ib) {
+		t.Fatalf("indexes diverged: %d vs %d entries", len(ia), len(ib))
+	}
+	for h, m := range ia {
+		if ib[h].Checksum != m.Checksum {
+			t.Errorf("entry %s differs between processes", m.Key)
+		}
+	}
+	rep, err := a.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if len(rep.Damaged) != 0 {
+		t.Errorf("damaged entries after concurrent writes: %+v", rep.Damaged)
+	}
+}
+
+func TestSharedDirConcurrentReaders(t *testing.T) {
+	a, b := openShared(t)
+	for i := 0; i < 10; i++ {
+		if err := a.Put(fmt.Sprintf("k-%d", i), []byte("v")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range []*FileCacheFS{a, b, a, b} {
+		wg.Add(1)
+		go func(c *FileCacheFS) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if _, err := c.Get(fmt.Sprintf("k-%d", j%10)); err != nil {
+					t.Errorf("Get failed: %v", err)
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	// a shared lock leaked by a reader would block this Put forever
+	if err := b.Put("k-0", []byte("w")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if got, err := a.Get("k-0"); err != nil || string(got) != "w" {
+		t.Errorf("a.Get = %q, %v, want \"w\"", got, err)
+	}
+}
+
+func TestCloseReleasesLock(t *testing.T) {
+	a, b := openShared(t)
+	if err := a.Put("k", []byte("v")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := a.Close(); err != nil {
+		t.Errorf("second Close = %v, want nil", err)
+	}
+	if err := b.Put("k", []byte("w")); err != nil {
+		t.Fatalf("Put after Close failed: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
@@ -0,0 +1,27 @@
+package filecache
+
+import "errors"
+
+// ErrInvalidOptions is returned by NewWithOptions for unsupported options.
+var ErrInvalidOptions = errors.New("invalid options")
+
+// Options configures a FileCacheFS created with NewWithOptions.
+type Options struct {
+	// ShardWidth is the number of leading hex chars of the key hash used as
+	// subdirectory name: with 2, the entry "abcd..." is stored under
+	// <dir>/ab/abcd....data. Zero keeps all files flat in dir.
+	// Valid values are 0 to 4.
+	ShardWidth int
+
+	// Codec, when set, compresses entries on disk. Get transparently
+	// decompresses them; size limits apply to the compressed (on-disk) size.
+	// Entries written before the codec was set are still readable.
+	Codec Codec
+}
+
+func (o Options) validate() error {
+	if o.ShardWidth < 0 || o.ShardWidth > maxShardWidth {
+		return ErrInvalidOptions
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package filecache
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+// TieredCache keeps the most recently used entries in memory in front of a
+// FileCacheFS. Writes go through to disk; reads are served from memory when
+// possible and fall back to disk otherwise.
+//
+// Concurrent misses for the same key are de-duplicated: only one goroutine
+// reads the disk (or runs the loader passed to GetOrLoad) while the others
+// wait for its result.
+//
+// Writes to the same key (Put, Del and the disk write after a load) are
+// serialized, so both tiers end up holding the value of the last write.
+//
+// The memory tier is private to the process: entries changed on disk by
+// other processes sharing the directory are not invalidated in memory.
+type TieredCache struct {
+	disk *FileCacheFS
+
+	mu       sync.Mutex
+	maxBytes int64
+	curBytes int64
+	ll       *list.List               // front = most recently used
+	items    map[string]*list.Element // key -> *memEntry element
+	flights  map[string]*flight
+	keyLocks map[string]*keyLock
+}
+
+// keyLock serializes writes to one key; refs counts holders and waiters so
+// the lock can be dropped when unused.
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+type memEntry struct {
+	key        string
+	data       []byte
+	lastAccess time.Time
+}
+
+// flight is an in-progress load shared by concurrent callers.
+type flight struct {
+	done  chan struct{}
+	data  []byte
+	err   error
+	stale bool // key was written meanwhile: do not keep data in memory
+}
+
+// NewTiered returns a TieredCache keeping at most maxMemBytes of data in
+// memory in front of disk. With maxMemBytes <= 0 the memory tier is
+// disabled and only miss de-duplication applies.
+func NewTiered(disk *FileCacheFS, maxMemBytes int64) *TieredCache {
+	return &TieredCache{
+		disk:     disk,
+		maxBytes: maxMemBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		flights:  make(map[string]*flight),
+		keyLocks: make(map[string]*keyLock),
+	}
+}
+
+// Disk returns the underlying disk cache.
+func (t *TieredCache) Disk() *FileCacheFS {
+	return t.disk
+}
+
+// Get returns the cached bytes for key, from memory if present or else from
+// disk (promoting the entry to memory). The returned slice is a copy and may
+// be modified by the caller.
+func (t *TieredCache) Get(key string) ([]byte, error) {
+	return t.GetOrLoad(key, nil)
+}
+
+// GetOrLoad is like Get but, when key is in neither tier, calls load and
+// stores its result in both tiers. Concurrent calls for the same key share
+// a single disk read and a single load.
+//
+// If load succeeds but writing to disk fails, the loaded data is returned
+// together with the write error.
+func (t *TieredCache) GetOrLoad(key string, load func() ([]byte, error)) ([]byte, error) {
+	if key == "" {
+		return nil, ErrInvalidKey
+	}
+
+	t.mu.Lock()
+	if data, ok := t.memGetLocked(key); ok {
+		t.mu.Unlock()
+		return clone(data), nil
+	}
+	if f, ok := t.flights[key]; ok {
+		t.mu.Unlock()
+		<-f.done
+		return clone(f.data), f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	t.flights[key] = f
+	t.mu.Unlock()
+
+	f.data, f.err = t.fill(key, f, load)
+
+	t.mu.Lock()
+	delete(t.flights, key)
+	if f.data != nil && !f.stale {
+		t.memPutLocked(key, f.data)
+	}
+	t.mu.Unlock()
+	close(f.done)
+
+	return clone(f.data), f.err
+}
+
+// fill reads key from disk or, on a miss, from load. The loaded data is not
+// written to disk if a Put or Del of the key happened meanwhile.
+func (t *TieredCache) fill(key string, f *flight, load func() ([]byte, error)) ([]byte, error) {
+	data, err := t.disk.Get(key)
+	if err == nil || load == nil {
+		return data, err
+	}
+	if !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrCorrupted) {
+		return nil, err
+	}
+
+	data, err = load()
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := t.lockKey(key)
+	defer unlock()
+	t.mu.Lock()
+	stale := f.stale
+	t.mu.Unlock()
+	if stale {
+		return data, nil
+	}
+	return data, t.disk.Put(key, data)
+}
+
+// Put stores data in both tiers. The disk is written first: on failure the
+// memory tier is left untouched.
+func (t *TieredCache) Put(key string, data []byte) error {
+	unlock := t.lockKey(key)
+	defer unlock()
+
+	if err := t.disk.Put(key, data); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.invalidateFlightLocked(key)
+	t.memPutLocked(key, clone(data))
+	t.mu.Unlock()
+	return nil
+}
+
+// Del removes key from both tiers. The disk entry is removed first, so a
+// concurrent load cannot bring the old value back into memory.
+func (t *TieredCache) Del(key string) error {
+	unlock := t.lockKey(key)
+	defer unlock()
+
+	err := t.disk.Del(key)
+	t.mu.Lock()
+	t.invalidateFlightLocked(key)
+	t.memDelLocked(key)
+	t.mu.Unlock()
+	return err
+}
+
+// lockKey acquires the write lock of key and returns its release function.
+func (t *TieredCache) lockKey(key string) func() {
+	t.mu.Lock()
+	kl, ok := t.keyLocks[key]
+	if !ok {
+		kl = &keyLock{}
+		t.keyLocks[key] = kl
+	}
+	kl.refs++
+	t.mu.Unlock()
+
+	kl.mu.Lock()
+	return func() {
+		kl.mu.Unlock()
+		t.mu.Lock()
+		if kl.refs--; kl.refs == 0 {
+			delete(t.keyLocks, key)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Clean empties both tiers.
+func (t *TieredCache) Clean() error {
+	t.mu.Lock()
+	t.ll.Init()
+	t.items = make(map[string]*list.Element)
+	t.curBytes = 0
+	t.mu.Unlock()
+	return t.disk.Clean()
+}
+
+// MemStats returns statistics about the memory tier only.
+func (t *TieredCache) MemStats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := Stats{Count: t.ll.Len(), TotalBytes: t.curBytes}
+	if e := t.ll.Front(); e != nil {
+		s.LastAccess = e.Value.(*memEntry).lastAccess
+	}
+	return s
+}
+
+func (t *TieredCache) memGetLocked(key string) ([]byte, bool) {
+	e, ok := t.items[key]
+	if !ok {
+		return nil, false
+	}
+	me := e.Value.(*memEntry)
+	me.lastAccess = time.Now()
+	t.ll.MoveToFront(e)
+	return me.data, true
+}
+
+func (t *TieredCache) memPutLocked(key string, data []byte) {
+	t.memDelLocked(key)
+	size := int64(len(data))
+	if t.maxBytes <= 0 || size > t.maxBytes {
+		// would evict everything else without fitting anyway
+		return
+	}
+	me := &memEntry{key: key, data: data, lastAccess: time.Now()}
+	t.items[key] = t.ll.PushFront(me)
+	t.curBytes += size
+	for t.curBytes > t.maxBytes {
+		t.memDelLocked(t.ll.Back().Value.(*memEntry).key)
+	}
+}
+
+func (t *TieredCache) memDelLocked(key string) {
+	e, ok := t.items[key]
+	if !ok {
+		return
+	}
+	t.ll.Remove(e)
+	delete(t.items, key)
+	t.curBytes -= int64(len(e.Value.(*memEntry).data))
+}
+
+// invalidateFlightLocked prevents an in-progress load from caching in
+// memory a value older than a concurrent write.
+func (t *TieredCache) invalidateFlightLocked(key string) {
+	if f, ok := t.flights[key]; ok {
+		f.stale = true
+	}
+}
+
+func clone(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
@@ -0,0 +1,177 @@
+package filecache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTieredServesHotKeysFromMemory(t *testing.T) {
+	disk, dir := setupTempCache(t)
+	tc := NewTiered(disk, 1024)
+
+	if err := tc.Put("k", []byte("value")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	// write-through
+	if got, err := disk.Get("k"); err != nil || string(got) != "value" {
+		t.Fatalf("disk.Get = %q, %v", got, err)
+	}
+
+	// removing the data file behind the cache's back proves the hit comes
+	// from memory
+	if err := os.Remove(filepath.Join(dir, hashKey("k")+".data")); err != nil {
+		t.Fatalf("remove data: %v", err)
+	}
+	got, err := tc.Get("k")
+	if err != nil || string(got) != "value" {
+		t.Fatalf("Get = %q, %v", got, err)
+	}
+	got[0] = 'X'
+	if again, _ := tc.Get("k"); string(again) != "value" {
+		t.Errorf("memory tier must not share slices with callers, got %q", again)
+	}
+}
+
+func TestTieredEvictsLRUFromMemory(t *testing.T) {
+	disk, _ := setupTempCache(t)
+	tc := NewTiered(disk, 10)
+
+	for _, k := range []string{"a", "b", "c"} {
+		if err := tc.Put(k, []byte("1234")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	s := tc.MemStats()
+	if s.Count != 2 || s.TotalBytes != 8 {
+		t.Errorf("MemStats = %+v, want 2 entries / 8 bytes", s)
+	}
+	// "a" was evicted from memory but is still on disk
+	if got, err := tc.Get("a"); err != nil || string(got) != "1234" {
+		t.Errorf("Get(a) = %q, %v", got, err)
+	}
+	if err := tc.Put("big", make([]byte, 11)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if s := tc.MemStats(); s.Count != 2 {
+		t.Errorf("entries larger than the memory limit must stay on disk only, got %+v", s)
+	}
+}
+
+func TestTieredSingleFlightLoad(t *testing.T) {
+	disk, _ := setupTempCache(t)
+	tc := NewTiered(disk, 1024)
+
+	var loads int32
+	release := make(chan struct{})
+	load := func() ([]byte, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return []byte("loaded"), nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]string, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b, err := tc.GetOrLoad("k", load)
+			if err != nil {
+				t.Errorf("GetOrLoad failed: %v", err)
+			}
+			results[i] = string(b)
+		}(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Errorf("load called %d times, want 1", n)
+	}
+	for _, r := range results {
+		if r != "loaded" {
+			t.Errorf("unexpected result %q", r)
+		}
+	}
+	if got, err := disk.Get("k"); err != nil || string(got) != "loaded" {
+		t.Errorf("loaded value not written to disk: %q, %v", got, err)
+	}
+}
+
+func TestTieredLoadError(t *testing.T) {
+	disk, _ := setupTempCache(t)
+	tc := NewTiered(disk, 1024)
+
+	boom := errors.New("boom")
+	if _, err := tc.GetOrLoad("k", func() ([]byte, error) { return nil, boom }); err != boom {
+		t.Errorf("err = %v, want %v", err, boom)
+	}
+	if _, err := tc.Get("k"); err != ErrNotFound {
+		t.Errorf("failed loads must not be cached, got %v", err)
+	}
+}
+
+func TestTieredDelDuringLoadIsNotResurrected(t *testing.T) {
+	disk, _ := setupTempCache(t)
+	tc := NewTiered(disk, 1024)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tc.GetOrLoad("k", func() ([]byte, error) {
+			close(started)
+			<-release
+			return []byte("old"), nil
+		})
+	}()
+
+	<-started
+	if err := tc.Del("k"); err != nil && !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Del failed: %v", err)
+	}
+	close(release)
+	<-done
+
+	if _, err := tc.Get("k"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted key served again, err = %v", err)
+	}
+}
+
+func TestTieredConcurrentPutsKeepTiersConsistent(t *testing.T) {
+	disk, _ := setupTempCache(t)
+	tc := NewTiered(disk, 1024)
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := tc.Put("k", []byte{byte('a' + i)}); err != nil {
+				t.Errorf("Put failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	mem, err := tc.Get("k")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	onDisk, err := disk.Get("k")
+	if err != nil {
+		t.Fatalf("disk.Get failed: %v", err)
+	}
+	if string(mem) != string(onDisk) {
+		t.Errorf("memory holds %q, disk holds %q", mem, onDisk)
+	}
+	if len(tc.keyLocks) != 0 {
+		t.Errorf("key locks leaked: %d", len(tc.keyLocks))
+	}
+}
@@ -7,6 +7,7 @@ require (
 	github.com/mattn/go-runewidth v0.0.16
 	github.com/stretchr/testify v1.10.0
 	golang.org/x/image v0.33.0
+	golang.org/x/net v0.47.0
 	golang.org/x/text v0.31.0
 	golang.org/x/time v0.14.0
 )
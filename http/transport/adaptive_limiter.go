@@ -0,0 +1,215 @@
+package transport
+
+import (
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// HostRateOverride imposta limiti specifici per gli host che corrispondono
+// a Pattern.
+type HostRateOverride struct {
+	// Pattern e' confrontato con l'hostname (senza porta) tramite path.Match,
+	// ad esempio "api.example.com" o "*.example.com".
+	Pattern string
+	Rate    rate.Limit
+	// Burst, se <= 0, eredita quello delle opzioni generali.
+	Burst int
+	// MinRate, se <= 0, eredita quello delle opzioni generali.
+	MinRate rate.Limit
+}
+
+// AdaptiveLimiterOptions configura [NewAdaptiveHostLimiter].
+type AdaptiveLimiterOptions struct {
+	// Rate e' il rate iniziale e massimo di ogni host. Deve essere finito; se
+	// <= 0 usa 1 richiesta al secondo.
+	Rate rate.Limit
+	// Burst e' il burst di ogni host. Se <= 0 usa 1.
+	Burst int
+	// MinRate e' il rate minimo sotto cui un host non scende. Se <= 0 usa una
+	// richiesta al minuto.
+	MinRate rate.Limit
+	// Decrease moltiplica il rate di un host a ogni risposta di throttling.
+	// Se non e' compreso tra 0 e 1 usa 0.5.
+	Decrease float64
+	// Increase e' la frazione del rate massimo recuperata a ogni risposta
+	// riuscita (2xx o 3xx). Se <= 0 usa 0.05.
+	Increase float64
+	// StatusCodes elenca le risposte di throttling. Se vuoto usa 429 e 503.
+	// Retry-After viene considerato solo su queste risposte: su una 301 o
+	// una 200 non sospende l'host.
+	StatusCodes []int
+	// MaxPause limita la pausa imposta da Retry-After. Se <= 0 la pausa non
+	// ha limiti.
+	MaxPause time.Duration
+	// Overrides definisce limiti per host specifici; vince il primo pattern
+	// che corrisponde.
+	Overrides []HostRateOverride
+	// OnRateChange, se valorizzato, viene invocato a ogni variazione del rate
+	// di un host. E' chiamato con il lock interno acquisito: deve essere
+	// rapido e non deve usare il transport.
+	OnRateChange func(host string, from, to rate.Limit)
+}
+
+// AdaptiveHostLimiter e' un rate limiter per host che si adatta alle
+// risposte del server in stile AIMD: dimezza (di default) il rate di un host
+// a ogni 429/503 e lo recupera gradualmente a ogni risposta riuscita. Se la
+// risposta di throttling ha Retry-After sospende del tutto l'host fino alla
+// scadenza indicata.
+type AdaptiveHostLimiter struct {
+	next http.RoundTripper
+	opts AdaptiveLimiterOptions
+
+	mu    sync.Mutex
+	hosts map[string]*adaptiveHost
+}
+
+type adaptiveHost struct {
+	limiter     *rate.Limiter
+	max, min    rate.Limit
+	pausedUntil time.Time
+}
+
+// NewAdaptiveHostLimiter crea un [AdaptiveHostLimiter] sopra next.
+func NewAdaptiveHostLimiter(next http.RoundTripper, opts AdaptiveLimiterOptions) *AdaptiveHostLimiter {
+	if next == nil {
+		next = Default()
+	}
+	if opts.Rate <= 0 {
+		opts.Rate = 1
+	}
+	if opts.Burst <= 0 {
+		opts.Burst = 1
+	}
+	if opts.MinRate <= 0 {
+		opts.MinRate = rate.Every(time.Minute)
+	}
+	if opts.Decrease <= 0 || opts.Decrease >= 1 {
+		opts.Decrease = 0.5
+	}
+	if opts.Increase <= 0 {
+		opts.Increase = 0.05
+	}
+	if len(opts.StatusCodes) == 0 {
+		opts.StatusCodes = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}
+	}
+
+	return &AdaptiveHostLimiter{
+		next:  next,
+		opts:  opts,
+		hosts: make(map[string]*adaptiveHost),
+	}
+}
+
+// Rates restituisce il rate corrente di ogni host contattato, utile per il
+// debugging.
+func (l *AdaptiveHostLimiter) Rates() map[string]rate.Limit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := make(map[string]rate.Limit, len(l.hosts))
+	for host, h := range l.hosts {
+		out[host] = h.limiter.Limit()
+	}
+	return out
+}
+
+func (l *AdaptiveHostLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+
+	l.mu.Lock()
+	h := l.hostLocked(host, strings.ToLower(req.URL.Hostname()))
+	pause := time.Until(h.pausedUntil)
+	l.mu.Unlock()
+
+	if err := waitForRetry(req.Context(), pause, 0); err != nil {
+		return nil, err
+	}
+	if err := h.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+
+	resp, err := l.next.RoundTrip(req)
+	if err != nil {
+		// Gli errori di rete non dicono nulla sul throttling del server.
+		return nil, err
+	}
+
+	l.observe(host, h, resp)
+	return resp, nil
+}
+
+// hostLocked restituisce lo stato dell'host, creandolo al primo utilizzo con
+// gli eventuali override.
+func (l *AdaptiveHostLimiter) hostLocked(host, hostname string) *adaptiveHost {
+	if h, ok := l.hosts[host]; ok {
+		return h
+	}
+
+	maxRate, burst, minRate := l.opts.Rate, l.opts.Burst, l.opts.MinRate
+	for _, o := range l.opts.Overrides {
+		if ok, _ := path.Match(o.Pattern, hostname); !ok {
+			continue
+		}
+		if o.Rate > 0 {
+			maxRate = o.Rate
+		}
+		if o.Burst > 0 {
+			burst = o.Burst
+		}
+		if o.MinRate > 0 {
+			minRate = o.MinRate
+		}
+		break
+	}
+
+	h := &adaptiveHost{
+		limiter: rate.NewLimiter(maxRate, burst),
+		max:     maxRate,
+		min:     min(minRate, maxRate),
+	}
+	l.hosts[host] = h
+	return h
+}
+
+// observe aggiorna il rate dell'host in base alla risposta.
+func (l *AdaptiveHostLimiter) observe(host string, h *adaptiveHost, resp *http.Response) {
+	throttled := slices.Contains(l.opts.StatusCodes, resp.StatusCode)
+	var retryAfter time.Duration
+	if throttled {
+		retryAfter = parseRetryAfter(resp)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	from := h.limiter.Limit()
+	to := from
+	switch {
+	case throttled:
+		to = max(from*rate.Limit(l.opts.Decrease), h.min)
+		if retryAfter > 0 {
+			if l.opts.MaxPause > 0 {
+				retryAfter = min(retryAfter, l.opts.MaxPause)
+			}
+			if until := time.Now().Add(retryAfter); until.After(h.pausedUntil) {
+				h.pausedUntil = until
+			}
+		}
+	case resp.StatusCode < http.StatusBadRequest:
+		to = min(from+h.max*rate.Limit(l.opts.Increase), h.max)
+	}
+
+	if to == from {
+		return
+	}
+	h.limiter.SetLimit(to)
+	if l.opts.OnRateChange != nil {
+		l.opts.OnRateChange(host, from, to)
+	}
+}
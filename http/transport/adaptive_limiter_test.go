@@ -0,0 +1,133 @@
+package transport_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lucasepe/x/http/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestAdaptiveHostLimiterDecreasesAndRecovers(t *testing.T) {
+	statuses := []int{http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusOK, http.StatusOK, http.StatusNotFound}
+	var changes [][2]rate.Limit
+
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		status := statuses[0]
+		statuses = statuses[1:]
+		return &http.Response{StatusCode: status, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+	})
+	limiter := transport.NewAdaptiveHostLimiter(upstream, transport.AdaptiveLimiterOptions{
+		Rate:     1000,
+		Burst:    10,
+		MinRate:  300,
+		Increase: 0.1,
+		OnRateChange: func(host string, from, to rate.Limit) {
+			assert.Equal(t, "api.example.com", host)
+			changes = append(changes, [2]rate.Limit{from, to})
+		},
+	})
+
+	for range 5 {
+		resp, err := limiter.RoundTrip(mustRequest(t, http.MethodGet, "https://api.example.com/", nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, [][2]rate.Limit{
+		{1000, 500},
+		{500, 300}, // non scende sotto MinRate
+		{300, 400},
+		{400, 500},
+	}, changes, "4xx diverse dal throttling non cambiano il rate")
+	assert.Equal(t, map[string]rate.Limit{"api.example.com": 500}, limiter.Rates())
+}
+
+func TestAdaptiveHostLimiterPausesOnRetryAfter(t *testing.T) {
+	calls := 0
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		header := make(http.Header)
+		status := http.StatusOK
+		if calls == 1 {
+			header.Set("Retry-After", "30")
+			status = http.StatusTooManyRequests
+		}
+		return &http.Response{StatusCode: status, Header: header, Body: http.NoBody, Request: req}, nil
+	})
+
+	limiter := transport.NewAdaptiveHostLimiter(upstream, transport.AdaptiveLimiterOptions{
+		Rate:     1000,
+		Burst:    10,
+		MaxPause: 100 * time.Millisecond,
+	})
+
+	resp, err := limiter.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	start := time.Now()
+	resp, err = limiter.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.GreaterOrEqual(t, time.Since(start), 80*time.Millisecond)
+
+	// Gli altri host non vengono sospesi.
+	start = time.Now()
+	resp, err = limiter.RoundTrip(mustRequest(t, http.MethodGet, "https://other.example.com/", nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestAdaptiveHostLimiterIgnoresRetryAfterOnOtherStatuses(t *testing.T) {
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		header := http.Header{"Retry-After": {"30"}, "Location": {"https://example.com/new"}}
+		return &http.Response{StatusCode: http.StatusMovedPermanently, Header: header, Body: http.NoBody, Request: req}, nil
+	})
+
+	var changes int
+	limiter := transport.NewAdaptiveHostLimiter(upstream, transport.AdaptiveLimiterOptions{
+		Rate:         1000,
+		Burst:        10,
+		OnRateChange: func(string, rate.Limit, rate.Limit) { changes++ },
+	})
+
+	start := time.Now()
+	for range 2 {
+		resp, err := limiter.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	assert.Less(t, time.Since(start), 50*time.Millisecond, "una 301 con Retry-After non sospende l'host")
+	assert.Zero(t, changes)
+	assert.Equal(t, map[string]rate.Limit{"example.com": 1000}, limiter.Rates())
+}
+
+func TestAdaptiveHostLimiterAppliesOverrides(t *testing.T) {
+	ok := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+	})
+	limiter := transport.NewAdaptiveHostLimiter(ok, transport.AdaptiveLimiterOptions{
+		Rate: 100,
+		Overrides: []transport.HostRateOverride{
+			{Pattern: "*.slow.example.com", Rate: 20},
+			{Pattern: "*.example.com", Rate: 50},
+		},
+	})
+
+	for _, u := range []string{"https://a.slow.example.com:8443/", "https://www.example.com/", "https://example.org/"} {
+		resp, err := limiter.RoundTrip(mustRequest(t, http.MethodGet, u, nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, map[string]rate.Limit{
+		"a.slow.example.com:8443": 20,
+		"www.example.com":         50,
+		"example.org":             100,
+	}, limiter.Rates())
+}
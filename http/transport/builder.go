@@ -1,6 +1,9 @@
 package transport
 
-import "net/http"
+import (
+	"errors"
+	"net/http"
+)
 
 // TransportBuilder compone piu' middleware HTTP (RoundTripper wrappers)
 // applicandoli nell'ordine in cui vengono dichiarati con [TransportBuilder.Use].
@@ -29,10 +32,44 @@ func (b *TransportBuilder) Use(layer func(http.RoundTripper) http.RoundTripper)
 
 // Build costruisce la catena finale partendo da [Default] e applicando i layer
 // in ordine inverso, cosi' da preservare l'ordine dichiarativo usato con [Use].
+//
+// Se qualche layer ha aperto risorse proprie (ad esempio il file cache del
+// layer "cache" di [LayerRegistry]), il transport finale implementa
+// [io.Closer] e Close le rilascia. Le risorse passate dal chiamante, come un
+// FileCacheFS dato a [FileCacheTransport] o un [Cassette], restano a suo
+// carico e non vengono chiuse.
 func (b *TransportBuilder) Build() http.RoundTripper {
 	var rt http.RoundTripper = Default()
+	var owned []ownedResource
 	for i := len(b.layers) - 1; i >= 0; i-- {
 		rt = b.layers[i](rt)
+		if o, ok := rt.(ownedResource); ok {
+			owned = append(owned, o)
+		}
 	}
-	return rt
+	if len(owned) == 0 {
+		return rt
+	}
+	return &closingTransport{RoundTripper: rt, owned: owned}
+}
+
+// ownedResource e' implementato dai transport del package che detengono
+// risorse aperte da loro stessi, e quindi da chiudere con la catena.
+type ownedResource interface {
+	closeOwned() error
+}
+
+// closingTransport aggiunge a una catena di layer la chiusura delle risorse
+// che possiede.
+type closingTransport struct {
+	http.RoundTripper
+	owned []ownedResource // dal piu' interno al piu' esterno
+}
+
+func (t *closingTransport) Close() error {
+	var errs []error
+	for i := len(t.owned) - 1; i >= 0; i-- {
+		errs = append(errs, t.owned[i].closeOwned())
+	}
+	return errors.Join(errs...)
 }
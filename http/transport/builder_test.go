@@ -41,3 +41,32 @@ func TestTransportBuilderPreservesDeclarationOrder(t *testing.T) {
 
 	assert.Equal(t, []string{"outer", "inner"}, steps)
 }
+
+// closerRoundTripper registra in closed il proprio nome quando viene chiuso.
+type closerRoundTripper struct {
+	http.RoundTripper
+	name   string
+	closed *[]string
+}
+
+func (c closerRoundTripper) Close() error {
+	*c.closed = append(*c.closed, c.name)
+	return nil
+}
+
+func TestTransportBuilderDoesNotCloseCallerTransports(t *testing.T) {
+	var closed []string
+	rt := transport.NewTransportBuilder().
+		Use(func(next http.RoundTripper) http.RoundTripper {
+			return closerRoundTripper{RoundTripper: next, name: "cassette", closed: &closed}
+		}).
+		Use(func(next http.RoundTripper) http.RoundTripper {
+			return transport.RequestIDRoundTripper(next)
+		}).
+		Build()
+
+	// il layer esterno resta quello del chiamante, che lo chiude da se'
+	_, ok := rt.(closerRoundTripper)
+	assert.True(t, ok)
+	assert.Empty(t, closed)
+}
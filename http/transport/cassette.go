@@ -0,0 +1,355 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"unicode/utf8"
+)
+
+// ErrCassetteMiss e' l'errore sentinella restituito (tramite
+// [*CassetteMissError]) quando in replay nessuna interazione registrata
+// corrisponde alla richiesta.
+var ErrCassetteMiss = errors.New("no recorded interaction matches the request")
+
+// CassetteMissError riporta la richiesta che non ha trovato corrispondenza
+// nella cassetta. Soddisfa errors.Is(err, ErrCassetteMiss).
+type CassetteMissError struct {
+	Method string
+	URL    string
+}
+
+func (e *CassetteMissError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Method, e.URL, ErrCassetteMiss)
+}
+
+func (e *CassetteMissError) Unwrap() error {
+	return ErrCassetteMiss
+}
+
+// CassetteMode stabilisce se la cassetta registra, riproduce o si fa da parte.
+type CassetteMode int
+
+const (
+	// CassetteRecordOnce riproduce la cassetta se il file esiste, altrimenti
+	// registra le interazioni reali e le salva.
+	CassetteRecordOnce CassetteMode = iota
+	// CassetteReplayOnly riproduce soltanto: il file deve esistere e le
+	// richieste senza corrispondenza falliscono con [*CassetteMissError].
+	CassetteReplayOnly
+	// CassettePassthrough inoltra tutto al transport reale senza registrare.
+	CassettePassthrough
+)
+
+// CassetteOptions controlla modalita', confronto delle richieste e
+// redazione dei segreti.
+type CassetteOptions struct {
+	Mode CassetteMode
+	// MatchHeaders elenca gli header di richiesta da confrontare, oltre a
+	// metodo e URL.
+	MatchHeaders []string
+	// MatchBody confronta anche il body della richiesta.
+	MatchBody bool
+	// Matcher, se valorizzato, sostituisce il confronto di default.
+	// Riceve la richiesta gia' redatta.
+	Matcher func(req RecordedRequest, rec RecordedRequest) bool
+	// RedactHeaders elenca gli header (di richiesta e di risposta) il cui
+	// valore non viene mai scritto su file. Se vuoto usa Authorization,
+	// Proxy-Authorization, Cookie e Set-Cookie.
+	RedactHeaders []string
+	// RedactQuery elenca i parametri di query da redigere (es. "api_key").
+	RedactQuery []string
+}
+
+// RecordedRequest e' la forma persistita di una richiesta.
+type RecordedRequest struct {
+	Method       string      `json:"method"`
+	URL          string      `json:"url"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"body_encoding,omitempty"`
+}
+
+// RecordedResponse e' la forma persistita di una risposta.
+type RecordedResponse struct {
+	StatusCode   int         `json:"status_code"`
+	Status       string      `json:"status"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"body_encoding,omitempty"`
+}
+
+// Interaction e' una coppia richiesta/risposta registrata.
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+type cassetteFile struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Cassette e' un [http.RoundTripper] che registra le interazioni reali su un
+// file JSON leggibile e le riproduce offline, utile per i test di
+// integrazione. Le interazioni uguali vengono riprodotte nell'ordine di
+// registrazione; esaurite, si riusa l'ultima corrispondente.
+//
+// In registrazione le interazioni restano in memoria finche' non vengono
+// scritte con [Cassette.Save] o [Cassette.Close], tipicamente in un defer o
+// in t.Cleanup.
+type Cassette struct {
+	path string
+	next http.RoundTripper
+	opts CassetteOptions
+
+	mu           sync.Mutex
+	recording    bool
+	dirty        bool // interazioni registrate non ancora salvate
+	interactions []Interaction
+	used         []bool
+}
+
+// NewCassette apre (o prepara) la cassetta in path. In modalita'
+// [CassetteReplayOnly] il file deve esistere. Se next e' nil usa [Default].
+func NewCassette(path string, next http.RoundTripper, opts CassetteOptions) (*Cassette, error) {
+	if next == nil {
+		next = Default()
+	}
+	if len(opts.RedactHeaders) == 0 {
+		opts.RedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+	}
+	opts.RedactHeaders = slices.Clone(opts.RedactHeaders)
+	for i, name := range opts.RedactHeaders {
+		opts.RedactHeaders[i] = http.CanonicalHeaderKey(name)
+	}
+
+	c := &Cassette{path: path, next: next, opts: opts}
+	if opts.Mode == CassettePassthrough {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		var f cassetteFile
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("cassette %s: %w", path, err)
+		}
+		c.interactions = f.Interactions
+		c.used = make([]bool, len(f.Interactions))
+	case errors.Is(err, os.ErrNotExist) && opts.Mode == CassetteRecordOnce:
+		c.recording = true
+	default:
+		return nil, err
+	}
+	return c, nil
+}
+
+// Recording indica se la cassetta sta registrando interazioni reali.
+func (c *Cassette) Recording() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.recording
+}
+
+// Interactions restituisce una copia delle interazioni note.
+func (c *Cassette) Interactions() []Interaction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.interactions)
+}
+
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c.opts.Mode == CassettePassthrough {
+		return c.next.RoundTrip(req)
+	}
+
+	body, err := requestBodyBytes(req)
+	if err != nil {
+		return nil, err
+	}
+	recReq := c.recordRequest(req, body)
+
+	c.mu.Lock()
+	recording := c.recording
+	c.mu.Unlock()
+
+	if !recording {
+		inter, ok := c.match(recReq)
+		if !ok {
+			return nil, &CassetteMissError{Method: recReq.Method, URL: recReq.URL}
+		}
+		return replayResponse(req, inter.Response)
+	}
+
+	resp, err := c.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	inter := Interaction{Request: recReq, Response: c.recordResponse(resp, respBody)}
+
+	c.mu.Lock()
+	c.interactions = append(c.interactions, inter)
+	c.used = append(c.used, true)
+	c.dirty = true
+	c.mu.Unlock()
+
+	return resp, nil
+}
+
+// Save scrive la cassetta su file, in modo atomico. Non fa nulla se non ci
+// sono nuove interazioni registrate (in particolare in replay o
+// passthrough).
+func (c *Cassette) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.recording || !c.dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(cassetteFile{Interactions: c.interactions}, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// Close salva le interazioni registrate, vedi [Cassette.Save].
+func (c *Cassette) Close() error {
+	return c.Save()
+}
+
+// match cerca la prima interazione non ancora riprodotta che corrisponde
+// alla richiesta, oppure l'ultima gia' usata.
+func (c *Cassette) match(req RecordedRequest) (Interaction, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	last := -1
+	for i, inter := range c.interactions {
+		if !c.matches(req, inter.Request) {
+			continue
+		}
+		if !c.used[i] {
+			c.used[i] = true
+			return inter, true
+		}
+		last = i
+	}
+	if last < 0 {
+		return Interaction{}, false
+	}
+	return c.interactions[last], true
+}
+
+func (c *Cassette) matches(req, rec RecordedRequest) bool {
+	if c.opts.Matcher != nil {
+		return c.opts.Matcher(req, rec)
+	}
+	if req.Method != rec.Method || req.URL != rec.URL {
+		return false
+	}
+	for _, name := range c.opts.MatchHeaders {
+		if !slices.Equal(req.Header.Values(name), rec.Header.Values(name)) {
+			return false
+		}
+	}
+	return !c.opts.MatchBody || (req.Body == rec.Body && req.BodyEncoding == rec.BodyEncoding)
+}
+
+func (c *Cassette) recordRequest(req *http.Request, body []byte) RecordedRequest {
+	enc, encoding := encodeCassetteBody(body)
+	return RecordedRequest{
+		Method:       req.Method,
+		URL:          redactURL(req.URL, c.opts.RedactQuery),
+		Header:       c.redactHeader(req.Header),
+		Body:         enc,
+		BodyEncoding: encoding,
+	}
+}
+
+func (c *Cassette) recordResponse(resp *http.Response, body []byte) RecordedResponse {
+	enc, encoding := encodeCassetteBody(body)
+	return RecordedResponse{
+		StatusCode:   resp.StatusCode,
+		Status:       resp.Status,
+		Header:       c.redactHeader(resp.Header),
+		Body:         enc,
+		BodyEncoding: encoding,
+	}
+}
+
+func (c *Cassette) redactHeader(h http.Header) http.Header {
+	out := cloneHeader(h)
+	for _, name := range c.opts.RedactHeaders {
+		if values, ok := out[name]; ok {
+			for i := range values {
+				values[i] = redactedValue
+			}
+		}
+	}
+	return out
+}
+
+// encodeCassetteBody lascia leggibili i body testuali e codifica in base64
+// quelli binari.
+func encodeCassetteBody(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func decodeCassetteBody(body, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(body)
+	}
+	return []byte(body), nil
+}
+
+func replayResponse(req *http.Request, rec RecordedResponse) (*http.Response, error) {
+	body, err := decodeCassetteBody(rec.Body, rec.BodyEncoding)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode:    rec.StatusCode,
+		Status:        rec.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        cloneHeader(rec.Header),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,155 @@
+package transport_test
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lucasepe/x/http/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echoUpstream(calls *int32) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		n := atomic.AddInt32(calls, 1)
+		body := req.Method + " " + req.URL.Path
+		if n > 1 {
+			body += " again"
+		}
+		return &http.Response{
+			StatusCode: http.StatusCreated,
+			Status:     "201 Created",
+			Header:     http.Header{"Content-Type": {"text/plain"}, "Set-Cookie": {"session=abc"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	})
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestCassetteRecordOnceThenReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixtures", "api.json")
+
+	var calls int32
+	rec, err := transport.NewCassette(path, transport.BearerAuthRoundTripper("s3cr3t", echoUpstream(&calls)),
+		transport.CassetteOptions{RedactQuery: []string{"api_key"}})
+	require.NoError(t, err)
+	require.True(t, rec.Recording())
+
+	client := &http.Client{Transport: transport.BearerAuthRoundTripper("s3cr3t", rec)}
+	resp, err := client.Get("https://example.com/items?api_key=k1&page=1")
+	require.NoError(t, err)
+	assert.Equal(t, "GET /items", readBody(t, resp))
+	resp, err = client.Get("https://example.com/items?api_key=k1&page=1")
+	require.NoError(t, err)
+	assert.Equal(t, "GET /items again", readBody(t, resp))
+
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist, "interactions are written on Close")
+	require.NoError(t, rec.Close())
+
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "s3cr3t")
+	assert.NotContains(t, string(raw), "k1")
+	assert.NotContains(t, string(raw), "session=abc")
+
+	// Riapertura: la cassetta esiste, quindi si riproduce senza upstream.
+	var offline int32
+	play, err := transport.NewCassette(path, echoUpstream(&offline), transport.CassetteOptions{
+		RedactQuery: []string{"api_key"},
+	})
+	require.NoError(t, err)
+	require.False(t, play.Recording())
+
+	client = &http.Client{Transport: play}
+	for _, want := range []string{"GET /items", "GET /items again", "GET /items again"} {
+		resp, err := client.Get("https://example.com/items?api_key=other&page=1")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+		assert.Equal(t, want, readBody(t, resp))
+	}
+	assert.Zero(t, atomic.LoadInt32(&offline))
+
+	_, err = client.Get("https://example.com/unknown")
+	require.Error(t, err)
+	assert.ErrorIs(t, err, transport.ErrCassetteMiss)
+}
+
+func TestCassetteReplayOnlyRequiresFile(t *testing.T) {
+	_, err := transport.NewCassette(filepath.Join(t.TempDir(), "missing.json"), nil, transport.CassetteOptions{
+		Mode: transport.CassetteReplayOnly,
+	})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestCassetteMatchesBody(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "post.json")
+
+	var calls int32
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		b, _ := io.ReadAll(req.Body)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Status:     "200 OK",
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader("echo:" + string(b))),
+			Request:    req,
+		}, nil
+	})
+
+	rec, err := transport.NewCassette(path, upstream, transport.CassetteOptions{MatchBody: true})
+	require.NoError(t, err)
+	for _, body := range []string{"a", "b"} {
+		resp, err := rec.RoundTrip(mustRequest(t, http.MethodPost, "https://example.com/echo", strings.NewReader(body)))
+		require.NoError(t, err)
+		readBody(t, resp)
+	}
+	require.NoError(t, rec.Save())
+
+	play, err := transport.NewCassette(path, nil, transport.CassetteOptions{
+		Mode:      transport.CassetteReplayOnly,
+		MatchBody: true,
+	})
+	require.NoError(t, err)
+
+	resp, err := play.RoundTrip(mustRequest(t, http.MethodPost, "https://example.com/echo", strings.NewReader("b")))
+	require.NoError(t, err)
+	assert.Equal(t, "echo:b", readBody(t, resp))
+
+	_, err = play.RoundTrip(mustRequest(t, http.MethodPost, "https://example.com/echo", strings.NewReader("c")))
+	assert.ErrorIs(t, err, transport.ErrCassetteMiss)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestCassettePassthrough(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "none.json")
+
+	var calls int32
+	c, err := transport.NewCassette(path, echoUpstream(&calls), transport.CassetteOptions{
+		Mode: transport.CassettePassthrough,
+	})
+	require.NoError(t, err)
+
+	resp, err := c.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/x", nil))
+	require.NoError(t, err)
+	readBody(t, resp)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,275 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen e' l'errore sentinella restituito (tramite
+// [*CircuitOpenError]) quando il circuito di un host e' aperto.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitOpenError descrive una richiesta rifiutata senza contattare l'host
+// perche' il suo circuito e' aperto. Soddisfa errors.Is(err, ErrCircuitOpen).
+type CircuitOpenError struct {
+	Host string
+	// RetryAfter e' il tempo che manca alla prossima richiesta di prova.
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s: %v (retry in %s)", e.Host, ErrCircuitOpen, e.RetryAfter.Round(time.Millisecond))
+}
+
+func (e *CircuitOpenError) Unwrap() error {
+	return ErrCircuitOpen
+}
+
+// CircuitState e' lo stato del circuito di un host.
+type CircuitState int
+
+const (
+	// CircuitClosed: le richieste passano e gli esiti vengono conteggiati.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen: le richieste falliscono subito fino alla fine del cool-down.
+	CircuitOpen
+	// CircuitHalfOpen: passano solo le richieste di prova, il cui esito decide
+	// se richiudere o riaprire il circuito.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+}
+
+// CircuitBreakerOptions controlla quando il circuito di un host si apre e
+// come viene richiuso.
+type CircuitBreakerOptions struct {
+	// ConsecutiveFailures apre il circuito dopo N fallimenti consecutivi.
+	// Se <= 0 usa 5.
+	ConsecutiveFailures int
+	// FailureRate apre il circuito quando la quota di fallimenti nella
+	// finestra corrente raggiunge la soglia (0..1). Zero la disabilita.
+	FailureRate float64
+	// MinRequests e' il numero minimo di richieste nella finestra prima di
+	// valutare FailureRate. Se <= 0 usa 10.
+	MinRequests int
+	// Window e' la durata della finestra usata per FailureRate.
+	// Se <= 0 usa un minuto.
+	Window time.Duration
+	// CoolDown e' la durata dello stato open. Se <= 0 usa 30 secondi.
+	CoolDown time.Duration
+	// HalfOpenProbes e' il numero di richieste di prova ammesse in half-open:
+	// devono riuscire tutte per richiudere il circuito. Se <= 0 usa 1.
+	HalfOpenProbes int
+	// IsFailure classifica l'esito di una richiesta. Se nil sono fallimenti
+	// gli errori del transport (tranne [ErrRobotsDisallowed]), le 5xx e le 429.
+	IsFailure func(resp *http.Response, err error) bool
+	// OnStateChange, se valorizzato, viene invocato a ogni cambio di stato.
+	// E' chiamato con il lock interno acquisito: deve essere rapido e non
+	// deve usare il transport.
+	OnStateChange func(host string, from, to CircuitState)
+}
+
+// CircuitBreakerRoundTripper applica un circuit breaker distinto per ogni
+// host. Quando un host accumula troppi fallimenti il circuito si apre e le
+// richieste successive falliscono subito con [*CircuitOpenError]; trascorso
+// il cool-down alcune richieste di prova decidono se richiuderlo.
+func CircuitBreakerRoundTripper(next http.RoundTripper, opts CircuitBreakerOptions) http.RoundTripper {
+	if next == nil {
+		next = Default()
+	}
+	if opts.ConsecutiveFailures <= 0 {
+		opts.ConsecutiveFailures = 5
+	}
+	if opts.MinRequests <= 0 {
+		opts.MinRequests = 10
+	}
+	if opts.Window <= 0 {
+		opts.Window = time.Minute
+	}
+	if opts.CoolDown <= 0 {
+		opts.CoolDown = 30 * time.Second
+	}
+	if opts.HalfOpenProbes <= 0 {
+		opts.HalfOpenProbes = 1
+	}
+	if opts.IsFailure == nil {
+		opts.IsFailure = defaultCircuitFailure
+	}
+
+	return &circuitBreakerTransport{
+		next:     next,
+		opts:     opts,
+		circuits: make(map[string]*circuit),
+	}
+}
+
+func defaultCircuitFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		// Un path vietato da robots.txt non dice nulla sulla salute dell'host.
+		return !errors.Is(err, ErrRobotsDisallowed)
+	}
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+}
+
+type circuitBreakerTransport struct {
+	next http.RoundTripper
+	opts CircuitBreakerOptions
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+// circuit e' lo stato di un singolo host; e' protetto dal mutex del transport.
+type circuit struct {
+	state    CircuitState
+	openedAt time.Time
+
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+
+	probes    int // richieste di prova in corso
+	successes int // richieste di prova riuscite
+}
+
+func (t *circuitBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if err := t.acquire(host); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if req.Context().Err() != nil {
+		// Le cancellazioni del chiamante non dicono nulla sulla salute dell'host.
+		t.release(host)
+		return resp, err
+	}
+	t.record(host, t.opts.IsFailure(resp, err))
+	return resp, err
+}
+
+// acquire verifica se la richiesta puo' passare, gestendo la transizione
+// open -> half-open alla fine del cool-down.
+func (t *circuitBreakerTransport) acquire(host string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.circuitFor(host)
+	now := time.Now()
+
+	if c.state == CircuitOpen {
+		if wait := c.openedAt.Add(t.opts.CoolDown).Sub(now); wait > 0 {
+			return &CircuitOpenError{Host: host, RetryAfter: wait}
+		}
+		t.setState(host, c, CircuitHalfOpen)
+	}
+
+	if c.state == CircuitHalfOpen {
+		if c.probes+c.successes >= t.opts.HalfOpenProbes {
+			return &CircuitOpenError{Host: host}
+		}
+		c.probes++
+	}
+	return nil
+}
+
+// release libera lo slot di prova occupato da una richiesta il cui esito
+// non viene conteggiato.
+func (t *circuitBreakerTransport) release(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if c := t.circuitFor(host); c.state == CircuitHalfOpen && c.probes > 0 {
+		c.probes--
+	}
+}
+
+func (t *circuitBreakerTransport) record(host string, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.circuitFor(host)
+	now := time.Now()
+
+	switch c.state {
+	case CircuitHalfOpen:
+		if c.probes > 0 {
+			c.probes--
+		}
+		if failed {
+			t.open(host, c, now)
+			return
+		}
+		c.successes++
+		if c.successes >= t.opts.HalfOpenProbes {
+			t.setState(host, c, CircuitClosed)
+		}
+
+	case CircuitClosed:
+		if now.Sub(c.windowStart) >= t.opts.Window {
+			c.windowStart, c.requests, c.failures = now, 0, 0
+		}
+		c.requests++
+		if !failed {
+			c.consecutive = 0
+			return
+		}
+		c.failures++
+		c.consecutive++
+
+		if c.consecutive >= t.opts.ConsecutiveFailures {
+			t.open(host, c, now)
+			return
+		}
+		if t.opts.FailureRate > 0 && c.requests >= t.opts.MinRequests &&
+			float64(c.failures)/float64(c.requests) >= t.opts.FailureRate {
+			t.open(host, c, now)
+		}
+
+	case CircuitOpen:
+		// Esito di una richiesta partita prima dell'apertura: non cambia nulla.
+	}
+}
+
+func (t *circuitBreakerTransport) open(host string, c *circuit, now time.Time) {
+	c.openedAt = now
+	t.setState(host, c, CircuitOpen)
+}
+
+// setState cambia stato azzerando i contatori; va chiamata con il mutex
+// acquisito.
+func (t *circuitBreakerTransport) setState(host string, c *circuit, to CircuitState) {
+	from := c.state
+	c.state = to
+	c.consecutive, c.requests, c.failures = 0, 0, 0
+	c.probes, c.successes = 0, 0
+	c.windowStart = time.Now()
+
+	if t.opts.OnStateChange != nil && from != to {
+		t.opts.OnStateChange(host, from, to)
+	}
+}
+
+func (t *circuitBreakerTransport) circuitFor(host string) *circuit {
+	c, ok := t.circuits[host]
+	if !ok {
+		c = &circuit{windowStart: time.Now()}
+		t.circuits[host] = c
+	}
+	return c
+}
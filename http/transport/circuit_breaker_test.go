@@ -0,0 +1,157 @@
+package transport_test
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lucasepe/x/http/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func statusUpstream(calls *int32, status *int32) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(calls, 1)
+		return &http.Response{
+			StatusCode: int(atomic.LoadInt32(status)),
+			Header:     make(http.Header),
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	})
+}
+
+func TestCircuitBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	var calls int32
+	status := int32(http.StatusServiceUnavailable)
+
+	var changes []string
+	rt := transport.CircuitBreakerRoundTripper(statusUpstream(&calls, &status), transport.CircuitBreakerOptions{
+		ConsecutiveFailures: 3,
+		CoolDown:            50 * time.Millisecond,
+		OnStateChange: func(host string, from, to transport.CircuitState) {
+			changes = append(changes, host+":"+from.String()+"->"+to.String())
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://down.example.com/", nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	_, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://down.example.com/", nil))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, transport.ErrCircuitOpen))
+
+	var openErr *transport.CircuitOpenError
+	require.True(t, errors.As(err, &openErr))
+	assert.Equal(t, "down.example.com", openErr.Host)
+	assert.Greater(t, openErr.RetryAfter, time.Duration(0))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// Gli altri host non sono coinvolti.
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://other.example.com/", nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, []string{"down.example.com:closed->open"}, changes)
+}
+
+func TestCircuitBreakerHalfOpenProbe(t *testing.T) {
+	var calls int32
+	status := int32(http.StatusBadGateway)
+
+	var changes []string
+	rt := transport.CircuitBreakerRoundTripper(statusUpstream(&calls, &status), transport.CircuitBreakerOptions{
+		ConsecutiveFailures: 1,
+		CoolDown:            20 * time.Millisecond,
+		OnStateChange: func(_ string, from, to transport.CircuitState) {
+			changes = append(changes, from.String()+"->"+to.String())
+		},
+	})
+
+	do := func() error {
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://flaky.example.com/", nil))
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	require.NoError(t, do())
+	require.ErrorIs(t, do(), transport.ErrCircuitOpen)
+
+	// La prova fallisce: il circuito si riapre.
+	time.Sleep(30 * time.Millisecond)
+	require.NoError(t, do())
+	require.ErrorIs(t, do(), transport.ErrCircuitOpen)
+
+	// La prova riesce: il circuito si richiude.
+	atomic.StoreInt32(&status, http.StatusOK)
+	time.Sleep(30 * time.Millisecond)
+	require.NoError(t, do())
+	require.NoError(t, do())
+
+	assert.Equal(t, []string{
+		"closed->open",
+		"open->half-open",
+		"half-open->open",
+		"open->half-open",
+		"half-open->closed",
+	}, changes)
+}
+
+func TestCircuitBreakerFailureRate(t *testing.T) {
+	var calls int32
+	status := int32(http.StatusOK)
+
+	rt := transport.CircuitBreakerRoundTripper(statusUpstream(&calls, &status), transport.CircuitBreakerOptions{
+		ConsecutiveFailures: 100,
+		FailureRate:         0.5,
+		MinRequests:         4,
+		CoolDown:            time.Minute,
+	})
+
+	do := func(code int32) error {
+		atomic.StoreInt32(&status, code)
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://rate.example.com/", nil))
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	require.NoError(t, do(http.StatusOK))
+	require.NoError(t, do(http.StatusInternalServerError))
+	require.NoError(t, do(http.StatusOK))
+	require.NoError(t, do(http.StatusInternalServerError))
+	assert.ErrorIs(t, do(http.StatusOK), transport.ErrCircuitOpen)
+}
+
+func TestForScrapingWithCircuitBreaker(t *testing.T) {
+	var calls int32
+	builder := transport.ForScrapingWithOptions(nil, transport.ScrapingPresetOptions{
+		HostRate:       1000,
+		HostBurst:      10,
+		Retry:          transport.RetryOptions{MaxAttempts: 1},
+		CircuitBreaker: &transport.CircuitBreakerOptions{ConsecutiveFailures: 1},
+	}).Use(func(http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&calls, 1)
+			return nil, errors.New("connection refused")
+		})
+	})
+	rt := builder.Build()
+
+	_, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, transport.ErrCircuitOpen)
+
+	_, err = rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	assert.ErrorIs(t, err, transport.ErrCircuitOpen)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,272 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentDecoder decomprime un body codificato con un Content-Encoding.
+type ContentDecoder func(r io.Reader) (io.ReadCloser, error)
+
+// CompressionOptions configura [CompressionRoundTripper].
+type CompressionOptions struct {
+	// Decoders aggiunge o sostituisce i decoder per Content-Encoding. gzip e
+	// deflate sono sempre disponibili; br e zstd richiedono una libreria
+	// esterna, ad esempio:
+	//
+	//	Decoders: map[string]transport.ContentDecoder{
+	//		"br": func(r io.Reader) (io.ReadCloser, error) {
+	//			return io.NopCloser(brotli.NewReader(r)), nil
+	//		},
+	//	}
+	Decoders map[string]ContentDecoder
+	// RequestMinSize, se > 0, comprime con gzip i body delle richieste di
+	// almeno RequestMinSize byte, per le API che accettano
+	// `Content-Encoding: gzip`.
+	RequestMinSize int
+	// RequestLevel e' il livello gzip delle richieste. Se 0 usa
+	// gzip.DefaultCompression.
+	RequestLevel int
+}
+
+// CompressionRoundTripper gestisce la compressione al posto di
+// [http.Transport]. Se la richiesta non ha Accept-Encoding annuncia le
+// codifiche supportate; se il chiamante ne ha impostato uno (cosa che
+// disabilita la decompressione automatica di Go) le risposte con una
+// codifica nota vengono comunque decompresse. Le risposte decompresse
+// perdono Content-Encoding e Content-Length e hanno Uncompressed a true.
+//
+// Con RequestMinSize i body grandi vengono compressi in memoria; GetBody
+// restituisce il body compresso, quindi [RetryRoundTripper] continua a
+// funzionare.
+func CompressionRoundTripper(next http.RoundTripper, opts CompressionOptions) http.RoundTripper {
+	if next == nil {
+		next = Default()
+	}
+
+	decoders := map[string]ContentDecoder{
+		"gzip":    gzipDecoder,
+		"x-gzip":  gzipDecoder,
+		"deflate": deflateDecoder,
+	}
+	for name, dec := range opts.Decoders {
+		decoders[strings.ToLower(name)] = dec
+	}
+
+	names := make([]string, 0, len(decoders))
+	for name := range decoders {
+		if name != "x-gzip" {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	if opts.RequestLevel == 0 {
+		opts.RequestLevel = gzip.DefaultCompression
+	}
+
+	return &compressionTransport{
+		next:           next,
+		opts:           opts,
+		decoders:       decoders,
+		acceptEncoding: strings.Join(names, ", "),
+	}
+}
+
+type compressionTransport struct {
+	next           http.RoundTripper
+	opts           CompressionOptions
+	decoders       map[string]ContentDecoder
+	acceptEncoding string
+}
+
+func (t *compressionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, err := t.compressRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", t.acceptEncoding)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.decodeResponse(resp)
+	return resp, nil
+}
+
+// compressRequest restituisce una copia della richiesta, con il body
+// compresso se abbastanza grande.
+func (t *compressionTransport) compressRequest(req *http.Request) (*http.Request, error) {
+	if t.opts.RequestMinSize <= 0 || req.Body == nil || req.Body == http.NoBody ||
+		req.Header.Get("Content-Encoding") != "" {
+		return cloneRequest(req), nil
+	}
+
+	body, err := requestBodyBytes(req)
+	if err != nil {
+		return nil, err
+	}
+	req = cloneRequest(req)
+	if len(body) < t.opts.RequestMinSize {
+		return req, nil
+	}
+
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, t.opts.RequestLevel)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	compressed := buf.Bytes()
+	req.Body = io.NopCloser(bytes.NewReader(compressed))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(compressed)), nil
+	}
+	req.ContentLength = int64(len(compressed))
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Content-Length", strconv.Itoa(len(compressed)))
+	return req, nil
+}
+
+// decodeResponse sostituisce il body con la versione decompressa, se tutte
+// le codifiche sono note.
+func (t *compressionTransport) decodeResponse(resp *http.Response) {
+	raw := resp.Header.Get("Content-Encoding")
+	if raw == "" || resp.Body == nil || resp.Body == http.NoBody {
+		return
+	}
+
+	var chain []ContentDecoder
+	for name := range strings.SplitSeq(raw, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == "identity" {
+			continue
+		}
+		dec, ok := t.decoders[name]
+		if !ok {
+			// Codifica sconosciuta: il chiamante riceve il body cosi' com'e'.
+			return
+		}
+		chain = append(chain, dec)
+	}
+	// Le codifiche sono elencate nell'ordine in cui sono state applicate.
+	slices.Reverse(chain)
+
+	resp.Body = &decodingBody{src: resp.Body, chain: chain}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+}
+
+// errBodyClosed e' restituito dalle letture di un [decodingBody] chiuso.
+var errBodyClosed = errors.New("read on closed response body")
+
+// decodingBody crea i decoder alla prima lettura, cosi' RoundTrip non
+// blocca in attesa dell'header compresso.
+//
+// mu serializza Read e Close, che possono arrivare da goroutine diverse: i
+// decoder non vanno chiusi durante una lettura.
+type decodingBody struct {
+	src   io.ReadCloser
+	chain []ContentDecoder
+
+	mu        sync.Mutex
+	closeOnce sync.Once
+	built     bool
+	closed    bool
+	r         io.Reader
+	closers   []io.Closer
+	err       error
+}
+
+func (b *decodingBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return 0, errBodyClosed
+	}
+	if !b.built {
+		b.built = true
+		b.build()
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.r.Read(p)
+}
+
+// build crea la catena dei decoder; va chiamato con b.mu.
+func (b *decodingBody) build() {
+	var r io.Reader = b.src
+	for _, dec := range b.chain {
+		rc, err := dec(r)
+		if err != nil {
+			b.err = err
+			return
+		}
+		b.closers = append(b.closers, rc)
+		r = rc
+	}
+	b.r = r
+}
+
+// Close chiude i decoder, dal piu' esterno, e poi il body originale. Se una
+// Read e' in corso il body originale viene chiuso subito per sbloccarla,
+// come farebbe net/http, e i decoder appena la lettura termina.
+func (b *decodingBody) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		srcClosed := false
+		if !b.mu.TryLock() {
+			err = b.src.Close()
+			srcClosed = true
+			b.mu.Lock()
+		}
+		defer b.mu.Unlock()
+
+		b.closed = true
+		for _, c := range slices.Backward(b.closers) {
+			c.Close()
+		}
+		if !srcClosed {
+			err = b.src.Close()
+		}
+	})
+	return err
+}
+
+func gzipDecoder(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// deflateDecoder accetta sia il formato zlib previsto da HTTP sia il
+// deflate "nudo" inviato da alcuni server.
+func deflateDecoder(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
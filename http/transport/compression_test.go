@@ -0,0 +1,285 @@
+package transport_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucasepe/x/http/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipBytes(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte(s))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func encodedUpstream(encoding string, body []byte, seen **http.Request) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if seen != nil {
+			*seen = req
+		}
+		header := make(http.Header)
+		header.Set("Content-Encoding", encoding)
+		header.Set("Content-Length", "999")
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        header,
+			ContentLength: int64(len(body)),
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			Request:       req,
+		}, nil
+	})
+}
+
+func TestCompressionRoundTripperDecodesGzipFromRealServer(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "br, deflate, gzip", r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gzipBytes(t, "hello gzip"))
+	}))
+	defer srv.Close()
+
+	rt := transport.CompressionRoundTripper(nil, transport.CompressionOptions{
+		Decoders: map[string]transport.ContentDecoder{
+			"br": func(r io.Reader) (io.ReadCloser, error) { return io.NopCloser(r), nil },
+		},
+	})
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, srv.URL, nil))
+	require.NoError(t, err)
+
+	assert.True(t, resp.Uncompressed)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Equal(t, "hello gzip", readBody(t, resp))
+}
+
+func TestCompressionRoundTripperKeepsCallerAcceptEncoding(t *testing.T) {
+	var seen *http.Request
+	rt := transport.CompressionRoundTripper(encodedUpstream("gzip", gzipBytes(t, "data"), &seen), transport.CompressionOptions{})
+
+	req := mustRequest(t, http.MethodGet, "https://example.com/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+
+	assert.Equal(t, "gzip", seen.Header.Get("Accept-Encoding"))
+	assert.Equal(t, "data", readBody(t, resp))
+}
+
+func TestCompressionRoundTripperDecodesDeflateVariants(t *testing.T) {
+	var zlibBuf, rawBuf bytes.Buffer
+	zw := zlib.NewWriter(&zlibBuf)
+	zw.Write([]byte("zlib"))
+	require.NoError(t, zw.Close())
+	fw, err := flate.NewWriter(&rawBuf, flate.DefaultCompression)
+	require.NoError(t, err)
+	fw.Write([]byte("raw"))
+	require.NoError(t, fw.Close())
+
+	for want, body := range map[string][]byte{"zlib": zlibBuf.Bytes(), "raw": rawBuf.Bytes()} {
+		rt := transport.CompressionRoundTripper(encodedUpstream("deflate", body, nil), transport.CompressionOptions{})
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+		require.NoError(t, err)
+		assert.Equal(t, want, readBody(t, resp))
+	}
+}
+
+func TestCompressionRoundTripperDecodesStackedEncodings(t *testing.T) {
+	// Prima gzip, poi una codifica custom (base64) applicata sopra.
+	body := []byte(base64.StdEncoding.EncodeToString(gzipBytes(t, "stacked")))
+	rt := transport.CompressionRoundTripper(encodedUpstream("gzip, b64", body, nil), transport.CompressionOptions{
+		Decoders: map[string]transport.ContentDecoder{
+			"B64": func(r io.Reader) (io.ReadCloser, error) {
+				return io.NopCloser(base64.NewDecoder(base64.StdEncoding, r)), nil
+			},
+		},
+	})
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "stacked", readBody(t, resp))
+}
+
+func TestCompressionRoundTripperLeavesUnknownEncodings(t *testing.T) {
+	rt := transport.CompressionRoundTripper(encodedUpstream("zstd", []byte("opaque"), nil), transport.CompressionOptions{})
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "zstd", resp.Header.Get("Content-Encoding"))
+	assert.False(t, resp.Uncompressed)
+	assert.Equal(t, "opaque", readBody(t, resp))
+}
+
+func TestCompressionRoundTripperCompressesLargeRequestsAndKeepsThemRetryable(t *testing.T) {
+	payload := strings.Repeat("compress me ", 100)
+
+	var bodies []string
+	attempts := 0
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		assert.Equal(t, "gzip", req.Header.Get("Content-Encoding"))
+		zr, err := gzip.NewReader(req.Body)
+		require.NoError(t, err)
+		data, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		bodies = append(bodies, string(data))
+
+		status := http.StatusOK
+		if attempts == 1 {
+			status = http.StatusServiceUnavailable
+		}
+		return &http.Response{StatusCode: status, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+	})
+
+	rt := transport.RetryRoundTripper(
+		transport.CompressionRoundTripper(upstream, transport.CompressionOptions{RequestMinSize: 256}),
+		transport.RetryOptions{
+			MaxAttempts: 2,
+			Methods:     []string{http.MethodPost},
+			StatusCodes: []int{http.StatusServiceUnavailable},
+		},
+	)
+
+	req, err := http.NewRequest(http.MethodPost, "https://example.com/upload", strings.NewReader(payload))
+	require.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{payload, payload}, bodies)
+}
+
+func TestCompressionRoundTripperSkipsSmallRequests(t *testing.T) {
+	var seen *http.Request
+	rt := transport.CompressionRoundTripper(captureRequest(&seen), transport.CompressionOptions{RequestMinSize: 1024})
+
+	req, err := http.NewRequest(http.MethodPost, "https://example.com/", strings.NewReader("tiny"))
+	require.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Empty(t, seen.Header.Get("Content-Encoding"))
+	body, err := io.ReadAll(seen.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "tiny", string(body))
+}
+
+// closeLog registra l'ordine delle chiusure.
+type closeLog struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *closeLog) add(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, name)
+}
+
+func (l *closeLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.events)
+}
+
+type loggedCloser struct {
+	io.Reader
+	name string
+	log  *closeLog
+}
+
+func (c loggedCloser) Close() error {
+	c.log.add(c.name)
+	return nil
+}
+
+func loggingDecoderTransport(log *closeLog, body io.Reader) http.RoundTripper {
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		header := make(http.Header)
+		header.Set("Content-Encoding", "rec")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     header,
+			Body:       loggedCloser{Reader: body, name: "body", log: log},
+			Request:    req,
+		}, nil
+	})
+	return transport.CompressionRoundTripper(upstream, transport.CompressionOptions{
+		Decoders: map[string]transport.ContentDecoder{
+			"rec": func(r io.Reader) (io.ReadCloser, error) {
+				return loggedCloser{Reader: r, name: "decoder", log: log}, nil
+			},
+		},
+	})
+}
+
+func TestCompressionRoundTripperClosesDecodersBeforeBody(t *testing.T) {
+	log := &closeLog{}
+	rt := loggingDecoderTransport(log, strings.NewReader("payload"))
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	require.NoError(t, err)
+	buf := make([]byte, 3)
+	_, err = resp.Body.Read(buf)
+	require.NoError(t, err)
+
+	require.NoError(t, resp.Body.Close())
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, []string{"decoder", "body"}, log.get())
+
+	_, err = resp.Body.Read(buf)
+	assert.Error(t, err)
+}
+
+func TestCompressionRoundTripperCloseDuringRead(t *testing.T) {
+	log := &closeLog{}
+	rt := loggingDecoderTransport(log, infiniteReader{})
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 512)
+		for {
+			if _, err := resp.Body.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, resp.Body.Close())
+	<-done
+	assert.ElementsMatch(t, []string{"decoder", "body"}, log.get())
+}
+
+// infiniteReader produce byte senza fine.
+type infiniteReader struct{}
+
+func (infiniteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
@@ -0,0 +1,263 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Priority e' la classe di priorita' di una richiesta in coda su
+// [ConcurrencyLimiter]: a parita' di risorse libere passa prima la priorita'
+// piu' alta, e a parita' di priorita' la richiesta in coda da piu' tempo.
+type Priority int
+
+const (
+	// PriorityBatch e' per i job di massa che possono attendere.
+	PriorityBatch Priority = -1
+	// PriorityNormal e' la priorita' delle richieste senza indicazioni.
+	PriorityNormal Priority = 0
+	// PriorityInteractive e' per le richieste con un utente in attesa.
+	PriorityInteractive Priority = 1
+)
+
+type priorityKey struct{}
+
+// WithPriority restituisce un context che assegna la priorita' p alle
+// richieste che lo usano.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFromContext restituisce la priorita' impostata con
+// [WithPriority], oppure [PriorityNormal].
+func PriorityFromContext(ctx context.Context) Priority {
+	p, _ := ctx.Value(priorityKey{}).(Priority)
+	return p
+}
+
+// ConcurrencyOptions configura [NewConcurrencyLimiter].
+type ConcurrencyOptions struct {
+	// MaxPerHost limita le richieste in volo verso lo stesso host. Se <= 0
+	// non c'e' limite per host.
+	MaxPerHost int
+	// MaxTotal limita le richieste in volo complessive. Se <= 0 non c'e'
+	// limite globale.
+	MaxTotal int
+	// OnAcquire, se valorizzato, riceve il tempo trascorso in coda da ogni
+	// richiesta che ottiene uno slot.
+	OnAcquire func(host string, p Priority, wait time.Duration)
+}
+
+// ConcurrencyStats e' una fotografia dello stato di un [ConcurrencyLimiter].
+type ConcurrencyStats struct {
+	// InFlight conta le richieste in volo, body della risposta compreso.
+	InFlight int
+	// InFlightPerHost conta le richieste in volo per host.
+	InFlightPerHost map[string]int
+	// Queued conta le richieste in attesa di uno slot.
+	Queued int
+	// Acquired conta le richieste che hanno ottenuto uno slot.
+	Acquired uint64
+	// TotalWait e MaxWait misurano il tempo trascorso in coda.
+	TotalWait time.Duration
+	MaxWait   time.Duration
+}
+
+// ConcurrencyLimiter limita le richieste contemporaneamente in volo, per
+// host e in totale, per le API che rifiutano il parallelismo. Le richieste
+// oltre il limite attendono in coda rispettando il proprio context; lo slot
+// viene liberato quando il body della risposta e' stato letto o chiuso.
+//
+// La coda e' ordinata per [Priority]: le richieste interattive superano
+// quelle batch. Una richiesta bloccata dal limite del proprio host non
+// blocca quelle verso altri host.
+type ConcurrencyLimiter struct {
+	next http.RoundTripper
+	opts ConcurrencyOptions
+
+	mu       sync.Mutex
+	inFlight int
+	perHost  map[string]int
+	waiters  []*concurrencyWaiter // ordinati per priorita', poi per arrivo
+	stats    ConcurrencyStats
+}
+
+type concurrencyWaiter struct {
+	host     string
+	priority Priority
+	queued   time.Time
+	ready    chan struct{}
+	granted  bool
+}
+
+// NewConcurrencyLimiter crea un [ConcurrencyLimiter] sopra next.
+func NewConcurrencyLimiter(next http.RoundTripper, opts ConcurrencyOptions) *ConcurrencyLimiter {
+	if next == nil {
+		next = Default()
+	}
+
+	return &ConcurrencyLimiter{
+		next:    next,
+		opts:    opts,
+		perHost: make(map[string]int),
+	}
+}
+
+// Stats restituisce lo stato corrente del limiter.
+func (l *ConcurrencyLimiter) Stats() ConcurrencyStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	out := l.stats
+	out.InFlight = l.inFlight
+	out.Queued = len(l.waiters)
+	out.InFlightPerHost = make(map[string]int, len(l.perHost))
+	for host, n := range l.perHost {
+		out.InFlightPerHost[host] = n
+	}
+	return out
+}
+
+func (l *ConcurrencyLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	priority := PriorityFromContext(req.Context())
+
+	wait, err := l.acquire(req.Context(), host, priority)
+	if err != nil {
+		return nil, err
+	}
+	if l.opts.OnAcquire != nil {
+		l.opts.OnAcquire(host, priority, wait)
+	}
+
+	resp, err := l.next.RoundTrip(req)
+	if err != nil {
+		l.release(host)
+		return nil, err
+	}
+	if resp.Body == nil || resp.Body == http.NoBody {
+		l.release(host)
+		return resp, nil
+	}
+
+	resp.Body = &releaseBody{rc: resp.Body, release: func() { l.release(host) }}
+	return resp, nil
+}
+
+// acquire ottiene uno slot per host, attendendo in coda se necessario, e
+// restituisce il tempo di attesa.
+func (l *ConcurrencyLimiter) acquire(ctx context.Context, host string, priority Priority) (time.Duration, error) {
+	start := time.Now()
+
+	l.mu.Lock()
+	// Dopo ogni rilascio la coda viene smaltita: se c'e' posto nessuno in
+	// attesa puo' usarlo, quindi la richiesta passa subito.
+	if l.canRunLocked(host) {
+		l.takeLocked(host, 0)
+		l.mu.Unlock()
+		return 0, nil
+	}
+
+	w := &concurrencyWaiter{host: host, priority: priority, queued: start, ready: make(chan struct{})}
+	l.enqueueLocked(w)
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		if w.granted {
+			// Lo slot e' arrivato insieme alla cancellazione: va restituito.
+			l.mu.Unlock()
+			l.release(host)
+			return 0, ctx.Err()
+		}
+		l.removeLocked(w)
+		l.mu.Unlock()
+		return 0, ctx.Err()
+	}
+}
+
+func (l *ConcurrencyLimiter) release(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	if l.perHost[host]--; l.perHost[host] <= 0 {
+		delete(l.perHost, host)
+	}
+	l.dispatchLocked()
+}
+
+// dispatchLocked assegna gli slot liberi ai primi waiter che possono usarli.
+func (l *ConcurrencyLimiter) dispatchLocked() {
+	now := time.Now()
+	for i := 0; i < len(l.waiters); {
+		w := l.waiters[i]
+		if !l.canRunLocked(w.host) {
+			i++
+			continue
+		}
+		l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+		w.granted = true
+		l.takeLocked(w.host, now.Sub(w.queued))
+		close(w.ready)
+	}
+}
+
+func (l *ConcurrencyLimiter) canRunLocked(host string) bool {
+	if l.opts.MaxTotal > 0 && l.inFlight >= l.opts.MaxTotal {
+		return false
+	}
+	return l.opts.MaxPerHost <= 0 || l.perHost[host] < l.opts.MaxPerHost
+}
+
+func (l *ConcurrencyLimiter) takeLocked(host string, wait time.Duration) {
+	l.inFlight++
+	l.perHost[host]++
+	l.stats.Acquired++
+	l.stats.TotalWait += wait
+	l.stats.MaxWait = max(l.stats.MaxWait, wait)
+}
+
+func (l *ConcurrencyLimiter) enqueueLocked(w *concurrencyWaiter) {
+	i := len(l.waiters)
+	for i > 0 && l.waiters[i-1].priority < w.priority {
+		i--
+	}
+	l.waiters = append(l.waiters, nil)
+	copy(l.waiters[i+1:], l.waiters[i:])
+	l.waiters[i] = w
+}
+
+func (l *ConcurrencyLimiter) removeLocked(w *concurrencyWaiter) {
+	for i, other := range l.waiters {
+		if other == w {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// releaseBody libera lo slot della richiesta a fine lettura o alla chiusura.
+type releaseBody struct {
+	rc      io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	if err != nil {
+		b.once.Do(b.release)
+	}
+	return n, err
+}
+
+func (b *releaseBody) Close() error {
+	b.once.Do(b.release)
+	return b.rc.Close()
+}
@@ -0,0 +1,154 @@
+package transport_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lucasepe/x/http/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingUpstream risponde solo quando release viene chiuso e tiene traccia
+// del massimo numero di richieste contemporanee.
+func blockingUpstream(release <-chan struct{}, current, peak *int32, order *[]string, mu *sync.Mutex) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		n := atomic.AddInt32(current, 1)
+		for {
+			p := atomic.LoadInt32(peak)
+			if n <= p || atomic.CompareAndSwapInt32(peak, p, n) {
+				break
+			}
+		}
+		if order != nil {
+			mu.Lock()
+			*order = append(*order, req.URL.Path)
+			mu.Unlock()
+		}
+		<-release
+		atomic.AddInt32(current, -1)
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: io.NopCloser(strings.NewReader("ok")), Request: req}, nil
+	})
+}
+
+func TestConcurrencyLimiterCapsInFlightPerHost(t *testing.T) {
+	release := make(chan struct{})
+	var current, peak int32
+	limiter := transport.NewConcurrencyLimiter(blockingUpstream(release, &current, &peak, nil, nil), transport.ConcurrencyOptions{
+		MaxPerHost: 2,
+	})
+
+	var wg sync.WaitGroup
+	for range 6 {
+		wg.Go(func() {
+			resp, err := limiter.RoundTrip(mustRequest(t, http.MethodGet, "https://api.example.com/", nil))
+			if assert.NoError(t, err) {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		})
+	}
+
+	require.Eventually(t, func() bool { return limiter.Stats().Queued == 4 }, time.Second, time.Millisecond)
+	assert.Equal(t, map[string]int{"api.example.com": 2}, limiter.Stats().InFlightPerHost)
+
+	close(release)
+	wg.Wait()
+
+	stats := limiter.Stats()
+	assert.Equal(t, int32(2), peak)
+	assert.Equal(t, 0, stats.InFlight)
+	assert.Equal(t, uint64(6), stats.Acquired)
+	assert.Positive(t, stats.MaxWait)
+}
+
+func TestConcurrencyLimiterDoesNotBlockOtherHosts(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	var current, peak int32
+	blocking := blockingUpstream(release, &current, &peak, nil, nil)
+
+	limiter := transport.NewConcurrencyLimiter(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "slow.example.com" {
+			return blocking.RoundTrip(req)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+	}), transport.ConcurrencyOptions{MaxPerHost: 1, MaxTotal: 3})
+
+	for range 2 {
+		go limiter.RoundTrip(mustRequest(t, http.MethodGet, "https://slow.example.com/", nil))
+	}
+	require.Eventually(t, func() bool { return limiter.Stats().Queued == 1 }, time.Second, time.Millisecond)
+
+	resp, err := limiter.RoundTrip(mustRequest(t, http.MethodGet, "https://fast.example.com/", nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+}
+
+func TestConcurrencyLimiterServesHigherPriorityFirst(t *testing.T) {
+	release := make(chan struct{})
+	var (
+		current, peak int32
+		order         []string
+		mu            sync.Mutex
+	)
+	limiter := transport.NewConcurrencyLimiter(blockingUpstream(release, &current, &peak, &order, &mu), transport.ConcurrencyOptions{
+		MaxTotal: 1,
+	})
+
+	send := func(wg *sync.WaitGroup, path string, p transport.Priority) {
+		wg.Go(func() {
+			req := mustRequest(t, http.MethodGet, "https://example.com"+path, nil)
+			resp, err := limiter.RoundTrip(req.WithContext(transport.WithPriority(req.Context(), p)))
+			if assert.NoError(t, err) {
+				resp.Body.Close()
+			}
+		})
+	}
+
+	var wg sync.WaitGroup
+	send(&wg, "/first", transport.PriorityNormal)
+	require.Eventually(t, func() bool { return limiter.Stats().InFlight == 1 }, time.Second, time.Millisecond)
+
+	send(&wg, "/batch", transport.PriorityBatch)
+	require.Eventually(t, func() bool { return limiter.Stats().Queued == 1 }, time.Second, time.Millisecond)
+	send(&wg, "/normal", transport.PriorityNormal)
+	require.Eventually(t, func() bool { return limiter.Stats().Queued == 2 }, time.Second, time.Millisecond)
+	send(&wg, "/interactive", transport.PriorityInteractive)
+	require.Eventually(t, func() bool { return limiter.Stats().Queued == 3 }, time.Second, time.Millisecond)
+
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, []string{"/first", "/interactive", "/normal", "/batch"}, order)
+}
+
+func TestConcurrencyLimiterHonorsContextWhileQueued(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	var current, peak int32
+	limiter := transport.NewConcurrencyLimiter(blockingUpstream(release, &current, &peak, nil, nil), transport.ConcurrencyOptions{
+		MaxTotal: 1,
+	})
+
+	go limiter.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	require.Eventually(t, func() bool { return limiter.Stats().InFlight == 1 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req := mustRequest(t, http.MethodGet, "https://example.com/", nil).WithContext(ctx)
+
+	_, err := limiter.RoundTrip(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 0, limiter.Stats().Queued)
+}
+
+func TestPriorityFromContextDefaultsToNormal(t *testing.T) {
+	assert.Equal(t, transport.PriorityNormal, transport.PriorityFromContext(context.Background()))
+}
@@ -0,0 +1,220 @@
+package transport
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FaultRule descrive un guasto da iniettare nelle richieste che
+// corrispondono a Host, Path e Methods. I campi del guasto si combinano:
+// prima viene applicata Latency, poi Reset, Timeout o Status (nell'ordine);
+// se nessuno dei tre e' impostato la richiesta prosegue, eventualmente con
+// il body troncato.
+type FaultRule struct {
+	// Name identifica la regola in OnFault.
+	Name string
+	// Host e Path sono pattern per path.Match (es. "*.example.com",
+	// "/api/*"). Se vuoti corrispondono a tutto.
+	Host string
+	Path string
+	// Methods limita i metodi coinvolti. Se vuoto vale per tutti.
+	Methods []string
+	// Probability e' la probabilita' (0-1) che la regola scatti. Se <= 0
+	// scatta sempre.
+	Probability float64
+
+	// Latency ritarda la richiesta, rispettandone il context.
+	Latency time.Duration
+	// Reset simula una connessione chiusa dal server (ECONNRESET).
+	Reset bool
+	// Timeout restituisce un errore di timeout di rete (dopo Latency).
+	Timeout bool
+	// Status, se valorizzato, restituisce una risposta sintetica con questo
+	// status code senza contattare il server.
+	Status int
+	// RetryAfter aggiunge l'header Retry-After alla risposta sintetica.
+	RetryAfter time.Duration
+	// TruncateAfter, se > 0, interrompe il body della risposta reale dopo
+	// TruncateAfter byte con io.ErrUnexpectedEOF.
+	TruncateAfter int64
+}
+
+// FaultOptions configura [FaultInjectionRoundTripper].
+type FaultOptions struct {
+	// Rules viene valutato in ordine: si applica la prima regola che
+	// corrisponde e il cui sorteggio scatta.
+	Rules []FaultRule
+	// Source alimenta i sorteggi. Con una sorgente deterministica (ad
+	// esempio rand.SimplePRNG di github.com/lucasepe/x/rand) la sequenza dei
+	// guasti e' riproducibile. Se nil usa una sorgente basata sull'orario.
+	Source rand.Source
+	// OnFault, se valorizzato, viene invocato per ogni guasto iniettato.
+	OnFault func(req *http.Request, rule FaultRule)
+}
+
+// FaultInjectionRoundTripper inietta guasti configurabili (latenza, status
+// sintetici, reset di connessione, timeout, body troncati) per verificare
+// il comportamento di retry, circuit breaker e cache. E' pensato per test e
+// ambienti di chaos testing, non per la produzione.
+func FaultInjectionRoundTripper(next http.RoundTripper, opts FaultOptions) http.RoundTripper {
+	if next == nil {
+		next = Default()
+	}
+	if opts.Source == nil {
+		opts.Source = rand.NewSource(time.Now().UnixNano())
+	}
+
+	rules := slices.Clone(opts.Rules)
+	for i := range rules {
+		// normalizeMethods trasforma una lista vuota in [GET], mentre qui
+		// vuota significa tutti i metodi.
+		if len(rules[i].Methods) > 0 {
+			rules[i].Methods = normalizeMethods(rules[i].Methods)
+		}
+	}
+
+	return &faultTransport{
+		next:    next,
+		rules:   rules,
+		rnd:     rand.New(opts.Source),
+		onFault: opts.OnFault,
+	}
+}
+
+type faultTransport struct {
+	next    http.RoundTripper
+	rules   []FaultRule
+	onFault func(req *http.Request, rule FaultRule)
+
+	mu  sync.Mutex
+	rnd *rand.Rand // rand.Rand non e' sicuro per l'uso concorrente
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rule, ok := t.pick(req)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	if t.onFault != nil {
+		t.onFault(req, rule)
+	}
+
+	if err := waitForRetry(req.Context(), rule.Latency, 0); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case rule.Reset:
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	case rule.Timeout:
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: faultTimeoutError{}}
+	case rule.Status != 0:
+		return faultResponse(req, rule), nil
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || rule.TruncateAfter <= 0 || resp.Body == nil {
+		return resp, err
+	}
+	resp.Body = &truncatedBody{rc: resp.Body, left: rule.TruncateAfter}
+	return resp, nil
+}
+
+// pick restituisce la prima regola che corrisponde e scatta.
+func (t *faultTransport) pick(req *http.Request) (FaultRule, bool) {
+	for _, rule := range t.rules {
+		if !rule.matches(req) {
+			continue
+		}
+		if rule.Probability <= 0 || t.draw() < rule.Probability {
+			return rule, true
+		}
+	}
+	return FaultRule{}, false
+}
+
+func (t *faultTransport) draw() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rnd.Float64()
+}
+
+func (r FaultRule) matches(req *http.Request) bool {
+	if len(r.Methods) > 0 && !slices.Contains(r.Methods, req.Method) {
+		return false
+	}
+	if r.Host != "" {
+		if ok, _ := path.Match(r.Host, strings.ToLower(req.URL.Hostname())); !ok {
+			return false
+		}
+	}
+	if r.Path != "" {
+		if ok, _ := path.Match(r.Path, req.URL.Path); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func faultResponse(req *http.Request, rule FaultRule) *http.Response {
+	header := make(http.Header)
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	if rule.RetryAfter > 0 {
+		secs := int((rule.RetryAfter + time.Second - 1) / time.Second)
+		header.Set("Retry-After", strconv.Itoa(secs))
+	}
+
+	body := http.StatusText(rule.Status)
+	return &http.Response{
+		Status:        strconv.Itoa(rule.Status) + " " + body,
+		StatusCode:    rule.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		Request:       req,
+	}
+}
+
+// faultTimeoutError imita l'errore di timeout restituito dalla rete.
+type faultTimeoutError struct{}
+
+func (faultTimeoutError) Error() string   { return "i/o timeout (injected)" }
+func (faultTimeoutError) Timeout() bool   { return true }
+func (faultTimeoutError) Temporary() bool { return true }
+
+var _ net.Error = faultTimeoutError{}
+
+// truncatedBody interrompe il body dopo left byte.
+type truncatedBody struct {
+	rc   io.ReadCloser
+	left int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.rc.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
+
+func (b *truncatedBody) Close() error {
+	return b.rc.Close()
+}
@@ -0,0 +1,133 @@
+package transport_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lucasepe/x/http/transport"
+	xrand "github.com/lucasepe/x/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func okUpstream(body string) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+	})
+}
+
+func TestFaultInjectionReturnsSyntheticStatus(t *testing.T) {
+	rt := transport.FaultInjectionRoundTripper(okUpstream("real"), transport.FaultOptions{
+		Rules: []transport.FaultRule{{
+			Host:       "*.example.com",
+			Path:       "/api/*",
+			Methods:    []string{"get"},
+			Status:     http.StatusTooManyRequests,
+			RetryAfter: 1500 * time.Millisecond,
+		}},
+	})
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://api.example.com/api/items", nil))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+	assert.Equal(t, "Too Many Requests", readBody(t, resp))
+
+	for _, tc := range []struct{ method, url string }{
+		{http.MethodPost, "https://api.example.com/api/items"},
+		{http.MethodGet, "https://api.example.com/health"},
+		{http.MethodGet, "https://example.org/api/items"},
+	} {
+		resp, err := rt.RoundTrip(mustRequest(t, tc.method, tc.url, nil))
+		require.NoError(t, err)
+		assert.Equal(t, "real", readBody(t, resp), tc.url)
+	}
+}
+
+func TestFaultInjectionRuleWithoutMethodsMatchesAllMethods(t *testing.T) {
+	rt := transport.FaultInjectionRoundTripper(okUpstream("real"), transport.FaultOptions{
+		Rules: []transport.FaultRule{{Status: http.StatusServiceUnavailable}},
+	})
+
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete} {
+		resp, err := rt.RoundTrip(mustRequest(t, method, "https://example.com/", nil))
+		require.NoError(t, err)
+		readBody(t, resp)
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, method)
+	}
+}
+
+func TestFaultInjectionNetworkErrors(t *testing.T) {
+	reset := transport.FaultInjectionRoundTripper(okUpstream(""), transport.FaultOptions{
+		Rules: []transport.FaultRule{{Reset: true}},
+	})
+	_, err := reset.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	assert.ErrorIs(t, err, syscall.ECONNRESET)
+
+	timeout := transport.FaultInjectionRoundTripper(okUpstream(""), transport.FaultOptions{
+		Rules: []transport.FaultRule{{Timeout: true, Latency: 10 * time.Millisecond}},
+	})
+	start := time.Now()
+	_, err = timeout.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	var netErr net.Error
+	require.True(t, errors.As(err, &netErr))
+	assert.True(t, netErr.Timeout())
+	assert.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+}
+
+func TestFaultInjectionTruncatesBody(t *testing.T) {
+	rt := transport.FaultInjectionRoundTripper(okUpstream("0123456789"), transport.FaultOptions{
+		Rules: []transport.FaultRule{{TruncateAfter: 4}},
+	})
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, "0123", string(data))
+}
+
+func TestFaultInjectionIsReproducibleWithSeededSource(t *testing.T) {
+	run := func() []int {
+		rt := transport.FaultInjectionRoundTripper(okUpstream(""), transport.FaultOptions{
+			Source: xrand.SimplePRNG("chaos"),
+			Rules:  []transport.FaultRule{{Probability: 0.3, Status: http.StatusServiceUnavailable}},
+		})
+		out := make([]int, 50)
+		for i := range out {
+			resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+			require.NoError(t, err)
+			resp.Body.Close()
+			out[i] = resp.StatusCode
+		}
+		return out
+	}
+
+	first := run()
+	assert.Equal(t, first, run())
+	assert.Contains(t, first, http.StatusServiceUnavailable)
+	assert.Contains(t, first, http.StatusOK)
+}
+
+func TestFaultInjectionDrivesRetries(t *testing.T) {
+	rt := transport.RetryRoundTripper(
+		transport.FaultInjectionRoundTripper(okUpstream("ok"), transport.FaultOptions{
+			Source:  xrand.SimplePRNG("retry"),
+			Rules:   []transport.FaultRule{{Name: "flaky", Probability: 0.5, Status: http.StatusBadGateway}},
+			OnFault: func(_ *http.Request, rule transport.FaultRule) { assert.Equal(t, "flaky", rule.Name) },
+		}),
+		transport.RetryOptions{MaxAttempts: 20, StatusCodes: []int{http.StatusBadGateway}, BaseDelay: time.Millisecond},
+	)
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "ok", readBody(t, resp))
+}
@@ -25,6 +25,21 @@ type CacheKeyFunc func(req *http.Request, body []byte) (string, error)
 type FileCacheOptions struct {
 	Methods []string
 	KeyFunc CacheKeyFunc
+
+	// HTTPSemantics abilita il caching conforme a RFC 9111: vengono
+	// memorizzati status e header oltre al body, la freshness segue
+	// Cache-Control/Expires/Age, le risposte scadute sono rivalidate con
+	// If-None-Match/If-Modified-Since e Vary seleziona la variante. Le risposte
+	// mantengono status e header originali e riportano l'header
+	// [CacheStatusHeader]. Se false resta il comportamento "cache-first".
+	HTTPSemantics bool
+
+	// PrivateCache, con HTTPSemantics, tratta il file cache come cache privata
+	// di un solo utente: le risposte "private" e quelle a richieste con
+	// Authorization possono essere memorizzate e s-maxage viene ignorato.
+	// Di default la cache e' considerata condivisa, dato che la directory
+	// puo' essere usata da piu' processi.
+	PrivateCache bool
 }
 
 // FileCacheTransport restituisce un transport che cachea su filesystem le
@@ -32,6 +47,7 @@ type FileCacheOptions struct {
 // Il comportamento e' "cache-first" per le URL gia' presenti: in quel caso il
 // backend non viene contattato. Per le 304, se il contenuto e' disponibile nel
 // file cache, viene restituita una risposta sintetica con body ricostruito.
+// Il file cache resta del chiamante, che lo chiude quando non serve piu'.
 func FileCacheTransport(fs *filecache.FileCacheFS, us http.RoundTripper) http.RoundTripper {
 	return FileCacheTransportWithOptions(fs, us, FileCacheOptions{
 		Methods: []string{http.MethodGet},
@@ -51,10 +67,12 @@ func FileCacheTransportWithOptions(fs *filecache.FileCacheFS, us http.RoundTripp
 	}
 
 	return &cacheRoundTripper{
-		cache:    fs,
-		upstream: us,
-		methods:  normalizeMethods(opts.Methods),
-		keyFunc:  opts.KeyFunc,
+		cache:     fs,
+		upstream:  us,
+		methods:   normalizeMethods(opts.Methods),
+		keyFunc:   opts.KeyFunc,
+		semantics: opts.HTTPSemantics,
+		private:   opts.PrivateCache,
 	}
 }
 
@@ -93,10 +111,12 @@ func DigestCacheKeyMethodURLHeadersBody(headerNames ...string) CacheKeyFunc {
 }
 
 type cacheRoundTripper struct {
-	cache    *filecache.FileCacheFS
-	upstream http.RoundTripper
-	methods  []string
-	keyFunc  CacheKeyFunc
+	cache     *filecache.FileCacheFS
+	upstream  http.RoundTripper
+	methods   []string
+	keyFunc   CacheKeyFunc
+	semantics bool
+	private   bool
 }
 
 func (t *cacheRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -105,6 +125,10 @@ func (t *cacheRoundTripper) RoundTrip(req *http.Request) (*http.Response, error)
 		t.upstream = Default()
 	}
 
+	if t.semantics {
+		return t.roundTripHTTP(req)
+	}
+
 	if !slices.Contains(t.methods, req.Method) {
 		return t.upstream.RoundTrip(req)
 	}
@@ -234,6 +258,8 @@ func normalizeMethods(methods []string) []string {
 	return out
 }
 
+// requestBodyBytes legge il body della richiesta e lo sostituisce con una
+// copia in memoria, ripetibile tramite GetBody.
 func requestBodyBytes(req *http.Request) ([]byte, error) {
 	if req == nil || req.Body == nil || req.Body == http.NoBody {
 		return nil, nil
@@ -246,10 +272,10 @@ func requestBodyBytes(req *http.Request) ([]byte, error) {
 
 	req.Body.Close()
 	req.Body = io.NopCloser(bytes.NewReader(body))
-	if req.GetBody != nil {
-		req.GetBody = func() (io.ReadCloser, error) {
-			return io.NopCloser(bytes.NewReader(body)), nil
-		}
+	// il body ora e' in memoria: GetBody lo rende ritentabile anche quando il
+	// chiamante non l'aveva impostato
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
 	}
 
 	return body, nil
@@ -0,0 +1,231 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// hedgeSamples e' il numero di latenze recenti usate per il percentile.
+const hedgeSamples = 100
+
+// HedgeOptions configura [HedgeRoundTripper].
+type HedgeOptions struct {
+	// Delay e' l'attesa prima di inviare la copia della richiesta. Se <= 0
+	// usa 100ms. Con Percentile e' usato finche' non ci sono abbastanza
+	// campioni.
+	Delay time.Duration
+	// Percentile, se compreso tra 0 e 1 (es. 0.95), calcola l'attesa come
+	// quel percentile delle latenze recenti.
+	Percentile float64
+	// MinSamples e' il numero di latenze necessarie per usare Percentile. Se
+	// <= 0 usa 20.
+	MinSamples int
+	// MinDelay e' l'attesa minima calcolata con Percentile: con latenze
+	// recenti quasi nulle evita di duplicare ogni richiesta. Se <= 0 usa 10ms.
+	MinDelay time.Duration
+	// Methods limita i metodi su cui fare hedging. Se vuoto usa GET, HEAD e
+	// OPTIONS, come [RetryOptions].
+	Methods []string
+	// Budget, se valorizzato, limita le copie extra rispetto alle richieste.
+	// Puo' essere condiviso con [RetryOptions.Budget].
+	Budget *RetryBudget
+	// OnHedge, se valorizzato, viene invocato quando parte una copia.
+	OnHedge func(req *http.Request)
+}
+
+// HedgeRoundTripper riduce la latenza di coda inviando una seconda copia
+// della richiesta quando la prima non ha risposto entro Delay (o entro il
+// percentile configurato). Restituisce la prima risposta riuscita (errore
+// assente e status < 500); l'altra viene cancellata e il suo body chiuso.
+//
+// Vale solo per i metodi idempotenti in Methods e per richieste senza body o
+// con GetBody. Ogni copia raddoppia il carico: usare Budget per contenerlo.
+func HedgeRoundTripper(next http.RoundTripper, opts HedgeOptions) http.RoundTripper {
+	if next == nil {
+		next = Default()
+	}
+	if opts.Delay <= 0 {
+		opts.Delay = 100 * time.Millisecond
+	}
+	if opts.MinSamples <= 0 {
+		opts.MinSamples = 20
+	}
+	if opts.MinDelay <= 0 {
+		opts.MinDelay = 10 * time.Millisecond
+	}
+	if len(opts.Methods) == 0 {
+		opts.Methods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	}
+	opts.Methods = normalizeMethods(opts.Methods)
+
+	return &hedgeTransport{
+		next: next,
+		opts: opts,
+	}
+}
+
+type hedgeTransport struct {
+	next http.RoundTripper
+	opts HedgeOptions
+
+	mu        sync.Mutex
+	latencies []time.Duration // buffer circolare
+	cursor    int
+}
+
+type hedgeResult struct {
+	attempt int
+	resp    *http.Response
+	err     error
+	cancel  context.CancelFunc
+}
+
+func (r hedgeResult) succeeded() bool {
+	return r.err == nil && r.resp.StatusCode < http.StatusInternalServerError
+}
+
+func (t *hedgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !slices.Contains(t.opts.Methods, req.Method) || !canRetryRequest(req) {
+		return t.next.RoundTrip(req)
+	}
+	if t.opts.Budget != nil {
+		t.opts.Budget.deposit()
+	}
+
+	start := time.Now()
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+
+	launch := func(attempt int) error {
+		attemptReq, err := requestForAttempt(req, attempt)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels = append(cancels, cancel)
+		attemptReq = attemptReq.WithContext(ctx)
+
+		go func() {
+			resp, err := t.next.RoundTrip(attemptReq)
+			results <- hedgeResult{attempt: attempt, resp: resp, err: err, cancel: cancel}
+		}()
+		return nil
+	}
+
+	if err := launch(1); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(t.delay())
+	defer timer.Stop()
+
+	pending := 1
+	var failed *hedgeResult
+	for {
+		select {
+		case <-timer.C:
+			if t.opts.Budget != nil && !t.opts.Budget.withdraw() {
+				continue
+			}
+			if launch(2) == nil {
+				pending++
+				if t.opts.OnHedge != nil {
+					t.opts.OnHedge(req)
+				}
+			}
+
+		case res := <-results:
+			pending--
+			switch {
+			case res.succeeded():
+				t.observe(time.Since(start))
+				if failed != nil {
+					discardHedge(*failed)
+				}
+			case pending > 0:
+				// Aspettiamo l'altra copia, che potrebbe ancora riuscire.
+				failed = &res
+				continue
+			case failed != nil:
+				// Entrambe fallite: restituiamo il primo esito.
+				discardHedge(res)
+				res = *failed
+			}
+			// Un fallimento prima del ritardo arriva qui senza copie in volo:
+			// ai fallimenti pensa il retry, non l'hedging.
+
+			if pending > 0 {
+				// La copia perdente viene cancellata e chiusa in background.
+				for i, cancel := range cancels {
+					if i != res.attempt-1 {
+						cancel()
+					}
+				}
+				go func() {
+					discardHedge(<-results)
+				}()
+			}
+			return finishHedge(res)
+		}
+	}
+}
+
+// finishHedge restituisce l'esito, cancellando il suo context solo dopo la
+// chiusura del body.
+func finishHedge(res hedgeResult) (*http.Response, error) {
+	if res.err != nil {
+		res.cancel()
+		return nil, res.err
+	}
+	res.resp.Body = &releaseBody{rc: res.resp.Body, release: res.cancel}
+	return res.resp, nil
+}
+
+// discardHedge scarta un esito perdente, leggendo un po' di body per
+// permettere il riuso della connessione.
+func discardHedge(res hedgeResult) {
+	defer res.cancel()
+	if res.err != nil || res.resp.Body == nil {
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(res.resp.Body, 4<<10))
+	res.resp.Body.Close()
+}
+
+// delay restituisce l'attesa prima della copia.
+func (t *hedgeTransport) delay() time.Duration {
+	if t.opts.Percentile <= 0 || t.opts.Percentile >= 1 {
+		return t.opts.Delay
+	}
+
+	t.mu.Lock()
+	if len(t.latencies) < t.opts.MinSamples {
+		t.mu.Unlock()
+		return t.opts.Delay
+	}
+	sorted := slices.Clone(t.latencies)
+	t.mu.Unlock()
+
+	slices.Sort(sorted)
+	return max(sorted[int(t.opts.Percentile*float64(len(sorted)-1))], t.opts.MinDelay)
+}
+
+// observe registra la latenza della risposta vincente.
+func (t *hedgeTransport) observe(d time.Duration) {
+	if t.opts.Percentile <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.latencies) < hedgeSamples {
+		t.latencies = append(t.latencies, d)
+		return
+	}
+	t.latencies[t.cursor] = d
+	t.cursor = (t.cursor + 1) % hedgeSamples
+}
@@ -0,0 +1,190 @@
+package transport_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lucasepe/x/http/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// trackedBody segnala la chiusura del body.
+type trackedBody struct {
+	io.Reader
+	closed *int32
+}
+
+func (b trackedBody) Close() error {
+	atomic.AddInt32(b.closed, 1)
+	return nil
+}
+
+// sequencedUpstream risponde alla chiamata n-esima dopo delays[n], con il
+// numero della chiamata nel body; se il context viene cancellato prima
+// restituisce l'errore del context.
+func sequencedUpstream(delays []time.Duration, calls, closed *int32) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		n := atomic.AddInt32(calls, 1)
+		select {
+		case <-time.After(delays[n-1]):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       trackedBody{Reader: strings.NewReader(string(rune('0' + n))), closed: closed},
+			Request:    req,
+		}, nil
+	})
+}
+
+func TestHedgeRoundTripperReturnsFasterCopy(t *testing.T) {
+	var calls, closed, hedges int32
+	rt := transport.HedgeRoundTripper(sequencedUpstream([]time.Duration{time.Second, 10 * time.Millisecond}, &calls, &closed), transport.HedgeOptions{
+		Delay:   20 * time.Millisecond,
+		OnHedge: func(*http.Request) { atomic.AddInt32(&hedges, 1) },
+	})
+
+	start := time.Now()
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, "2", readBody(t, resp))
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hedges))
+}
+
+func TestHedgeRoundTripperSkipsHedgeWhenFast(t *testing.T) {
+	var calls, closed int32
+	rt := transport.HedgeRoundTripper(sequencedUpstream([]time.Duration{0, 0}, &calls, &closed), transport.HedgeOptions{
+		Delay: 50 * time.Millisecond,
+	})
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "1", readBody(t, resp))
+
+	time.Sleep(80 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestHedgeRoundTripperDrainsLoser(t *testing.T) {
+	var calls, closed int32
+	rt := transport.HedgeRoundTripper(sequencedUpstream([]time.Duration{30 * time.Millisecond, 30 * time.Millisecond}, &calls, &closed), transport.HedgeOptions{
+		Delay: time.Millisecond,
+	})
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// Chiuso il vincitore, anche il perdente (cancellato o arrivato) e' chiuso.
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&closed) >= 1 }, time.Second, time.Millisecond)
+}
+
+func TestHedgeRoundTripperIgnoresNonIdempotentMethods(t *testing.T) {
+	var calls, closed int32
+	rt := transport.HedgeRoundTripper(sequencedUpstream([]time.Duration{50 * time.Millisecond, 0}, &calls, &closed), transport.HedgeOptions{
+		Delay: time.Millisecond,
+	})
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodPost, "https://example.com/", strings.NewReader("x")))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestHedgeRoundTripperWaitsForCopyAfterFailure(t *testing.T) {
+	var calls int32
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		status := http.StatusOK
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(30 * time.Millisecond)
+			status = http.StatusBadGateway
+		} else {
+			time.Sleep(60 * time.Millisecond)
+		}
+		return &http.Response{StatusCode: status, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+	})
+
+	rt := transport.HedgeRoundTripper(upstream, transport.HedgeOptions{Delay: 10 * time.Millisecond})
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestHedgeRoundTripperRespectsBudget(t *testing.T) {
+	var calls, closed int32
+	rt := transport.HedgeRoundTripper(sequencedUpstream([]time.Duration{20 * time.Millisecond, 20 * time.Millisecond, 20 * time.Millisecond}, &calls, &closed), transport.HedgeOptions{
+		Delay:  time.Millisecond,
+		Budget: transport.NewRetryBudget(0, 1),
+	})
+
+	for range 2 {
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	time.Sleep(40 * time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls), "one hedge allowed by the budget")
+}
+
+func TestHedgeRoundTripperUsesLatencyPercentile(t *testing.T) {
+	var calls int32
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&calls, 1) > 5 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+	})
+
+	var hedges int32
+	rt := transport.HedgeRoundTripper(upstream, transport.HedgeOptions{
+		Delay:      time.Hour,
+		Percentile: 0.9,
+		MinSamples: 5,
+		OnHedge:    func(*http.Request) { atomic.AddInt32(&hedges, 1) },
+	})
+
+	for range 6 {
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hedges), "the sixth request is hedged after the p90 of fast samples")
+}
+
+func TestHedgeRoundTripperClampsPercentileDelay(t *testing.T) {
+	var calls int32
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&calls, 1) > 5 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+	})
+
+	var hedges int32
+	rt := transport.HedgeRoundTripper(upstream, transport.HedgeOptions{
+		Delay:      time.Hour,
+		Percentile: 0.9,
+		MinSamples: 5,
+		MinDelay:   time.Second,
+		OnHedge:    func(*http.Request) { atomic.AddInt32(&hedges, 1) },
+	})
+
+	for range 8 {
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	assert.Zero(t, atomic.LoadInt32(&hedges), "near-zero samples must not hedge every request")
+	assert.Equal(t, int32(8), atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,95 @@
+package transport_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasepe/x/http/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHMACSignerRoundTripperDefaultCanonicalization(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+
+	var seen *http.Request
+	rt := transport.HMACSignerRoundTripper(captureRequest(&seen), transport.HMACOptions{
+		KeyID:  "key-1",
+		Secret: []byte("shared"),
+		Now:    func() time.Time { return ts },
+	})
+
+	req, err := http.NewRequest(http.MethodPost, "https://api.example.com/v1/orders?page=2", strings.NewReader(`{"id":1}`))
+	require.NoError(t, err)
+
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	bodySum := sha256.Sum256([]byte(`{"id":1}`))
+	mac := hmac.New(sha256.New, []byte("shared"))
+	mac.Write([]byte("POST\n/v1/orders?page=2\n1700000000\n" + hex.EncodeToString(bodySum[:])))
+
+	assert.Equal(t, base64.StdEncoding.EncodeToString(mac.Sum(nil)), seen.Header.Get("X-Signature"))
+	assert.Equal(t, "1700000000", seen.Header.Get("X-Timestamp"))
+	assert.Equal(t, "key-1", seen.Header.Get("X-Key-Id"))
+
+	body, err := io.ReadAll(seen.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"id":1}`, string(body))
+	require.NotNil(t, seen.GetBody)
+}
+
+func TestHMACSignerRoundTripperCustomCanonicalization(t *testing.T) {
+	var seen *http.Request
+	rt := transport.HMACSignerRoundTripper(captureRequest(&seen), transport.HMACOptions{
+		Secret:          []byte("shared"),
+		Hash:            sha512.New,
+		SignatureHeader: "X-Hub-Signature",
+		HexEncoding:     true,
+		Canonicalize: func(req *http.Request, body []byte, _ time.Time) string {
+			return string(body)
+		},
+	})
+
+	req, err := http.NewRequest(http.MethodPost, "https://hooks.example.com/", strings.NewReader("payload"))
+	require.NoError(t, err)
+
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	mac := hmac.New(sha512.New, []byte("shared"))
+	mac.Write([]byte("payload"))
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), seen.Header.Get("X-Hub-Signature"))
+	assert.Empty(t, seen.Header.Get("X-Key-Id"))
+}
+
+func TestHMACSignerRoundTripperSetsGetBody(t *testing.T) {
+	var seen *http.Request
+	rt := transport.HMACSignerRoundTripper(captureRequest(&seen), transport.HMACOptions{Secret: []byte("shared")})
+
+	// un body senza GetBody, come quello di un io.Pipe
+	req, err := http.NewRequest(http.MethodPost, "https://api.example.com/v1/orders", io.NopCloser(strings.NewReader("payload")))
+	require.NoError(t, err)
+	require.Nil(t, req.GetBody)
+
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	require.NotNil(t, seen.GetBody)
+	again, err := seen.GetBody()
+	require.NoError(t, err)
+	body, err := io.ReadAll(again)
+	require.NoError(t, err)
+	assert.Equal(t, "payload", string(body))
+}
@@ -7,10 +7,25 @@ import (
 	"golang.org/x/time/rate"
 )
 
+// HostLimiterOptions configura [HostLimiterWithOptions].
+type HostLimiterOptions struct {
+	Rate  rate.Limit
+	Burst int
+	// HostRate, se valorizzato, puo' imporre a un host un rate piu' basso di
+	// Rate (ad esempio il Crawl-delay letto da robots.txt). Un valore <= 0
+	// o superiore a Rate viene ignorato.
+	HostRate func(host string) rate.Limit
+}
+
 // HostLimiter applica un rate limit distinto per ogni host contattato.
 // Ogni host riceve il proprio limiter, creato lazy al primo utilizzo, cosi'
 // domini diversi non si influenzano tra loro.
 func HostLimiter(rl rate.Limit, burst int, next http.RoundTripper) http.RoundTripper {
+	return HostLimiterWithOptions(next, HostLimiterOptions{Rate: rl, Burst: burst})
+}
+
+// HostLimiterWithOptions e' la variante configurabile di [HostLimiter].
+func HostLimiterWithOptions(next http.RoundTripper, opts HostLimiterOptions) http.RoundTripper {
 	if next == nil {
 		next = Default()
 	}
@@ -18,8 +33,9 @@ func HostLimiter(rl rate.Limit, burst int, next http.RoundTripper) http.RoundTri
 	return &hostLimiterTransport{
 		next:     next,
 		limiters: make(map[string]*rate.Limiter),
-		rate:     rl,
-		burst:    burst,
+		rate:     opts.Rate,
+		burst:    opts.Burst,
+		hostRate: opts.HostRate,
 	}
 }
 
@@ -29,8 +45,9 @@ type hostLimiterTransport struct {
 	mu       sync.Mutex
 	limiters map[string]*rate.Limiter
 
-	rate  rate.Limit
-	burst int
+	rate     rate.Limit
+	burst    int
+	hostRate func(host string) rate.Limit
 }
 
 func (t *hostLimiterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -47,12 +64,18 @@ func (t *hostLimiterTransport) limiterFor(host string) *rate.Limiter {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	if l, ok := t.limiters[host]; ok {
-		// Reimpieghiamo sempre lo stesso limiter per garantire fairness per host.
-		return l
+	l, ok := t.limiters[host]
+	if !ok {
+		l = rate.NewLimiter(t.rate, t.burst)
+		t.limiters[host] = l
+	}
+	// Reimpieghiamo sempre lo stesso limiter per garantire fairness per host;
+	// un rate specifico dell'host puo' solo rallentarlo.
+	if t.hostRate != nil {
+		if r := t.hostRate(host); r > 0 && r < t.rate && r != l.Limit() {
+			l.SetLimit(r)
+			l.SetBurst(1)
+		}
 	}
-
-	l := rate.NewLimiter(t.rate, t.burst)
-	t.limiters[host] = l
 	return l
 }
@@ -0,0 +1,583 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lucasepe/x/env"
+	"github.com/lucasepe/x/filecache"
+	"github.com/lucasepe/x/log"
+)
+
+// CacheStatusHeader e' l'header (RFC 9211) aggiunto dal file cache in
+// modalita' HTTPSemantics per indicare come e' stata servita la risposta,
+// ad esempio "filecache; hit" oppure "filecache; fwd=stale; fwd-status=304".
+const CacheStatusHeader = "Cache-Status"
+
+const cacheStatusName = "filecache"
+
+// heuristicMaxLifetime limita la freshness euristica calcolata da
+// Last-Modified quando la risposta non dichiara una scadenza esplicita.
+const heuristicMaxLifetime = 24 * time.Hour
+
+// heuristicallyCacheable elenca gli status code memorizzabili anche senza
+// informazioni di freshness esplicite (RFC 9110, sezione 15.1).
+var heuristicallyCacheable = []int{
+	http.StatusOK,
+	http.StatusNonAuthoritativeInfo,
+	http.StatusNoContent,
+	http.StatusMultipleChoices,
+	http.StatusMovedPermanently,
+	http.StatusPermanentRedirect,
+	http.StatusNotFound,
+	http.StatusMethodNotAllowed,
+	http.StatusGone,
+	http.StatusRequestURITooLong,
+	http.StatusNotImplemented,
+}
+
+// storedResponse e' la rappresentazione persistita di una risposta: una riga
+// JSON con status, header e timestamp seguita dal body grezzo.
+// Un'entry con StatusCode zero e' solo un marker, salvato con la chiave
+// primaria, che indica su quali header di richiesta variano le risposte
+// memorizzate e con quali chiavi sono state salvate le varianti.
+type storedResponse struct {
+	StatusCode   int         `json:"status_code,omitempty"`
+	Status       string      `json:"status,omitempty"`
+	Proto        string      `json:"proto,omitempty"`
+	ProtoMajor   int         `json:"proto_major,omitempty"`
+	ProtoMinor   int         `json:"proto_minor,omitempty"`
+	Header       http.Header `json:"header,omitempty"`
+	RequestTime  time.Time   `json:"request_time,omitzero"`
+	ResponseTime time.Time   `json:"response_time,omitzero"`
+	VaryOn       []string    `json:"vary_on,omitempty"`
+	Variants     []string    `json:"variants,omitempty"`
+
+	Body []byte `json:"-"`
+}
+
+func (s *storedResponse) marshal() ([]byte, error) {
+	head, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(head)+1+len(s.Body))
+	out = append(out, head...)
+	out = append(out, '\n')
+	return append(out, s.Body...), nil
+}
+
+func unmarshalStoredResponse(data []byte) (*storedResponse, error) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return nil, errors.New("invalid cached response")
+	}
+	var s storedResponse
+	if err := json.Unmarshal(data[:i], &s); err != nil {
+		return nil, err
+	}
+	s.Body = data[i+1:]
+	return &s, nil
+}
+
+// roundTripHTTP implementa la modalita' HTTPSemantics, che segue RFC 9111:
+// freshness da Cache-Control/Expires/Age, rivalidazione con richieste
+// condizionali, varianti per Vary e invalidazione sui metodi non sicuri.
+func (t *cacheRoundTripper) roundTripHTTP(req *http.Request) (*http.Response, error) {
+	if !slices.Contains(t.methods, req.Method) || t.cache == nil || env.True("SKIP_CACHE") {
+		return t.forward(req)
+	}
+
+	reqCC := parseCacheControl(req.Header)
+	if reqCC.has("no-store") || hasConditionalHeaders(req.Header) {
+		// Le richieste condizionali del chiamante vengono gestite dal chiamante
+		// stesso: non interferiamo con i suoi validator.
+		return t.forward(req)
+	}
+
+	key, err := t.cacheKey(req)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, variant := t.lookup(key, req)
+	if stored != nil {
+		age := stored.currentAge(time.Now())
+		if t.canServe(stored, reqCC, age) {
+			log.D("cache hit",
+				log.String("method", req.Method),
+				log.String("url", req.URL.String()),
+			)
+			return stored.response(req, age, "hit"), nil
+		}
+	}
+	if stored == nil && reqCC.has("only-if-cached") {
+		return &http.Response{
+			StatusCode: http.StatusGatewayTimeout,
+			Status:     "504 Gateway Timeout",
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{CacheStatusHeader: []string{cacheStatusName + "; fwd=miss"}},
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	}
+
+	log.D("cache missed",
+		log.String("method", req.Method),
+		log.String("url", req.URL.String()),
+	)
+
+	outReq := req
+	if stored != nil {
+		outReq = conditionalRequest(req, stored)
+	}
+
+	reqTime := time.Now()
+	resp, err := t.upstream.RoundTrip(outReq)
+	if err != nil {
+		return nil, err
+	}
+	respTime := time.Now()
+	// i metodi non sicuri abilitati con Methods invalidano come in forward
+	t.invalidateAfter(req, resp)
+
+	if stored != nil && resp.StatusCode == http.StatusNotModified {
+		// La risposta memorizzata e' ancora valida: aggiorniamo i suoi header
+		// con quelli della 304 e la restituiamo con lo status originale.
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		stored.refresh(resp.Header, reqTime, respTime)
+		t.save(variant, stored)
+		return stored.response(req, stored.currentAge(time.Now()), "fwd=stale; fwd-status=304"), nil
+	}
+
+	if !t.isStorable(req, resp, reqCC) {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	fresh := &storedResponse{
+		StatusCode:   resp.StatusCode,
+		Status:       resp.Status,
+		Proto:        resp.Proto,
+		ProtoMajor:   resp.ProtoMajor,
+		ProtoMinor:   resp.ProtoMinor,
+		Header:       cloneHeader(resp.Header),
+		RequestTime:  reqTime,
+		ResponseTime: respTime,
+		Body:         body,
+	}
+	t.store(key, req, fresh)
+
+	fwd := "fwd=uri-miss"
+	if stored != nil {
+		fwd = "fwd=stale"
+	}
+	resp.Header.Set(CacheStatusHeader, cacheStatusName+"; "+fwd+"; stored")
+	return resp, nil
+}
+
+// forward inoltra la richiesta senza consultare la cache; per i metodi non
+// sicuri andati a buon fine invalida le risposte memorizzate per la stessa
+// URL (RFC 9111, sezione 4.4).
+func (t *cacheRoundTripper) forward(req *http.Request) (*http.Response, error) {
+	resp, err := t.upstream.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.invalidateAfter(req, resp)
+	return resp, nil
+}
+
+// invalidateAfter invalida le risposte memorizzate per la URL della
+// richiesta se il metodo non e' sicuro e la risposta non e' un errore.
+func (t *cacheRoundTripper) invalidateAfter(req *http.Request, resp *http.Response) {
+	if t.cache != nil && !isSafeMethod(req.Method) && resp.StatusCode < 400 {
+		t.invalidate(req)
+	}
+}
+
+// invalidate rimuove le risposte GET memorizzate per la URL della richiesta:
+// il marker e le varianti che elenca.
+func (t *cacheRoundTripper) invalidate(req *http.Request) {
+	getReq := req.Clone(req.Context())
+	getReq.Method = http.MethodGet
+	getReq.Body = nil
+	getReq.GetBody = nil
+	getReq.ContentLength = 0
+
+	key, err := t.keyFunc(getReq, nil)
+	if err != nil {
+		return
+	}
+	marker := t.marker(key)
+	if marker == nil {
+		return
+	}
+	for _, k := range append(marker.Variants, key) {
+		if err := t.cache.Del(k); err != nil && !errors.Is(err, filecache.ErrNotFound) {
+			log.E("unable to invalidate cached responses",
+				log.String("url", req.URL.String()),
+				log.Err("err", err),
+			)
+		}
+	}
+}
+
+// marker restituisce il marker memorizzato con la chiave primaria, o nil.
+func (t *cacheRoundTripper) marker(key string) *storedResponse {
+	data, err := t.cache.Get(key)
+	if err != nil {
+		return nil
+	}
+	marker, err := unmarshalStoredResponse(data)
+	if err != nil || marker.StatusCode != 0 {
+		return nil
+	}
+	return marker
+}
+
+// lookup restituisce la risposta memorizzata per la richiesta e la chiave
+// della variante selezionata dagli header indicati in Vary.
+func (t *cacheRoundTripper) lookup(key string, req *http.Request) (*storedResponse, string) {
+	marker := t.marker(key)
+	if marker == nil {
+		return nil, ""
+	}
+
+	variant := variantKey(key, marker.VaryOn, req.Header)
+	data, err := t.cache.Get(variant)
+	if err != nil {
+		return nil, ""
+	}
+	stored, err := unmarshalStoredResponse(data)
+	if err != nil || stored.StatusCode == 0 {
+		return nil, ""
+	}
+	return stored, variant
+}
+
+// store salva la risposta nella variante corretta e aggiorna il marker con
+// gli header elencati in Vary e le chiavi delle varianti. Se Vary e' cambiato
+// le varianti precedenti non sarebbero piu' raggiungibili e vengono rimosse.
+func (t *cacheRoundTripper) store(key string, req *http.Request, s *storedResponse) {
+	varyOn := varyHeaders(s.Header)
+	variant := variantKey(key, varyOn, req.Header)
+	marker := &storedResponse{VaryOn: varyOn, Variants: []string{variant}}
+	if old := t.marker(key); old != nil {
+		for _, v := range old.Variants {
+			switch {
+			case v == variant:
+			case slices.Equal(old.VaryOn, varyOn):
+				marker.Variants = append(marker.Variants, v)
+			default:
+				_ = t.cache.Del(v)
+			}
+		}
+	}
+	t.save(key, marker)
+	t.save(variant, s)
+}
+
+func (t *cacheRoundTripper) save(key string, s *storedResponse) {
+	data, err := s.marshal()
+	if err == nil {
+		err = t.cache.Put(key, data)
+	}
+	if err != nil {
+		log.E("unable to put response in cache",
+			log.String("key", key),
+			log.Err("err", err),
+		)
+	}
+}
+
+// variantKey deriva la chiave della variante dai valori degli header di
+// richiesta selezionati da Vary.
+func variantKey(key string, varyOn []string, h http.Header) string {
+	parts := make([]string, 0, 2*len(varyOn))
+	for _, name := range varyOn {
+		values := make([]string, 0)
+		for _, v := range h.Values(name) {
+			for item := range strings.SplitSeq(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					values = append(values, item)
+				}
+			}
+		}
+		parts = append(parts, name, strings.Join(values, ","))
+	}
+	return key + "#" + digestParts(parts...)
+}
+
+// varyHeaders restituisce i nomi canonici degli header elencati in Vary,
+// ordinati per avere chiavi stabili.
+func varyHeaders(h http.Header) []string {
+	var out []string
+	for _, v := range h.Values("Vary") {
+		for name := range strings.SplitSeq(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && !slices.Contains(out, name) {
+				out = append(out, name)
+			}
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// isStorable applica le regole di RFC 9111, sezione 3.
+func (t *cacheRoundTripper) isStorable(req *http.Request, resp *http.Response, reqCC cacheControl) bool {
+	if reqCC.has("no-store") {
+		return false
+	}
+	// Le risposte parziali non sono combinate con le altre: non vengono
+	// memorizzate ne' le 206 ne' le risposte a richieste con Range.
+	if resp.StatusCode == http.StatusPartialContent || req.Header.Get("Range") != "" {
+		return false
+	}
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-store") {
+		return false
+	}
+	if slices.Contains(varyHeaders(resp.Header), "*") {
+		return false
+	}
+	if !t.private {
+		// Una cache condivisa non memorizza risposte private ne', salvo
+		// indicazione esplicita, risposte a richieste autenticate.
+		if cc.has("private") {
+			return false
+		}
+		if req.Header.Get("Authorization") != "" &&
+			!cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+			return false
+		}
+	}
+
+	explicit := cc.has("max-age") || cc.has("public") || resp.Header.Get("Expires") != "" ||
+		(!t.private && cc.has("s-maxage"))
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		// Per gli altri metodi (es. POST abilitate esplicitamente) serve una
+		// freshness dichiarata dal server.
+		return explicit
+	}
+	return explicit || slices.Contains(heuristicallyCacheable, resp.StatusCode)
+}
+
+// canServe indica se la risposta memorizzata puo' essere usata senza
+// contattare il server, tenendo conto delle direttive di richiesta.
+func (t *cacheRoundTripper) canServe(s *storedResponse, reqCC cacheControl, age time.Duration) bool {
+	cc := parseCacheControl(s.Header)
+	if cc.has("no-cache") || reqCC.has("no-cache") {
+		return false
+	}
+
+	lifetime := s.freshnessLifetime(t.private)
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok && lifetime-age < minFresh {
+		return false
+	}
+	if lifetime > age {
+		return true
+	}
+
+	// Risposta stale: ammessa solo se il client lo consente esplicitamente e
+	// il server non ha richiesto la rivalidazione obbligatoria.
+	if cc.has("must-revalidate") || (!t.private && cc.has("proxy-revalidate")) || !reqCC.has("max-stale") {
+		return false
+	}
+	maxStale, ok := reqCC.seconds("max-stale")
+	return !ok || age-lifetime <= maxStale
+}
+
+// freshnessLifetime calcola la durata di validita' (RFC 9111, sezione 4.2.1).
+func (s *storedResponse) freshnessLifetime(private bool) time.Duration {
+	cc := parseCacheControl(s.Header)
+	if !private {
+		if v, ok := cc.seconds("s-maxage"); ok {
+			return v
+		}
+	}
+	if v, ok := cc.seconds("max-age"); ok {
+		return v
+	}
+
+	date := s.date()
+	if raw := s.Header.Get("Expires"); raw != "" {
+		expires, err := http.ParseTime(raw)
+		if err != nil {
+			// Un Expires non valido equivale a una risposta gia' scaduta.
+			return 0
+		}
+		return expires.Sub(date)
+	}
+
+	// Freshness euristica: 10% del tempo trascorso da Last-Modified.
+	if slices.Contains(heuristicallyCacheable, s.StatusCode) {
+		if lm, err := http.ParseTime(s.Header.Get("Last-Modified")); err == nil && date.After(lm) {
+			return min(date.Sub(lm)/10, heuristicMaxLifetime)
+		}
+	}
+	return 0
+}
+
+// currentAge calcola l'eta' della risposta (RFC 9111, sezione 4.2.3).
+func (s *storedResponse) currentAge(now time.Time) time.Duration {
+	apparentAge := max(0, s.ResponseTime.Sub(s.date()))
+
+	var ageValue time.Duration
+	if v, err := strconv.ParseInt(strings.TrimSpace(s.Header.Get("Age")), 10, 64); err == nil && v > 0 {
+		ageValue = time.Duration(v) * time.Second
+	}
+	responseDelay := s.ResponseTime.Sub(s.RequestTime)
+	correctedAgeValue := ageValue + responseDelay
+
+	correctedInitialAge := max(apparentAge, correctedAgeValue)
+	residentTime := now.Sub(s.ResponseTime)
+	return correctedInitialAge + residentTime
+}
+
+// date restituisce l'header Date o, se assente o invalido, l'istante in cui
+// la risposta e' stata ricevuta.
+func (s *storedResponse) date() time.Time {
+	if d, err := http.ParseTime(s.Header.Get("Date")); err == nil {
+		return d
+	}
+	return s.ResponseTime
+}
+
+// refresh aggiorna la risposta memorizzata con gli header di una 304
+// (RFC 9111, sezione 4.3.4).
+func (s *storedResponse) refresh(h http.Header, reqTime, respTime time.Time) {
+	if s.Header == nil {
+		// Header e' omitempty: una risposta salvata senza header torna nil
+		s.Header = make(http.Header)
+	}
+	for name, values := range h {
+		if name == "Content-Length" {
+			continue
+		}
+		s.Header[name] = append([]string(nil), values...)
+	}
+	s.RequestTime = reqTime
+	s.ResponseTime = respTime
+}
+
+// response ricostruisce una [http.Response] dalla risposta memorizzata,
+// con status e header originali, Age aggiornato e Cache-Status.
+func (s *storedResponse) response(req *http.Request, age time.Duration, status string) *http.Response {
+	h := cloneHeader(s.Header)
+	h.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	h.Set(CacheStatusHeader, cacheStatusName+"; "+status)
+
+	return &http.Response{
+		StatusCode:    s.StatusCode,
+		Status:        s.Status,
+		Proto:         s.Proto,
+		ProtoMajor:    s.ProtoMajor,
+		ProtoMinor:    s.ProtoMinor,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(s.Body)),
+		ContentLength: int64(len(s.Body)),
+		Request:       req,
+	}
+}
+
+// conditionalRequest clona la richiesta aggiungendo i validator della
+// risposta memorizzata.
+func conditionalRequest(req *http.Request, s *storedResponse) *http.Request {
+	etag := s.Header.Get("ETag")
+	lastModified := s.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return req
+	}
+
+	out := cloneRequest(req)
+	if etag != "" {
+		out.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		out.Header.Set("If-Modified-Since", lastModified)
+	}
+	return out
+}
+
+func hasConditionalHeaders(h http.Header) bool {
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		if h.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// cacheControl contiene le direttive Cache-Control, con nomi in minuscolo e
+// valori senza virgolette.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, v := range h.Values("Cache-Control") {
+		for part := range strings.SplitSeq(v, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(part, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	if len(cc) == 0 {
+		// Pragma: no-cache vale solo in assenza di Cache-Control (RFC 9111, 5.4).
+		if strings.Contains(strings.ToLower(h.Get("Pragma")), "no-cache") {
+			cc["no-cache"] = ""
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds restituisce il valore della direttiva come durata; ok e' false se
+// la direttiva manca o non ha un valore numerico valido.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	raw, ok := cc[name]
+	if !ok || raw == "" {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || v < 0 {
+		return 0, false
+	}
+	return time.Duration(v) * time.Second, true
+}
@@ -0,0 +1,312 @@
+package transport_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	xfilecache "github.com/lucasepe/x/filecache"
+	"github.com/lucasepe/x/http/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// httpCacheUpstream restituisce un upstream che risponde con gli header
+// prodotti da headers e registra le richieste ricevute.
+func httpCacheUpstream(seen *[]*http.Request, status int, body string, headers func(*http.Request) http.Header) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		*seen = append(*seen, req)
+		h := headers(req)
+		if h.Get("Date") == "" {
+			h.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		}
+		return &http.Response{
+			StatusCode: status,
+			Status:     http.StatusText(status),
+			Header:     h,
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	})
+}
+
+func newHTTPCacheTransport(t *testing.T, us http.RoundTripper, private bool) http.RoundTripper {
+	t.Helper()
+	t.Setenv("SKIP_CACHE", "false")
+
+	cache, err := xfilecache.New(t.TempDir())
+	require.NoError(t, err)
+	return transport.FileCacheTransportWithOptions(cache, us, transport.FileCacheOptions{
+		HTTPSemantics: true,
+		PrivateCache:  private,
+	})
+}
+
+func doRequest(t *testing.T, rt http.RoundTripper, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+func TestHTTPCacheServesFreshResponses(t *testing.T) {
+	var seen []*http.Request
+	us := httpCacheUpstream(&seen, http.StatusOK, "fresh", func(*http.Request) http.Header {
+		return http.Header{
+			"Cache-Control": {"max-age=60"},
+			"Content-Type":  {"text/plain"},
+		}
+	})
+	rt := newHTTPCacheTransport(t, us, false)
+
+	resp, body := doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/a", nil))
+	assert.Equal(t, "fresh", body)
+	assert.Contains(t, resp.Header.Get(transport.CacheStatusHeader), "fwd=uri-miss")
+
+	resp, body = doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/a", nil))
+	assert.Equal(t, "fresh", body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "OK", resp.Status)
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "filecache; hit", resp.Header.Get(transport.CacheStatusHeader))
+	assert.NotEmpty(t, resp.Header.Get("Age"))
+	assert.Len(t, seen, 1)
+
+	// max-age=0 nella richiesta forza il ritorno al server
+	req := mustRequest(t, http.MethodGet, "https://example.com/a", nil)
+	req.Header.Set("Cache-Control", "max-age=0")
+	doRequest(t, rt, req)
+	assert.Len(t, seen, 2)
+}
+
+func TestHTTPCacheHonorsNoStore(t *testing.T) {
+	var seen []*http.Request
+	us := httpCacheUpstream(&seen, http.StatusOK, "secret", func(*http.Request) http.Header {
+		return http.Header{"Cache-Control": {"no-store, max-age=60"}}
+	})
+	rt := newHTTPCacheTransport(t, us, false)
+
+	doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/a", nil))
+	doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/a", nil))
+	assert.Len(t, seen, 2)
+}
+
+func TestHTTPCachePrivateResponses(t *testing.T) {
+	headers := func(*http.Request) http.Header {
+		return http.Header{"Cache-Control": {"private, max-age=60"}}
+	}
+
+	var shared []*http.Request
+	rt := newHTTPCacheTransport(t, httpCacheUpstream(&shared, http.StatusOK, "me", headers), false)
+	doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/me", nil))
+	doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/me", nil))
+	assert.Len(t, shared, 2)
+
+	var private []*http.Request
+	rt = newHTTPCacheTransport(t, httpCacheUpstream(&private, http.StatusOK, "me", headers), true)
+	doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/me", nil))
+	doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/me", nil))
+	assert.Len(t, private, 1)
+}
+
+func TestHTTPCacheRevalidatesStaleResponses(t *testing.T) {
+	var seen []*http.Request
+	calls := 0
+	us := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		seen = append(seen, req)
+		calls++
+		if calls == 1 {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Status:     "200 OK",
+				Header: http.Header{
+					"Cache-Control": {"no-cache"},
+					"Etag":          {`"v1"`},
+					"X-Version":     {"1"},
+				},
+				Body:    io.NopCloser(strings.NewReader("payload")),
+				Request: req,
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusNotModified,
+			Status:     "304 Not Modified",
+			Header:     http.Header{"X-Version": {"2"}},
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	})
+	rt := newHTTPCacheTransport(t, us, false)
+
+	doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/r", nil))
+	resp, body := doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/r", nil))
+
+	require.Len(t, seen, 2)
+	assert.Equal(t, `"v1"`, seen[1].Header.Get("If-None-Match"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "payload", body)
+	assert.Equal(t, "2", resp.Header.Get("X-Version"))
+	assert.Contains(t, resp.Header.Get(transport.CacheStatusHeader), "fwd-status=304")
+}
+
+func TestHTTPCacheKeysOnVary(t *testing.T) {
+	var seen []*http.Request
+	us := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		seen = append(seen, req)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Status:     "200 OK",
+			Header: http.Header{
+				"Cache-Control": {"max-age=60"},
+				"Vary":          {"Accept-Language"},
+			},
+			Body:    io.NopCloser(strings.NewReader("lang=" + req.Header.Get("Accept-Language"))),
+			Request: req,
+		}, nil
+	})
+	rt := newHTTPCacheTransport(t, us, false)
+
+	get := func(lang string) string {
+		req := mustRequest(t, http.MethodGet, "https://example.com/v", nil)
+		req.Header.Set("Accept-Language", lang)
+		_, body := doRequest(t, rt, req)
+		return body
+	}
+
+	assert.Equal(t, "lang=it", get("it"))
+	assert.Equal(t, "lang=en", get("en"))
+	assert.Equal(t, "lang=it", get("it"))
+	assert.Equal(t, "lang=en", get("en"))
+	assert.Len(t, seen, 2)
+}
+
+func TestHTTPCacheInvalidatesOnUnsafeMethods(t *testing.T) {
+	var seen []*http.Request
+	us := httpCacheUpstream(&seen, http.StatusOK, "doc", func(*http.Request) http.Header {
+		return http.Header{"Cache-Control": {"max-age=60"}}
+	})
+	rt := newHTTPCacheTransport(t, us, false)
+
+	doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/doc", nil))
+	doRequest(t, rt, mustRequest(t, http.MethodDelete, "https://example.com/doc", nil))
+	doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/doc", nil))
+	assert.Len(t, seen, 3)
+}
+
+func TestHTTPCacheOnlyIfCachedMiss(t *testing.T) {
+	var seen []*http.Request
+	us := httpCacheUpstream(&seen, http.StatusOK, "x", func(*http.Request) http.Header {
+		return http.Header{}
+	})
+	rt := newHTTPCacheTransport(t, us, false)
+
+	req := mustRequest(t, http.MethodGet, "https://example.com/x", nil)
+	req.Header.Set("Cache-Control", "only-if-cached")
+	resp, _ := doRequest(t, rt, req)
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Empty(t, seen)
+}
+
+func TestHTTPCacheDoesNotStorePartialResponses(t *testing.T) {
+	var seen []*http.Request
+	us := httpCacheUpstream(&seen, http.StatusPartialContent, "par", func(*http.Request) http.Header {
+		return http.Header{"Cache-Control": {"max-age=60"}, "Content-Range": {"bytes 0-2/10"}}
+	})
+	rt := newHTTPCacheTransport(t, us, false)
+
+	for range 2 {
+		doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/partial", nil))
+	}
+	assert.Len(t, seen, 2)
+
+	seen = nil
+	us = httpCacheUpstream(&seen, http.StatusOK, "full", func(*http.Request) http.Header {
+		return http.Header{"Cache-Control": {"max-age=60"}}
+	})
+	rt = newHTTPCacheTransport(t, us, false)
+
+	req := mustRequest(t, http.MethodGet, "https://example.com/range", nil)
+	req.Header.Set("Range", "bytes=0-2")
+	doRequest(t, rt, req)
+	doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/range", nil))
+	assert.Len(t, seen, 2)
+}
+
+func TestHTTPCacheInvalidatesAllVariants(t *testing.T) {
+	var seen []*http.Request
+	us := httpCacheUpstream(&seen, http.StatusOK, "doc", func(*http.Request) http.Header {
+		return http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}}
+	})
+	rt := newHTTPCacheTransport(t, us, false)
+
+	get := func(lang string) {
+		req := mustRequest(t, http.MethodGet, "https://example.com/doc", nil)
+		req.Header.Set("Accept-Language", lang)
+		doRequest(t, rt, req)
+	}
+	get("it")
+	get("en")
+	doRequest(t, rt, mustRequest(t, http.MethodPut, "https://example.com/doc", strings.NewReader("new")))
+	get("it")
+	get("en")
+	assert.Len(t, seen, 5)
+}
+
+func TestHTTPCacheInvalidatesOnCachedUnsafeMethods(t *testing.T) {
+	t.Setenv("SKIP_CACHE", "false")
+
+	var seen []*http.Request
+	us := httpCacheUpstream(&seen, http.StatusOK, "doc", func(*http.Request) http.Header {
+		return http.Header{"Cache-Control": {"max-age=60"}}
+	})
+	cache, err := xfilecache.New(t.TempDir())
+	require.NoError(t, err)
+	rt := transport.FileCacheTransportWithOptions(cache, us, transport.FileCacheOptions{
+		Methods:       []string{http.MethodGet, http.MethodPost},
+		KeyFunc:       transport.DigestCacheKeyMethodURLBody,
+		HTTPSemantics: true,
+	})
+
+	doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/doc", nil))
+	doRequest(t, rt, mustRequest(t, http.MethodPost, "https://example.com/doc", strings.NewReader("edit")))
+	doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/doc", nil))
+	assert.Len(t, seen, 3)
+}
+
+func TestHTTPCacheRevalidatesResponsesStoredWithoutHeaders(t *testing.T) {
+	calls := 0
+	us := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		if calls == 1 {
+			// un header vuoto viene salvato e riletto come nil
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Status:     "200 OK",
+				Header:     http.Header{},
+				Body:       io.NopCloser(strings.NewReader("bare")),
+				Request:    req,
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusNotModified,
+			Status:     "304 Not Modified",
+			Header:     http.Header{"X-Version": {"2"}},
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	})
+	rt := newHTTPCacheTransport(t, us, false)
+
+	doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/bare", nil))
+	resp, body := doRequest(t, rt, mustRequest(t, http.MethodGet, "https://example.com/bare", nil))
+
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "bare", body)
+	assert.Equal(t, "2", resp.Header.Get("X-Version"))
+}
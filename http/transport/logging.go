@@ -0,0 +1,197 @@
+package transport
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucasepe/x/log"
+)
+
+// LoggingOptions controlla il transport di logging strutturato.
+type LoggingOptions struct {
+	// Logger riceve le voci di log. Se nil ne viene creato uno su Output.
+	Logger *log.Logger
+	// Output e' la destinazione usata quando Logger e' nil; se nil usa
+	// os.Stderr.
+	Output io.Writer
+	// RequestIDHeader e' l'header letto per correlare le voci, lo stesso
+	// impostato da [RequestIDRoundTripper]. Se vuoto usa `X-Request-Id`.
+	RequestIDHeader string
+	// LogHeaders aggiunge gli header di richiesta e risposta alla voce.
+	LogHeaders bool
+	// RedactHeaders elenca gli header il cui valore viene mascherato. Se
+	// vuoto usa Authorization, Proxy-Authorization, Cookie e Set-Cookie.
+	RedactHeaders []string
+	// RedactQuery elenca i parametri di query da mascherare nella URL.
+	RedactQuery []string
+	// Timing aggiunge alla voce la scomposizione della durata (dns, connect,
+	// tls, server, ttfb, transfer, conn_reused), vedi [RequestTiming].
+	Timing bool
+}
+
+// LoggingRoundTripper scrive su stderr una voce di log strutturata per ogni
+// scambio HTTP. Vedi [LoggingRoundTripperWithOptions].
+func LoggingRoundTripper(next http.RoundTripper) http.RoundTripper {
+	return LoggingRoundTripperWithOptions(next, LoggingOptions{})
+}
+
+// LoggingRoundTripperWithOptions scrive una voce del package log per ogni
+// scambio con metodo, URL, status, durata, byte trasferiti, request id e
+// tentativo di retry (vedi [RetryAttempt]). La voce viene emessa quando il
+// body della risposta e' stato letto fino in fondo o chiuso, cosi' i byte
+// ricevuti sono quelli effettivi; gli errori del transport sono loggati
+// subito. Il livello dipende dall'esito: info per 1xx-3xx, warning per 4xx,
+// error per 5xx ed errori.
+func LoggingRoundTripperWithOptions(next http.RoundTripper, opts LoggingOptions) http.RoundTripper {
+	if next == nil {
+		next = Default()
+	}
+	if strings.TrimSpace(opts.RequestIDHeader) == "" {
+		opts.RequestIDHeader = "X-Request-Id"
+	}
+	if len(opts.RedactHeaders) == 0 {
+		opts.RedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+	}
+	redact := make([]string, len(opts.RedactHeaders))
+	for i, name := range opts.RedactHeaders {
+		redact[i] = http.CanonicalHeaderKey(name)
+	}
+	opts.RedactHeaders = redact
+
+	logger := opts.Logger
+	if logger == nil {
+		out := opts.Output
+		if out == nil {
+			out = os.Stderr
+		}
+		logger = log.New(out)
+	}
+
+	return &loggingTransport{
+		next:   next,
+		opts:   opts,
+		logger: logger,
+	}
+}
+
+type loggingTransport struct {
+	next   http.RoundTripper
+	opts   LoggingOptions
+	logger *log.Logger
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	fields := []log.Field{
+		log.String("method", req.Method),
+		log.String("url", redactURL(req.URL, t.opts.RedactQuery)),
+	}
+	if id := req.Header.Get(t.opts.RequestIDHeader); id != "" {
+		fields = append(fields, log.String("request_id", id))
+	}
+	if attempt := RetryAttempt(req.Context()); attempt > 0 {
+		fields = append(fields, log.Int("attempt", attempt))
+	}
+	if req.ContentLength > 0 {
+		fields = append(fields, log.Int("bytes_out", int(req.ContentLength)))
+	}
+	if t.opts.LogHeaders {
+		fields = append(fields, log.Map("request_headers", t.headerMap(req.Header)))
+	}
+
+	var rec *timingRecorder
+	if t.opts.Timing {
+		req, rec = traceRequest(req)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		fields = append(fields, log.String("duration", time.Since(start).String()))
+		if rec != nil {
+			fields = append(fields, rec.timing().logFields()...)
+		}
+		fields = append(fields, log.Err("err", err))
+		t.logger.E("http request failed", fields...)
+		return nil, err
+	}
+
+	fields = append(fields, log.Int("status", resp.StatusCode))
+	if t.opts.LogHeaders {
+		fields = append(fields, log.Map("response_headers", t.headerMap(resp.Header)))
+	}
+
+	body := &loggingBody{rc: resp.Body}
+	body.done = func(readErr error) {
+		all := append(fields,
+			log.String("duration", time.Since(start).String()),
+			log.Int("bytes_in", int(body.n)),
+		)
+		if rec != nil {
+			all = append(all, rec.timing().logFields()...)
+		}
+		if readErr != nil {
+			all = append(all, log.Err("err", readErr))
+		}
+		switch {
+		case readErr != nil || resp.StatusCode >= 500:
+			t.logger.E("http request", all...)
+		case resp.StatusCode >= 400:
+			t.logger.W("http request", all...)
+		default:
+			t.logger.I("http request", all...)
+		}
+	}
+	if resp.Body == nil || resp.Body == http.NoBody {
+		body.finish(nil)
+		return resp, nil
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+func (t *loggingTransport) headerMap(h http.Header) map[string]any {
+	out := make(map[string]any, len(h))
+	for name, values := range h {
+		if slices.Contains(t.opts.RedactHeaders, name) {
+			out[name] = redactedValue
+			continue
+		}
+		out[name] = strings.Join(values, ", ")
+	}
+	return out
+}
+
+// loggingBody conta i byte letti e invoca done una sola volta, al primo tra
+// EOF, errore di lettura e Close.
+type loggingBody struct {
+	rc   io.ReadCloser
+	n    int64
+	once sync.Once
+	done func(err error)
+}
+
+func (b *loggingBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	b.n += int64(n)
+	switch {
+	case err == io.EOF:
+		b.finish(nil)
+	case err != nil:
+		b.finish(err)
+	}
+	return n, err
+}
+
+func (b *loggingBody) Close() error {
+	b.finish(nil)
+	return b.rc.Close()
+}
+
+func (b *loggingBody) finish(err error) {
+	b.once.Do(func() { b.done(err) })
+}
@@ -0,0 +1,104 @@
+package transport_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lucasepe/x/http/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggingRoundTripperWritesStructuredEntry(t *testing.T) {
+	var out bytes.Buffer
+
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Status:     "200 OK",
+			Header:     http.Header{"Set-Cookie": {"session=abc"}},
+			Body:       io.NopCloser(strings.NewReader("hello")),
+			Request:    req,
+		}, nil
+	})
+
+	rt := transport.RequestIDRoundTripperWithOptions(
+		transport.LoggingRoundTripperWithOptions(upstream, transport.LoggingOptions{
+			Output:      &out,
+			LogHeaders:  true,
+			RedactQuery: []string{"token"},
+		}),
+		transport.RequestIDOptions{Generator: func() string { return "req-42" }},
+	)
+
+	req := mustRequest(t, http.MethodPost, "https://example.com/items?token=s3cr3t", strings.NewReader("{}"))
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Empty(t, out.String(), "entry is written once the body is consumed")
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, "hello", string(body))
+
+	line := out.String()
+	assert.Equal(t, 1, strings.Count(line, "[I] http request"))
+	assert.Contains(t, line, "method=POST")
+	assert.Contains(t, line, "url=https://example.com/items?token=REDACTED")
+	assert.Contains(t, line, "status=200")
+	assert.Contains(t, line, "request_id=req-42")
+	assert.Contains(t, line, "bytes_out=2")
+	assert.Contains(t, line, "bytes_in=5")
+	assert.Contains(t, line, "duration=")
+	assert.NotContains(t, line, "s3cr3t")
+	assert.NotContains(t, line, "session=abc")
+}
+
+func TestLoggingRoundTripperLogsRetryAttemptsAndErrors(t *testing.T) {
+	var out bytes.Buffer
+
+	var calls int32
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return nil, errors.New("connection reset")
+		}
+		return &http.Response{
+			StatusCode: http.StatusNotFound,
+			Status:     "404 Not Found",
+			Header:     make(http.Header),
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	})
+
+	rt := transport.RetryRoundTripper(
+		transport.LoggingRoundTripperWithOptions(upstream, transport.LoggingOptions{Output: &out}),
+		transport.RetryOptions{
+			MaxAttempts:  2,
+			RetryOnError: true,
+			BaseDelay:    time.Millisecond,
+		},
+	)
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/missing", nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// Ogni voce e' composta dalla riga del messaggio e da quella dei campi.
+	entries := strings.Split(strings.TrimSpace(out.String()), "\n[")
+	require.Len(t, entries, 2)
+	assert.Contains(t, entries[0], "[E] http request failed")
+	assert.Contains(t, entries[0], "attempt=1")
+	assert.Contains(t, entries[0], "err=connection reset")
+	assert.Contains(t, entries[1], "W] http request")
+	assert.Contains(t, entries[1], "attempt=2")
+	assert.Contains(t, entries[1], "status=404")
+}
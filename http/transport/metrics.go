@@ -0,0 +1,362 @@
+package transport
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMetricsBuckets sono gli estremi (in secondi) dell'istogramma delle
+// latenze, gli stessi del client Prometheus.
+var defaultMetricsBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// MetricsOptions configura [NewMetrics].
+type MetricsOptions struct {
+	// Namespace e' il prefisso delle metriche. Se vuoto usa "http_client".
+	Namespace string
+	// Buckets sono gli estremi superiori (in secondi) dell'istogramma delle
+	// latenze. Se vuoto usa quelli di default del client Prometheus.
+	Buckets []float64
+}
+
+// Metrics raccoglie le metriche di uno o piu' [MetricsRoundTripper] e le
+// espone nel formato testuale di Prometheus tramite [Metrics.Handler],
+// senza dipendenze esterne.
+//
+// Le serie sono etichettate per host, metodo e classe di status ("2xx",
+// "4xx", ..., "error" per gli errori del transport):
+//
+//   - <ns>_requests_total e <ns>_request_duration_seconds (istogramma);
+//   - <ns>_requests_in_flight per host;
+//   - <ns>_request_bytes_total e <ns>_response_bytes_total;
+//   - <ns>_retries_total, per le richieste con [RetryAttempt] > 1;
+//   - <ns>_cache_hits_total, per le risposte servite dal file cache.
+type Metrics struct {
+	namespace string
+	buckets   []float64
+
+	mu        sync.Mutex
+	series    map[metricsKey]*metricsSeries
+	inFlight  map[string]int64
+	bytesOut  map[metricsKey]int64 // senza status
+	retries   map[metricsKey]uint64
+	cacheHits map[metricsKey]uint64
+}
+
+type metricsKey struct {
+	host, method, status string
+}
+
+type metricsSeries struct {
+	count    uint64
+	sum      float64
+	buckets  []uint64 // non cumulativi, uno per estremo
+	bytesIn  int64
+	hasBytes bool
+}
+
+// NewMetrics crea un registro di metriche vuoto.
+func NewMetrics(opts MetricsOptions) *Metrics {
+	if opts.Namespace == "" {
+		opts.Namespace = "http_client"
+	}
+	buckets := slices.Clone(opts.Buckets)
+	if len(buckets) == 0 {
+		buckets = slices.Clone(defaultMetricsBuckets)
+	}
+	slices.Sort(buckets)
+
+	return &Metrics{
+		namespace: opts.Namespace,
+		buckets:   buckets,
+		series:    make(map[metricsKey]*metricsSeries),
+		inFlight:  make(map[string]int64),
+		bytesOut:  make(map[metricsKey]int64),
+		retries:   make(map[metricsKey]uint64),
+		cacheHits: make(map[metricsKey]uint64),
+	}
+}
+
+// MetricsRoundTripper registra in m le metriche delle richieste che lo
+// attraversano. Registrato dopo [RetryRoundTripper] conta ogni tentativo e
+// i retry; registrato prima del file cache ne vede gli hit.
+func MetricsRoundTripper(next http.RoundTripper, m *Metrics) http.RoundTripper {
+	if next == nil {
+		next = Default()
+	}
+	if m == nil {
+		m = NewMetrics(MetricsOptions{})
+	}
+
+	return &metricsTransport{
+		next:    next,
+		metrics: m,
+	}
+}
+
+type metricsTransport struct {
+	next    http.RoundTripper
+	metrics *Metrics
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m := t.metrics
+	host, method := req.URL.Host, req.Method
+
+	m.requestStarted(req)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	elapsed := time.Since(start)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode/100) + "xx"
+	}
+	key := metricsKey{host: host, method: method, status: status}
+	m.requestDone(key, elapsed, resp)
+
+	if err != nil {
+		return nil, err
+	}
+	if resp.Body != nil && resp.Body != http.NoBody {
+		body := &loggingBody{rc: resp.Body}
+		body.done = func(error) { m.addBytesIn(key, body.n) }
+		resp.Body = body
+	}
+	return resp, nil
+}
+
+func (m *Metrics) requestStarted(req *http.Request) {
+	key := metricsKey{host: req.URL.Host, method: req.Method}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight[key.host]++
+	if req.ContentLength > 0 {
+		m.bytesOut[key] += req.ContentLength
+	}
+	if RetryAttempt(req.Context()) > 1 {
+		m.retries[key]++
+	}
+}
+
+func (m *Metrics) requestDone(key metricsKey, elapsed time.Duration, resp *http.Response) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.inFlight[key.host]--; m.inFlight[key.host] <= 0 {
+		m.inFlight[key.host] = 0
+	}
+
+	s := m.seriesLocked(key)
+	s.count++
+	s.sum += elapsed.Seconds()
+	for i, le := range m.buckets {
+		if elapsed.Seconds() <= le {
+			s.buckets[i]++
+			break
+		}
+	}
+
+	if resp != nil && isCacheHit(resp) {
+		m.cacheHits[metricsKey{host: key.host, method: key.method}]++
+	}
+}
+
+func (m *Metrics) addBytesIn(key metricsKey, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.seriesLocked(key)
+	s.bytesIn += n
+	s.hasBytes = true
+}
+
+func (m *Metrics) seriesLocked(key metricsKey) *metricsSeries {
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricsSeries{buckets: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+// isCacheHit riconosce le risposte servite dal file cache: in modalita'
+// RFC 9111 tramite Cache-Status, altrimenti dallo status "(from cache)".
+func isCacheHit(resp *http.Response) bool {
+	if cs := resp.Header.Get(CacheStatusHeader); cs != "" {
+		for param := range strings.SplitSeq(cs, ";") {
+			if strings.TrimSpace(param) == "hit" {
+				return true
+			}
+		}
+		return false
+	}
+	return strings.Contains(resp.Status, "from cache")
+}
+
+// Handler espone le metriche nel formato testuale di Prometheus.
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.WriteTo(w)
+	})
+}
+
+// WriteTo scrive le metriche nel formato testuale di Prometheus, con le
+// serie in ordine stabile.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	snap := m.snapshot()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	ns := m.namespace
+
+	keys := sortedMetricsKeys(snap.series)
+
+	writeMetricsHeader(bw, ns+"_requests_total", "counter", "Total number of HTTP requests.")
+	for _, k := range keys {
+		fmt.Fprintf(bw, "%s_requests_total%s %d\n", ns, k.labels(), snap.series[k].count)
+	}
+
+	writeMetricsHeader(bw, ns+"_request_duration_seconds", "histogram", "Time until response headers are received.")
+	for _, k := range keys {
+		s := snap.series[k]
+		var cumulative uint64
+		for i, le := range m.buckets {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(bw, "%s_request_duration_seconds_bucket%s %d\n", ns,
+				k.labels("le", strconv.FormatFloat(le, 'g', -1, 64)), cumulative)
+		}
+		fmt.Fprintf(bw, "%s_request_duration_seconds_bucket%s %d\n", ns, k.labels("le", "+Inf"), s.count)
+		fmt.Fprintf(bw, "%s_request_duration_seconds_sum%s %s\n", ns, k.labels(), strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(bw, "%s_request_duration_seconds_count%s %d\n", ns, k.labels(), s.count)
+	}
+
+	writeMetricsHeader(bw, ns+"_requests_in_flight", "gauge", "Requests waiting for response headers.")
+	for _, host := range sortedMetricsHosts(snap.inFlight) {
+		fmt.Fprintf(bw, "%s_requests_in_flight%s %d\n", ns, metricsKey{host: host}.labels(), snap.inFlight[host])
+	}
+
+	writeMetricsHeader(bw, ns+"_request_bytes_total", "counter", "Request body bytes sent.")
+	for _, k := range sortedMetricsKeys(snap.bytesOut) {
+		fmt.Fprintf(bw, "%s_request_bytes_total%s %d\n", ns, k.labels(), snap.bytesOut[k])
+	}
+
+	writeMetricsHeader(bw, ns+"_response_bytes_total", "counter", "Response body bytes read.")
+	for _, k := range keys {
+		if s := snap.series[k]; s.hasBytes {
+			fmt.Fprintf(bw, "%s_response_bytes_total%s %d\n", ns, k.labels(), s.bytesIn)
+		}
+	}
+
+	writeMetricsHeader(bw, ns+"_retries_total", "counter", "Retry attempts.")
+	for _, k := range sortedMetricsKeys(snap.retries) {
+		fmt.Fprintf(bw, "%s_retries_total%s %d\n", ns, k.labels(), snap.retries[k])
+	}
+
+	writeMetricsHeader(bw, ns+"_cache_hits_total", "counter", "Responses served from cache.")
+	for _, k := range sortedMetricsKeys(snap.cacheHits) {
+		fmt.Fprintf(bw, "%s_cache_hits_total%s %d\n", ns, k.labels(), snap.cacheHits[k])
+	}
+
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// metricsSnapshot e' una copia dei contatori, formattata senza tenere il lock.
+type metricsSnapshot struct {
+	series    map[metricsKey]metricsSeries
+	inFlight  map[string]int64
+	bytesOut  map[metricsKey]int64
+	retries   map[metricsKey]uint64
+	cacheHits map[metricsKey]uint64
+}
+
+// snapshot copia i contatori sotto il lock, cosi' le richieste in corso non
+// attendono la formattazione e la scrittura su un writer eventualmente lento.
+func (m *Metrics) snapshot() metricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snap := metricsSnapshot{
+		series:    make(map[metricsKey]metricsSeries, len(m.series)),
+		inFlight:  maps.Clone(m.inFlight),
+		bytesOut:  maps.Clone(m.bytesOut),
+		retries:   maps.Clone(m.retries),
+		cacheHits: maps.Clone(m.cacheHits),
+	}
+	for k, s := range m.series {
+		c := *s
+		c.buckets = slices.Clone(s.buckets)
+		snap.series[k] = c
+	}
+	return snap
+}
+
+func writeMetricsHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labels formatta le etichette valorizzate della chiave, piu' le eventuali
+// coppie nome/valore aggiuntive.
+func (k metricsKey) labels(extra ...string) string {
+	pairs := []string{"host", k.host, "method", k.method, "status", k.status}
+	pairs = append(pairs, extra...)
+
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			continue
+		}
+		parts = append(parts, pairs[i]+`="`+escapeMetricsLabel(pairs[i+1])+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeMetricsLabel(s string) string {
+	return metricsLabelEscaper.Replace(s)
+}
+
+func sortedMetricsKeys[V any](m map[metricsKey]V) []metricsKey {
+	keys := make([]metricsKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b metricsKey) int {
+		return strings.Compare(a.host+"\x00"+a.method+"\x00"+a.status, b.host+"\x00"+b.method+"\x00"+b.status)
+	})
+	return keys
+}
+
+func sortedMetricsHosts(m map[string]int64) []string {
+	hosts := make([]string, 0, len(m))
+	for host := range m {
+		hosts = append(hosts, host)
+	}
+	slices.Sort(hosts)
+	return hosts
+}
+
+// countingWriter conta i byte scritti.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,184 @@
+package transport_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasepe/x/http/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func scrapeMetrics(t *testing.T, m *transport.Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/plain; version=0.0.4")
+	return rec.Body.String()
+}
+
+func TestMetricsRoundTripperRecordsRequests(t *testing.T) {
+	statuses := []int{http.StatusOK, http.StatusNotFound, http.StatusOK}
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		status := statuses[0]
+		statuses = statuses[1:]
+		return &http.Response{StatusCode: status, Header: make(http.Header), Body: io.NopCloser(strings.NewReader("hello")), Request: req}, nil
+	})
+
+	m := transport.NewMetrics(transport.MetricsOptions{Namespace: "test", Buckets: []float64{0.5, 0.1}})
+	rt := transport.MetricsRoundTripper(upstream, m)
+
+	for _, path := range []string{"/a", "/missing", "/b"} {
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://api.example.com"+path, nil))
+		require.NoError(t, err)
+		readBody(t, resp)
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://api.example.com/items", strings.NewReader("payload"))
+	require.NoError(t, err)
+	statuses = []int{http.StatusCreated}
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	out := scrapeMetrics(t, m)
+	for _, line := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{host="api.example.com",method="GET",status="2xx"} 2`,
+		`test_requests_total{host="api.example.com",method="GET",status="4xx"} 1`,
+		`test_requests_total{host="api.example.com",method="POST",status="2xx"} 1`,
+		"# TYPE test_request_duration_seconds histogram",
+		`test_request_duration_seconds_bucket{host="api.example.com",method="GET",status="2xx",le="0.1"} 2`,
+		`test_request_duration_seconds_bucket{host="api.example.com",method="GET",status="2xx",le="0.5"} 2`,
+		`test_request_duration_seconds_bucket{host="api.example.com",method="GET",status="2xx",le="+Inf"} 2`,
+		`test_request_duration_seconds_count{host="api.example.com",method="GET",status="2xx"} 2`,
+		`test_requests_in_flight{host="api.example.com"} 0`,
+		`test_request_bytes_total{host="api.example.com",method="POST"} 7`,
+		`test_response_bytes_total{host="api.example.com",method="GET",status="2xx"} 10`,
+		`test_response_bytes_total{host="api.example.com",method="GET",status="4xx"} 5`,
+	} {
+		assert.Contains(t, out, line+"\n")
+	}
+	// Il body della POST non e' stato letto ma solo chiuso.
+	assert.Contains(t, out, `test_response_bytes_total{host="api.example.com",method="POST",status="2xx"} 0`)
+}
+
+func TestMetricsRoundTripperCountsErrorsAndInFlight(t *testing.T) {
+	m := transport.NewMetrics(transport.MetricsOptions{})
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := transport.MetricsRoundTripper(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		close(started)
+		<-release
+		return nil, io.ErrUnexpectedEOF
+	}), m)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := slow.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+		assert.Error(t, err)
+	}()
+
+	<-started
+	assert.Contains(t, scrapeMetrics(t, m), `http_client_requests_in_flight{host="example.com"} 1`)
+	close(release)
+	<-done
+
+	out := scrapeMetrics(t, m)
+	assert.Contains(t, out, `http_client_requests_in_flight{host="example.com"} 0`)
+	assert.Contains(t, out, `http_client_requests_total{host="example.com",method="GET",status="error"} 1`)
+}
+
+func TestMetricsRoundTripperCountsRetriesAndCacheHits(t *testing.T) {
+	m := transport.NewMetrics(transport.MetricsOptions{})
+
+	attempts := 0
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		attempts++
+		status := http.StatusOK
+		if attempts == 1 {
+			status = http.StatusServiceUnavailable
+		}
+		return &http.Response{StatusCode: status, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+	})
+	rt := transport.RetryRoundTripper(transport.MetricsRoundTripper(upstream, m), transport.RetryOptions{
+		MaxAttempts: 2,
+		StatusCodes: []int{http.StatusServiceUnavailable},
+		BaseDelay:   time.Millisecond,
+	})
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	cached := transport.MetricsRoundTripper(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		header := make(http.Header)
+		if req.URL.Path == "/rfc" {
+			header.Set(transport.CacheStatusHeader, "filecache; hit")
+		}
+		return &http.Response{Status: "200 OK (from cache)", StatusCode: http.StatusOK, Header: header, Body: http.NoBody, Request: req}, nil
+	}), m)
+	for _, path := range []string{"/legacy", "/rfc"} {
+		resp, err := cached.RoundTrip(mustRequest(t, http.MethodGet, "https://cache.example.com"+path, nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	out := scrapeMetrics(t, m)
+	assert.Contains(t, out, `http_client_retries_total{host="example.com",method="GET"} 1`)
+	assert.Contains(t, out, `http_client_requests_total{host="example.com",method="GET",status="5xx"} 1`)
+	assert.Contains(t, out, `http_client_cache_hits_total{host="cache.example.com",method="GET"} 2`)
+}
+
+// blockingWriter blocca la prima Write finche' release non viene chiuso.
+type blockingWriter struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case <-w.entered:
+	default:
+		close(w.entered)
+		<-w.release
+	}
+	return len(p), nil
+}
+
+func TestMetricsWriteToDoesNotBlockRequests(t *testing.T) {
+	m := transport.NewMetrics(transport.MetricsOptions{})
+	rt := transport.MetricsRoundTripper(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+	}), m)
+
+	w := &blockingWriter{entered: make(chan struct{}), release: make(chan struct{})}
+	written := make(chan error, 1)
+	go func() {
+		_, err := m.WriteTo(w)
+		written <- err
+	}()
+	<-w.entered
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://api.example.com/", nil))
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("request blocked by a slow metrics writer")
+	}
+
+	close(w.release)
+	assert.NoError(t, <-written)
+}
@@ -0,0 +1,501 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// ErrMockUnmatched e' l'errore sentinella restituito (tramite
+// [*MockUnmatchedError]) quando nessuna route del [MockTransport]
+// corrisponde alla richiesta.
+var ErrMockUnmatched = errors.New("no mock route matches the request")
+
+// MockUnmatchedError riporta la richiesta senza route corrispondente.
+// Soddisfa errors.Is(err, ErrMockUnmatched).
+type MockUnmatchedError struct {
+	Method string
+	URL    string
+}
+
+func (e *MockUnmatchedError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Method, e.URL, ErrMockUnmatched)
+}
+
+func (e *MockUnmatchedError) Unwrap() error {
+	return ErrMockUnmatched
+}
+
+// MockRequest e' il dato passato ai template delle risposte.
+type MockRequest struct {
+	Method string
+	URL    *url.URL
+	// Params contiene i segmenti catturati dai placeholder {name} del
+	// pattern della route.
+	Params map[string]string
+	Query  url.Values
+	Header http.Header
+	Body   string
+	// Call e' il numero della chiamata sulla route, a partire da 1.
+	Call int
+}
+
+// MockResponse descrive una risposta stub.
+type MockResponse struct {
+	// Status e' lo status code. Se 0 usa 200.
+	Status int
+	Header http.Header
+	Body   string
+	// Template, se true, interpreta Body come text/template eseguito con la
+	// [MockRequest], ad esempio `{"id": "{{.Params.id}}"}`.
+	Template bool
+	// Delay ritarda la risposta, rispettando il context della richiesta.
+	Delay time.Duration
+	// Err, se valorizzato, viene restituito al posto della risposta.
+	Err error
+}
+
+// MockTB e' il sottoinsieme di testing.TB usato da
+// [MockTransport.AssertExpectations].
+type MockTB interface {
+	Helper()
+	Errorf(format string, args ...any)
+}
+
+// MockTransport e' un test double di [http.RoundTripper]: risponde alle
+// richieste con le route registrate tramite [MockTransport.On], senza
+// contattare la rete. Le route sono valutate nell'ordine di registrazione e
+// le richieste senza route falliscono con [*MockUnmatchedError].
+//
+// Alla fine del test [MockTransport.AssertExpectations] verifica che ogni
+// route sia stata chiamata quanto previsto e che non ci siano state
+// richieste inattese:
+//
+//	mock := transport.NewMockTransport()
+//	mock.On(http.MethodGet, "/users/{id}").
+//		RespondTemplate(http.StatusOK, `{"id": "{{.Params.id}}"}`)
+//	mock.On(http.MethodPost, "/users").
+//		WithJSONBody(map[string]any{"name": "ada"}).
+//		RespondString(http.StatusCreated, "").
+//		Times(1)
+//
+//	client := &http.Client{Transport: mock}
+//	// ...
+//	mock.AssertExpectations(t)
+type MockTransport struct {
+	mu         sync.Mutex
+	routes     []*MockRoute
+	unexpected []string
+}
+
+// NewMockTransport crea un mock senza route.
+func NewMockTransport() *MockTransport {
+	return &MockTransport{}
+}
+
+// On registra una route per method (vuoto per qualunque metodo) e per il
+// pattern del path. Il pattern e' diviso in segmenti: {name} cattura un
+// segmento, {name...} come ultimo segmento cattura il resto del path, gli
+// altri segmenti seguono path.Match (es. "*.json"). Un pattern vuoto
+// corrisponde a qualunque path.
+func (m *MockTransport) On(method, pattern string) *MockRoute {
+	r := &MockRoute{
+		mock:    m,
+		method:  strings.ToUpper(strings.TrimSpace(method)),
+		pattern: pattern,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.routes = append(m.routes, r)
+	return r
+}
+
+// RoundTrip risponde con la prima route che corrisponde alla richiesta e non
+// ha esaurito le chiamate previste.
+func (m *MockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	params, call, resp, ok := m.claim(req, body)
+	if !ok {
+		return nil, &MockUnmatchedError{Method: req.Method, URL: req.URL.String()}
+	}
+
+	if err := waitForRetry(req.Context(), resp.Delay, 0); err != nil {
+		return nil, err
+	}
+	if resp.Err != nil {
+		return nil, resp.Err
+	}
+
+	data := MockRequest{
+		Method: req.Method,
+		URL:    req.URL,
+		Params: params,
+		Query:  req.URL.Query(),
+		Header: req.Header,
+		Body:   string(body),
+		Call:   call,
+	}
+	return resp.build(req, data)
+}
+
+// claim sceglie la route per la richiesta e ne registra la chiamata. I
+// matcher sono valutati senza m.mu, cosi' possono usare i metodi del mock
+// (es. [MockRoute.Calls]); se nel frattempo un'altra richiesta ha esaurito
+// le chiamate della route scelta, la ricerca riparte.
+func (m *MockTransport) claim(req *http.Request, body []byte) (map[string]string, int, MockResponse, bool) {
+	for {
+		m.mu.Lock()
+		candidates := m.candidates(req)
+		m.mu.Unlock()
+
+		route, params := firstMatching(candidates, req, body)
+
+		m.mu.Lock()
+		if route == nil {
+			m.unexpected = append(m.unexpected, req.Method+" "+req.URL.String())
+			m.mu.Unlock()
+			return nil, 0, MockResponse{}, false
+		}
+		if route.exhausted() {
+			m.mu.Unlock()
+			continue
+		}
+		route.calls++
+		call := route.calls
+		resp := route.responseFor(call)
+		m.mu.Unlock()
+		return params, call, resp, true
+	}
+}
+
+// mockCandidate e' una route il cui metodo e path corrispondono alla
+// richiesta, con la copia dei matcher ancora da valutare.
+type mockCandidate struct {
+	route    *MockRoute
+	params   map[string]string
+	matchers []func(req *http.Request, body []byte) bool
+}
+
+// candidates restituisce, in ordine, le route disponibili per metodo e
+// path della richiesta; va chiamato con m.mu.
+func (m *MockTransport) candidates(req *http.Request) []mockCandidate {
+	var out []mockCandidate
+	for _, r := range m.routes {
+		if r.exhausted() {
+			continue
+		}
+		if r.method != "" && r.method != req.Method {
+			continue
+		}
+		params, ok := matchMockPath(r.pattern, req.URL.Path)
+		if !ok {
+			continue
+		}
+		out = append(out, mockCandidate{
+			route:    r,
+			params:   params,
+			matchers: slices.Clone(r.matchers),
+		})
+	}
+	return out
+}
+
+// firstMatching restituisce la prima candidata i cui matcher accettano la
+// richiesta.
+func firstMatching(candidates []mockCandidate, req *http.Request, body []byte) (*MockRoute, map[string]string) {
+	for _, c := range candidates {
+		if matchAll(c.matchers, req, body) {
+			return c.route, c.params
+		}
+	}
+	return nil, nil
+}
+
+// ExpectationsError restituisce un errore che elenca le route chiamate meno
+// (o piu') del previsto e le richieste inattese, oppure nil.
+func (m *MockTransport) ExpectationsError() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var errs []error
+	for _, r := range m.routes {
+		switch {
+		case r.times > 0 && r.calls != r.times:
+			errs = append(errs, fmt.Errorf("%s: expected %d calls, got %d", r, r.times, r.calls))
+		case r.times == 0 && !r.optional && r.calls == 0:
+			errs = append(errs, fmt.Errorf("%s: never called", r))
+		}
+	}
+	for _, u := range m.unexpected {
+		errs = append(errs, fmt.Errorf("unexpected request %s", u))
+	}
+	return errors.Join(errs...)
+}
+
+// AssertExpectations segnala su t le aspettative non rispettate (vedi
+// [MockTransport.ExpectationsError]) e restituisce true se non ce ne sono.
+func (m *MockTransport) AssertExpectations(t MockTB) bool {
+	t.Helper()
+	if err := m.ExpectationsError(); err != nil {
+		t.Errorf("mock transport expectations not met:\n%v", err)
+		return false
+	}
+	return true
+}
+
+// MockRoute e' una route di [MockTransport]. I metodi restituiscono la route
+// stessa per poterli concatenare; vanno chiamati prima di usare il mock.
+//
+// Per default la route deve essere chiamata almeno una volta e risponde 200
+// con body vuoto. Con piu' risposte registrate ogni chiamata usa la
+// successiva; esaurite, si ripete l'ultima.
+type MockRoute struct {
+	mock     *MockTransport
+	method   string
+	pattern  string
+	matchers []func(req *http.Request, body []byte) bool
+
+	responses []MockResponse
+	times     int
+	optional  bool
+	calls     int
+}
+
+func (r *MockRoute) String() string {
+	method := r.method
+	if method == "" {
+		method = "*"
+	}
+	return method + " " + r.pattern
+}
+
+// WithHeader richiede che l'header name abbia il valore value.
+func (r *MockRoute) WithHeader(name, value string) *MockRoute {
+	return r.Match(func(req *http.Request, _ []byte) bool {
+		return req.Header.Get(name) == value
+	})
+}
+
+// WithQuery richiede che il parametro di query name abbia il valore value.
+func (r *MockRoute) WithQuery(name, value string) *MockRoute {
+	return r.Match(func(req *http.Request, _ []byte) bool {
+		return req.URL.Query().Get(name) == value
+	})
+}
+
+// WithBody richiede che il body della richiesta sia esattamente body.
+func (r *MockRoute) WithBody(body string) *MockRoute {
+	return r.Match(func(_ *http.Request, b []byte) bool {
+		return string(b) == body
+	})
+}
+
+// WithJSONBody richiede che il body della richiesta sia un JSON equivalente
+// a v, indipendentemente da spazi e ordine delle chiavi.
+func (r *MockRoute) WithJSONBody(v any) *MockRoute {
+	want, err := normalizeJSON(v)
+	return r.Match(func(_ *http.Request, b []byte) bool {
+		if err != nil {
+			return false
+		}
+		var got any
+		if json.Unmarshal(b, &got) != nil {
+			return false
+		}
+		return reflect.DeepEqual(want, got)
+	})
+}
+
+// Match aggiunge un matcher personalizzato; body e' il body della richiesta
+// gia' letto. Il matcher e' chiamato senza lock e puo' quindi usare i metodi
+// del mock, ad esempio [MockRoute.Calls].
+func (r *MockRoute) Match(fn func(req *http.Request, body []byte) bool) *MockRoute {
+	r.mock.mu.Lock()
+	defer r.mock.mu.Unlock()
+	r.matchers = append(r.matchers, fn)
+	return r
+}
+
+// Respond aggiunge una o piu' risposte alla sequenza della route.
+func (r *MockRoute) Respond(responses ...MockResponse) *MockRoute {
+	r.mock.mu.Lock()
+	defer r.mock.mu.Unlock()
+	r.responses = append(r.responses, responses...)
+	return r
+}
+
+// RespondString aggiunge una risposta testuale alla sequenza.
+func (r *MockRoute) RespondString(status int, body string) *MockRoute {
+	return r.Respond(MockResponse{Status: status, Body: body})
+}
+
+// RespondTemplate aggiunge una risposta il cui body e' un text/template
+// eseguito con la [MockRequest].
+func (r *MockRoute) RespondTemplate(status int, body string) *MockRoute {
+	return r.Respond(MockResponse{Status: status, Body: body, Template: true})
+}
+
+// RespondJSON aggiunge una risposta con v codificato in JSON. Se v non e'
+// codificabile la chiamata restituisce l'errore di encoding.
+func (r *MockRoute) RespondJSON(status int, v any) *MockRoute {
+	body, err := json.Marshal(v)
+	return r.Respond(MockResponse{
+		Status: status,
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   string(body),
+		Err:    err,
+	})
+}
+
+// RespondError aggiunge alla sequenza un errore del transport.
+func (r *MockRoute) RespondError(err error) *MockRoute {
+	return r.Respond(MockResponse{Err: err})
+}
+
+// Times richiede esattamente n chiamate; dopo l'n-esima la route non
+// corrisponde piu' e le richieste passano alle route successive.
+func (r *MockRoute) Times(n int) *MockRoute {
+	r.mock.mu.Lock()
+	defer r.mock.mu.Unlock()
+	r.times = n
+	return r
+}
+
+// Optional rende la route facoltativa: puo' non essere mai chiamata.
+func (r *MockRoute) Optional() *MockRoute {
+	r.mock.mu.Lock()
+	defer r.mock.mu.Unlock()
+	r.optional = true
+	return r
+}
+
+// Calls restituisce il numero di chiamate ricevute dalla route.
+func (r *MockRoute) Calls() int {
+	r.mock.mu.Lock()
+	defer r.mock.mu.Unlock()
+	return r.calls
+}
+
+// exhausted riporta se la route ha ricevuto tutte le chiamate previste; va
+// chiamato con m.mu.
+func (r *MockRoute) exhausted() bool {
+	return r.times > 0 && r.calls >= r.times
+}
+
+func matchAll(matchers []func(req *http.Request, body []byte) bool, req *http.Request, body []byte) bool {
+	for _, fn := range matchers {
+		if !fn(req, body) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *MockRoute) responseFor(call int) MockResponse {
+	if len(r.responses) == 0 {
+		return MockResponse{}
+	}
+	return r.responses[min(call, len(r.responses))-1]
+}
+
+func (resp MockResponse) build(req *http.Request, data MockRequest) (*http.Response, error) {
+	body := resp.Body
+	if resp.Template {
+		tmpl, err := template.New("mock").Parse(body)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		body = buf.String()
+	}
+
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header := cloneHeader(resp.Header)
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		Request:       req,
+	}, nil
+}
+
+// matchMockPath confronta il path con il pattern di una route, restituendo
+// i segmenti catturati.
+func matchMockPath(pattern, p string) (map[string]string, bool) {
+	if pattern == "" {
+		return nil, true
+	}
+
+	pat := strings.Split(strings.Trim(pattern, "/"), "/")
+	segs := strings.Split(strings.Trim(p, "/"), "/")
+	params := make(map[string]string)
+
+	for i, ps := range pat {
+		if name, ok := strings.CutPrefix(ps, "{"); ok && strings.HasSuffix(name, "...}") && i == len(pat)-1 {
+			if i >= len(segs) {
+				return nil, false
+			}
+			params[strings.TrimSuffix(name, "...}")] = strings.Join(segs[i:], "/")
+			return params, true
+		}
+		if i >= len(segs) {
+			return nil, false
+		}
+		if name, ok := strings.CutPrefix(ps, "{"); ok && strings.HasSuffix(name, "}") {
+			if segs[i] == "" {
+				return nil, false
+			}
+			params[strings.TrimSuffix(name, "}")] = segs[i]
+			continue
+		}
+		if ok, _ := path.Match(ps, segs[i]); !ok {
+			return nil, false
+		}
+	}
+	return params, len(pat) == len(segs)
+}
+
+// normalizeJSON riporta v alla forma prodotta da json.Unmarshal, per il
+// confronto con reflect.DeepEqual.
+func normalizeJSON(v any) (any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out any
+	err = json.Unmarshal(b, &out)
+	return out, err
+}
@@ -0,0 +1,200 @@
+package transport_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucasepe/x/http/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMockTransportMatchesRoutesAndTemplates(t *testing.T) {
+	mock := transport.NewMockTransport()
+	mock.On(http.MethodGet, "/users/{id}").
+		WithHeader("Accept", "application/json").
+		RespondTemplate(http.StatusOK, `{"id":"{{.Params.id}}","page":"{{.Query.Get "page"}}","call":{{.Call}}}`)
+	mock.On(http.MethodGet, "/files/{rest...}").
+		RespondTemplate(http.StatusOK, "{{.Params.rest}}")
+
+	req := mustRequest(t, http.MethodGet, "https://api.example.com/users/42?page=3", nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err := mock.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "200 OK", resp.Status)
+	assert.Equal(t, `{"id":"42","page":"3","call":1}`, readBody(t, resp))
+
+	resp, err = mock.RoundTrip(mustRequest(t, http.MethodGet, "https://api.example.com/files/a/b/c.txt", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "a/b/c.txt", readBody(t, resp))
+
+	// Senza l'header richiesto la route non corrisponde.
+	_, err = mock.RoundTrip(mustRequest(t, http.MethodGet, "https://api.example.com/users/42", nil))
+	var unmatched *transport.MockUnmatchedError
+	require.ErrorAs(t, err, &unmatched)
+	assert.ErrorIs(t, err, transport.ErrMockUnmatched)
+	assert.Equal(t, http.MethodGet, unmatched.Method)
+}
+
+func TestMockTransportMatchesBodies(t *testing.T) {
+	mock := transport.NewMockTransport()
+	created := mock.On(http.MethodPost, "/users").
+		WithJSONBody(map[string]any{"name": "ada", "admin": false}).
+		RespondJSON(http.StatusCreated, map[string]int{"id": 7})
+	mock.On(http.MethodPost, "/echo").
+		WithBody("ping").
+		RespondString(http.StatusOK, "pong")
+
+	resp, err := mock.RoundTrip(mustRequest(t, http.MethodPost, "https://api.example.com/users", strings.NewReader(`{ "admin": false, "name": "ada" }`)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.JSONEq(t, `{"id":7}`, readBody(t, resp))
+
+	resp, err = mock.RoundTrip(mustRequest(t, http.MethodPost, "https://api.example.com/echo", strings.NewReader("ping")))
+	require.NoError(t, err)
+	assert.Equal(t, "pong", readBody(t, resp))
+
+	_, err = mock.RoundTrip(mustRequest(t, http.MethodPost, "https://api.example.com/users", strings.NewReader(`{"name":"bob"}`)))
+	assert.ErrorIs(t, err, transport.ErrMockUnmatched)
+	assert.Equal(t, 1, created.Calls())
+}
+
+func TestMockTransportSequencesResponses(t *testing.T) {
+	boom := errors.New("connection reset")
+	mock := transport.NewMockTransport()
+	mock.On(http.MethodGet, "/flaky").
+		RespondError(boom).
+		RespondString(http.StatusServiceUnavailable, "busy").
+		RespondString(http.StatusOK, "ok")
+
+	_, err := mock.RoundTrip(mustRequest(t, http.MethodGet, "https://api.example.com/flaky", nil))
+	assert.ErrorIs(t, err, boom)
+
+	var statuses []int
+	for range 3 {
+		resp, err := mock.RoundTrip(mustRequest(t, http.MethodGet, "https://api.example.com/flaky", nil))
+		require.NoError(t, err)
+		readBody(t, resp)
+		statuses = append(statuses, resp.StatusCode)
+	}
+	assert.Equal(t, []int{503, 200, 200}, statuses, "the last response repeats")
+}
+
+func TestMockTransportWorksWithRetry(t *testing.T) {
+	mock := transport.NewMockTransport()
+	flaky := mock.On(http.MethodGet, "/items").
+		RespondString(http.StatusServiceUnavailable, "").
+		RespondString(http.StatusOK, "items")
+
+	rt := transport.RetryRoundTripper(mock, transport.RetryOptions{
+		MaxAttempts: 3,
+		StatusCodes: []int{http.StatusServiceUnavailable},
+		BaseDelay:   time.Millisecond,
+	})
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://api.example.com/items", nil))
+	require.NoError(t, err)
+	assert.Equal(t, "items", readBody(t, resp))
+	assert.Equal(t, 2, flaky.Calls())
+	mock.AssertExpectations(t)
+}
+
+func TestMockTransportTimesFallsThroughToNextRoute(t *testing.T) {
+	mock := transport.NewMockTransport()
+	mock.On(http.MethodGet, "/token").RespondString(http.StatusOK, "first").Times(1)
+	mock.On(http.MethodGet, "/token").RespondString(http.StatusOK, "later")
+
+	var got []string
+	for range 3 {
+		resp, err := mock.RoundTrip(mustRequest(t, http.MethodGet, "https://api.example.com/token", nil))
+		require.NoError(t, err)
+		got = append(got, readBody(t, resp))
+	}
+	assert.Equal(t, []string{"first", "later", "later"}, got)
+	assert.NoError(t, mock.ExpectationsError())
+}
+
+func TestMockTransportMatchersCanInspectTheMock(t *testing.T) {
+	mock := transport.NewMockTransport()
+	login := mock.On(http.MethodPost, "/login").Times(1)
+	mock.On(http.MethodGet, "/me").
+		Match(func(*http.Request, []byte) bool {
+			_ = mock.ExpectationsError()
+			return login.Calls() == 1
+		}).
+		RespondString(http.StatusOK, "ada")
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := mock.RoundTrip(mustRequest(t, http.MethodPost, "https://api.example.com/login", nil))
+		if err == nil {
+			resp.Body.Close()
+			resp, err = mock.RoundTrip(mustRequest(t, http.MethodGet, "https://api.example.com/me", nil))
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("matcher deadlocked on the mock lock")
+	}
+	mock.AssertExpectations(t)
+}
+
+func TestMockTransportReportsUnmetExpectations(t *testing.T) {
+	mock := transport.NewMockTransport()
+	mock.On(http.MethodGet, "/never")
+	mock.On(http.MethodDelete, "/users/*").Times(2)
+	mock.On("", "/maybe").Optional()
+
+	resp, err := mock.RoundTrip(mustRequest(t, http.MethodDelete, "https://api.example.com/users/1", nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+	_, err = mock.RoundTrip(mustRequest(t, http.MethodPut, "https://api.example.com/users/1", nil))
+	require.Error(t, err)
+
+	err = mock.ExpectationsError()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "GET /never: never called")
+	assert.Contains(t, err.Error(), "DELETE /users/*: expected 2 calls, got 1")
+	assert.Contains(t, err.Error(), "unexpected request PUT https://api.example.com/users/1")
+	assert.NotContains(t, err.Error(), "/maybe")
+
+	rec := &recordingTB{}
+	assert.False(t, mock.AssertExpectations(rec))
+	assert.Contains(t, rec.errors, "never called")
+}
+
+func TestMockTransportDelayHonorsContext(t *testing.T) {
+	mock := transport.NewMockTransport()
+	mock.On(http.MethodGet, "/slow").Respond(transport.MockResponse{Delay: time.Minute})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	req := mustRequest(t, http.MethodGet, "https://api.example.com/slow", nil).WithContext(ctx)
+	_, err := mock.RoundTrip(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+type recordingTB struct {
+	errors string
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...any) {
+	r.errors += fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,290 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuth2Options configura l'ottenimento dei token da un token endpoint
+// OAuth2 (RFC 6749).
+type OAuth2Options struct {
+	// TokenURL e' l'endpoint che rilascia i token.
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// RefreshToken, se valorizzato, abilita il grant refresh_token; altrimenti
+	// viene usato client_credentials. Se il server ne rilascia uno nuovo,
+	// sostituisce il precedente.
+	RefreshToken string
+	// EndpointParams aggiunge parametri alla richiesta di token (es. audience).
+	EndpointParams url.Values
+	// ClientAuthInBody invia client id e secret nel body invece che con
+	// autenticazione Basic.
+	ClientAuthInBody bool
+	// ExpiryDelta anticipa il rinnovo rispetto alla scadenza. Se <= 0 usa
+	// 30 secondi.
+	ExpiryDelta time.Duration
+	// TokenClient e' il client usato verso TokenURL. Se nil usa [Default]
+	// con timeout di 30 secondi.
+	TokenClient *http.Client
+	// OnToken, se valorizzato, viene invocato a ogni token ottenuto, ad
+	// esempio per persistere il refresh token ruotato.
+	OnToken func(OAuth2Token)
+}
+
+// OAuth2Token e' un token rilasciato dal token endpoint.
+type OAuth2Token struct {
+	AccessToken  string
+	TokenType    string
+	RefreshToken string
+	// Expiry e' zero se il server non indica una scadenza.
+	Expiry time.Time
+}
+
+// OAuth2Error riporta una risposta di errore del token endpoint.
+type OAuth2Error struct {
+	StatusCode  int
+	Code        string
+	Description string
+}
+
+func (e *OAuth2Error) Error() string {
+	msg := fmt.Sprintf("oauth2: token request failed with status %d", e.StatusCode)
+	if e.Code != "" {
+		msg += ": " + e.Code
+	}
+	if e.Description != "" {
+		msg += " (" + e.Description + ")"
+	}
+	return msg
+}
+
+// OAuth2RoundTripper aggiunge alle richieste un access token ottenuto dal
+// token endpoint, con grant client_credentials oppure refresh_token.
+// Il token viene riusato fino a poco prima della scadenza; i rinnovi
+// concorrenti vengono accorpati in un'unica richiesta. Se il server risponde
+// 401 il token viene rinnovato e la richiesta ritentata una volta, purche'
+// il body sia ricostruibile. Come [BearerAuthRoundTripper], non sovrascrive
+// un header Authorization gia' presente.
+func OAuth2RoundTripper(next http.RoundTripper, opts OAuth2Options) http.RoundTripper {
+	if next == nil {
+		next = Default()
+	}
+	if opts.ExpiryDelta <= 0 {
+		opts.ExpiryDelta = 30 * time.Second
+	}
+	if opts.TokenClient == nil {
+		opts.TokenClient = &http.Client{Transport: Default(), Timeout: 30 * time.Second}
+	}
+
+	return &oauth2Transport{
+		next:         next,
+		opts:         opts,
+		refreshToken: opts.RefreshToken,
+	}
+}
+
+type oauth2Transport struct {
+	next http.RoundTripper
+	opts OAuth2Options
+
+	mu           sync.Mutex
+	token        *OAuth2Token
+	refreshToken string
+	flight       *tokenFlight
+}
+
+// tokenFlight e' un rinnovo in corso condiviso dalle richieste concorrenti.
+type tokenFlight struct {
+	done  chan struct{}
+	token *OAuth2Token
+	err   error
+}
+
+func (t *oauth2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" {
+		// Non sovrascriviamo credenziali impostate a monte.
+		return t.next.RoundTrip(req)
+	}
+
+	tok, err := t.currentToken(req.Context(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(authorize(req, tok))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !canRetryRequest(req) {
+		return resp, err
+	}
+
+	// 401: il token potrebbe essere stato revocato prima della scadenza.
+	fresh, err := t.currentToken(req.Context(), tok.AccessToken)
+	if err != nil {
+		// Restituiamo la 401 originale: e' piu' informativa dell'errore di rinnovo.
+		return resp, nil
+	}
+	retryReq, err := requestForAttempt(req, 2)
+	if err != nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return t.next.RoundTrip(authorize(retryReq, fresh))
+}
+
+func authorize(req *http.Request, tok *OAuth2Token) *http.Request {
+	out := cloneRequest(req)
+	out.Header.Set("Authorization", tok.authorization())
+	return out
+}
+
+func (tok *OAuth2Token) authorization() string {
+	typ := tok.TokenType
+	if typ == "" || strings.EqualFold(typ, "bearer") {
+		// Alcuni server rispondono "bearer": normalizziamo come da RFC 6750.
+		typ = "Bearer"
+	}
+	return typ + " " + tok.AccessToken
+}
+
+// currentToken restituisce un token valido. Se rejected coincide con il token
+// corrente, questo viene considerato non piu' valido e rinnovato.
+func (t *oauth2Transport) currentToken(ctx context.Context, rejected string) (*OAuth2Token, error) {
+	t.mu.Lock()
+	if tok := t.token; tok != nil && tok.AccessToken != rejected && t.valid(tok) {
+		t.mu.Unlock()
+		return tok, nil
+	}
+
+	f := t.flight
+	if f == nil {
+		f = &tokenFlight{done: make(chan struct{})}
+		t.flight = f
+		refreshToken := t.refreshToken
+		t.mu.Unlock()
+
+		// Il rinnovo non dipende dal context del singolo chiamante: altre
+		// richieste potrebbero attenderne l'esito.
+		go t.fetch(context.WithoutCancel(ctx), f, refreshToken)
+	} else {
+		t.mu.Unlock()
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-f.done:
+		return f.token, f.err
+	}
+}
+
+func (t *oauth2Transport) valid(tok *OAuth2Token) bool {
+	return tok.Expiry.IsZero() || time.Now().Add(t.opts.ExpiryDelta).Before(tok.Expiry)
+}
+
+func (t *oauth2Transport) fetch(ctx context.Context, f *tokenFlight, refreshToken string) {
+	f.token, f.err = t.requestToken(ctx, refreshToken)
+
+	t.mu.Lock()
+	t.flight = nil
+	if f.err == nil {
+		t.token = f.token
+		if f.token.RefreshToken != "" {
+			t.refreshToken = f.token.RefreshToken
+		}
+	}
+	t.mu.Unlock()
+
+	// OnToken viene invocato prima di sbloccare le richieste in attesa.
+	if f.err == nil && t.opts.OnToken != nil {
+		t.opts.OnToken(*f.token)
+	}
+	close(f.done)
+}
+
+func (t *oauth2Transport) requestToken(ctx context.Context, refreshToken string) (*OAuth2Token, error) {
+	form := url.Values{}
+	for k, v := range t.opts.EndpointParams {
+		form[k] = append([]string(nil), v...)
+	}
+	if refreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", refreshToken)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+	if len(t.opts.Scopes) > 0 {
+		form.Set("scope", strings.Join(t.opts.Scopes, " "))
+	}
+	if t.opts.ClientAuthInBody {
+		form.Set("client_id", t.opts.ClientID)
+		if t.opts.ClientSecret != "" {
+			form.Set("client_secret", t.opts.ClientSecret)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.opts.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if !t.opts.ClientAuthInBody {
+		req.SetBasicAuth(url.QueryEscape(t.opts.ClientID), url.QueryEscape(t.opts.ClientSecret))
+	}
+
+	resp, err := t.opts.TokenClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	var payload struct {
+		AccessToken      string          `json:"access_token"`
+		TokenType        string          `json:"token_type"`
+		RefreshToken     string          `json:"refresh_token"`
+		ExpiresIn        json.RawMessage `json:"expires_in"`
+		Error            string          `json:"error"`
+		ErrorDescription string          `json:"error_description"`
+	}
+	jsonErr := json.Unmarshal(body, &payload)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 || payload.Error != "" {
+		return nil, &OAuth2Error{
+			StatusCode:  resp.StatusCode,
+			Code:        payload.Error,
+			Description: payload.ErrorDescription,
+		}
+	}
+	if jsonErr != nil {
+		return nil, fmt.Errorf("oauth2: invalid token response: %w", jsonErr)
+	}
+	if payload.AccessToken == "" {
+		return nil, fmt.Errorf("oauth2: token response without access_token")
+	}
+
+	tok := &OAuth2Token{
+		AccessToken:  payload.AccessToken,
+		TokenType:    payload.TokenType,
+		RefreshToken: payload.RefreshToken,
+	}
+	// expires_in e' un numero, ma alcuni server lo inviano come stringa.
+	raw := strings.Trim(string(payload.ExpiresIn), `"`)
+	var secs int64
+	if _, err := fmt.Sscan(raw, &secs); err == nil && secs > 0 {
+		tok.Expiry = time.Now().Add(time.Duration(secs) * time.Second)
+	}
+	return tok, nil
+}
@@ -0,0 +1,179 @@
+package transport_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lucasepe/x/http/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tokenEndpoint simula un token endpoint che rilascia token numerati.
+func tokenEndpoint(t *testing.T, calls *int32, forms *[]url.Values, mu *sync.Mutex, expiresIn int) *http.Client {
+	return &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		n := atomic.AddInt32(calls, 1)
+		require.NoError(t, req.ParseForm())
+		mu.Lock()
+		*forms = append(*forms, req.PostForm)
+		mu.Unlock()
+
+		user, pass, ok := req.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "client", user)
+		assert.Equal(t, "secret", pass)
+
+		time.Sleep(10 * time.Millisecond)
+		body := fmt.Sprintf(`{"access_token":"tok-%d","token_type":"bearer","expires_in":%d,"refresh_token":"r%d"}`, n, expiresIn, n+1)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	})}
+}
+
+func okWithAuth(seen *[]string, mu *sync.Mutex) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		*seen = append(*seen, req.Header.Get("Authorization"))
+		mu.Unlock()
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+	})
+}
+
+func TestOAuth2ClientCredentialsSingleFlight(t *testing.T) {
+	var mu sync.Mutex
+	var calls int32
+	var forms []url.Values
+	var seen []string
+
+	rt := transport.OAuth2RoundTripper(okWithAuth(&seen, &mu), transport.OAuth2Options{
+		TokenURL:     "https://auth.example.com/token",
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Scopes:       []string{"read", "write"},
+		TokenClient:  tokenEndpoint(t, &calls, &forms, &mu, 3600),
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://api.example.com/", nil))
+			if assert.NoError(t, err) {
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	require.Len(t, forms, 1)
+	assert.Equal(t, "client_credentials", forms[0].Get("grant_type"))
+	assert.Equal(t, "read write", forms[0].Get("scope"))
+	require.Len(t, seen, 10)
+	for _, h := range seen {
+		assert.Equal(t, "Bearer tok-1", h)
+	}
+}
+
+func TestOAuth2RefreshTokenRotation(t *testing.T) {
+	var mu sync.Mutex
+	var calls int32
+	var forms []url.Values
+	var seen []string
+	var issued []transport.OAuth2Token
+
+	rt := transport.OAuth2RoundTripper(okWithAuth(&seen, &mu), transport.OAuth2Options{
+		TokenURL:     "https://auth.example.com/token",
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RefreshToken: "r1",
+		// expires_in=10 e' sotto ExpiryDelta: ogni richiesta rinnova il token.
+		ExpiryDelta: time.Minute,
+		TokenClient: tokenEndpoint(t, &calls, &forms, &mu, 10),
+		OnToken:     func(tok transport.OAuth2Token) { issued = append(issued, tok) },
+	})
+
+	for i := 0; i < 2; i++ {
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://api.example.com/", nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	require.Len(t, forms, 2)
+	assert.Equal(t, "refresh_token", forms[0].Get("grant_type"))
+	assert.Equal(t, "r1", forms[0].Get("refresh_token"))
+	assert.Equal(t, "r2", forms[1].Get("refresh_token"))
+	assert.Equal(t, []string{"Bearer tok-1", "Bearer tok-2"}, seen)
+	require.Len(t, issued, 2)
+	assert.Equal(t, "r3", issued[1].RefreshToken)
+}
+
+func TestOAuth2RetriesOnceOn401(t *testing.T) {
+	var mu sync.Mutex
+	var calls int32
+	var forms []url.Values
+	var seen []string
+
+	api := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(req.Body)
+		auth := req.Header.Get("Authorization")
+		seen = append(seen, auth+" "+string(body))
+		status := http.StatusOK
+		if auth == "Bearer tok-1" {
+			status = http.StatusUnauthorized
+		}
+		return &http.Response{StatusCode: status, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+	})
+
+	rt := transport.OAuth2RoundTripper(api, transport.OAuth2Options{
+		TokenURL:     "https://auth.example.com/token",
+		ClientID:     "client",
+		ClientSecret: "secret",
+		TokenClient:  tokenEndpoint(t, &calls, &forms, &mu, 3600),
+	})
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodPost, "https://api.example.com/", strings.NewReader("payload")))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"Bearer tok-1 payload", "Bearer tok-2 payload"}, seen)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestOAuth2TokenEndpointError(t *testing.T) {
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusBadRequest,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader(`{"error":"invalid_client","error_description":"unknown client"}`)),
+			Request:    req,
+		}, nil
+	})}
+
+	rt := transport.OAuth2RoundTripper(nil, transport.OAuth2Options{
+		TokenURL:    "https://auth.example.com/token",
+		ClientID:    "client",
+		TokenClient: client,
+	})
+
+	_, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://api.example.com/", nil))
+	var oauthErr *transport.OAuth2Error
+	require.True(t, errors.As(err, &oauthErr))
+	assert.Equal(t, http.StatusBadRequest, oauthErr.StatusCode)
+	assert.Equal(t, "invalid_client", oauthErr.Code)
+	assert.Equal(t, "unknown client", oauthErr.Description)
+}
@@ -0,0 +1,671 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucasepe/x/filecache"
+	"github.com/lucasepe/x/section"
+	"golang.org/x/time/rate"
+)
+
+// ErrUnknownLayer indica un tipo di layer non registrato in [LayerRegistry].
+var ErrUnknownLayer = errors.New("unknown transport layer")
+
+// PipelineConfig descrive uno stack di transport in forma dichiarativa. I
+// layer sono applicati nell'ordine in cui compaiono, come con
+// [TransportBuilder.Use]: il primo riceve per primo la richiesta.
+type PipelineConfig struct {
+	Layers []LayerConfig `json:"layers"`
+}
+
+// LayerConfig descrive un singolo layer della pipeline.
+type LayerConfig struct {
+	// Type e' il nome con cui il layer e' registrato, ad esempio "retry".
+	Type string `json:"type"`
+	// Options sono le opzioni del layer in forma testuale; le liste sono
+	// separate da virgole.
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// UnmarshalJSON accetta come valori delle opzioni anche numeri, booleani e
+// array, convertendoli nella forma testuale usata dal formato a sezioni.
+func (c *LayerConfig) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Type    string                     `json:"type"`
+		Options map[string]json.RawMessage `json:"options"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	c.Type = raw.Type
+	c.Options = nil
+	for key, value := range raw.Options {
+		s, ok, err := jsonOptionValue(value)
+		if err != nil {
+			return fmt.Errorf("layer %q: option %q: %w", raw.Type, key, err)
+		}
+		if !ok {
+			continue
+		}
+		if c.Options == nil {
+			c.Options = make(map[string]string, len(raw.Options))
+		}
+		c.Options[strings.ToLower(key)] = s
+	}
+	return nil
+}
+
+// jsonOptionValue converte un valore JSON nella sua forma testuale. I null
+// sono ignorati.
+func jsonOptionValue(value json.RawMessage) (string, bool, error) {
+	var v any
+	if err := json.Unmarshal(value, &v); err != nil {
+		return "", false, err
+	}
+
+	switch v := v.(type) {
+	case nil:
+		return "", false, nil
+	case string:
+		return v, true, nil
+	case []any:
+		var items []json.RawMessage
+		if err := json.Unmarshal(value, &items); err != nil {
+			return "", false, err
+		}
+		parts := make([]string, 0, len(items))
+		for _, item := range items {
+			s, ok, err := jsonOptionValue(item)
+			if err != nil {
+				return "", false, err
+			}
+			if ok {
+				parts = append(parts, s)
+			}
+		}
+		return strings.Join(parts, ","), true, nil
+	case map[string]any:
+		return "", false, errors.New("objects are not supported")
+	default:
+		// Numeri e booleani: il testo JSON e' gia' nella forma attesa.
+		return strings.TrimSpace(string(value)), true, nil
+	}
+}
+
+// ParsePipelineConfig legge una pipeline nel formato a sezioni del package
+// section: ogni sezione e' un layer, nell'ordine del file, e le sue righe
+// sono coppie "chiave = valore". Il nome della sezione e' il tipo del layer;
+// la chiave "type" permette di usare lo stesso tipo in piu' sezioni:
+//
+//	[request_id]
+//	header = X-Correlation-Id
+//
+//	[retry]
+//	max_attempts = 4
+//	status_codes = 429, 502, 503
+//	backoff = exponential
+//
+//	[api-cache]
+//	type = cache
+//	dir = /var/cache/api
+func ParsePipelineConfig(r io.Reader) (PipelineConfig, error) {
+	doc, err := section.Parse(r)
+	if err != nil {
+		return PipelineConfig{}, err
+	}
+	if lines := doc.Content(""); len(lines) > 0 {
+		return PipelineConfig{}, fmt.Errorf("line outside of a layer section: %q", strings.TrimSpace(lines[0]))
+	}
+
+	var cfg PipelineConfig
+	for _, unit := range doc.Units() {
+		layer := LayerConfig{Type: unit}
+		for _, line := range doc.Content(unit) {
+			key, value, ok := strings.Cut(line, "=")
+			key = strings.ToLower(strings.TrimSpace(key))
+			if !ok || key == "" {
+				return PipelineConfig{}, fmt.Errorf("layer [%s]: invalid line %q, want key = value", unit, strings.TrimSpace(line))
+			}
+			value = unquoteOption(strings.TrimSpace(value))
+
+			if key == "type" {
+				layer.Type = value
+				continue
+			}
+			if layer.Options == nil {
+				layer.Options = make(map[string]string)
+			}
+			if _, dup := layer.Options[key]; dup {
+				return PipelineConfig{}, fmt.Errorf("layer [%s]: duplicate option %q", unit, key)
+			}
+			layer.Options[key] = value
+		}
+		cfg.Layers = append(cfg.Layers, layer)
+	}
+	return cfg, nil
+}
+
+// ParsePipelineConfigJSON legge una pipeline in formato JSON:
+//
+//	{"layers": [
+//		{"type": "request_id"},
+//		{"type": "retry", "options": {"max_attempts": 4, "status_codes": [429, 503]}}
+//	]}
+func ParsePipelineConfigJSON(r io.Reader) (PipelineConfig, error) {
+	var cfg PipelineConfig
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return PipelineConfig{}, err
+	}
+	return cfg, nil
+}
+
+func unquoteOption(s string) string {
+	if len(s) >= 2 && (s[0] == '"' && s[len(s)-1] == '"' || s[0] == '\'' && s[len(s)-1] == '\'') {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// LayerFactory costruisce un layer a partire dalle sue opzioni. Gli errori
+// di conversione restano in opts e vengono segnalati da
+// [LayerRegistry.Apply], che rifiuta anche le opzioni mai lette.
+type LayerFactory func(opts *LayerOptions) (func(http.RoundTripper) http.RoundTripper, error)
+
+// LayerOptions da' accesso tipizzato alle opzioni di un layer. Ogni getter
+// restituisce def se l'opzione manca; il primo valore non valido viene
+// conservato in [LayerOptions.Err].
+type LayerOptions struct {
+	values  map[string]string
+	used    map[string]bool
+	err     error
+	closers []func() error // risorse aperte dalla factory
+}
+
+// closeOnFailure registra una risorsa aperta dalla factory, da chiudere se
+// Apply fallisce e il layer non viene mai aggiunto al builder.
+func (o *LayerOptions) closeOnFailure(fn func() error) {
+	o.closers = append(o.closers, fn)
+}
+
+// release chiude le risorse registrate con closeOnFailure.
+func (o *LayerOptions) release() {
+	for _, fn := range o.closers {
+		_ = fn()
+	}
+}
+
+func newLayerOptions(values map[string]string) *LayerOptions {
+	o := &LayerOptions{
+		values: make(map[string]string, len(values)),
+		used:   make(map[string]bool, len(values)),
+	}
+	for key, value := range values {
+		o.values[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return o
+}
+
+func (o *LayerOptions) lookup(key string) (string, bool) {
+	o.used[key] = true
+	v, ok := o.values[key]
+	if !ok || strings.TrimSpace(v) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(v), true
+}
+
+func (o *LayerOptions) fail(key string, err error) {
+	if o.err == nil {
+		o.err = fmt.Errorf("option %q: %w", key, err)
+	}
+}
+
+// Has indica se l'opzione e' valorizzata.
+func (o *LayerOptions) Has(key string) bool {
+	_, ok := o.lookup(key)
+	return ok
+}
+
+// String restituisce l'opzione cosi' com'e'.
+func (o *LayerOptions) String(key, def string) string {
+	if v, ok := o.lookup(key); ok {
+		return v
+	}
+	return def
+}
+
+// Int restituisce l'opzione come intero.
+func (o *LayerOptions) Int(key string, def int) int {
+	v, ok := o.lookup(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		o.fail(key, err)
+		return def
+	}
+	return n
+}
+
+// Float restituisce l'opzione come numero decimale.
+func (o *LayerOptions) Float(key string, def float64) float64 {
+	v, ok := o.lookup(key)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		o.fail(key, err)
+		return def
+	}
+	return f
+}
+
+// Bool restituisce l'opzione come booleano, nei formati di strconv.ParseBool.
+func (o *LayerOptions) Bool(key string, def bool) bool {
+	v, ok := o.lookup(key)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		o.fail(key, err)
+		return def
+	}
+	return b
+}
+
+// Duration restituisce l'opzione come durata, nel formato di
+// time.ParseDuration (es. "250ms", "2s").
+func (o *LayerOptions) Duration(key string, def time.Duration) time.Duration {
+	v, ok := o.lookup(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		o.fail(key, err)
+		return def
+	}
+	return d
+}
+
+// Strings restituisce l'opzione come lista separata da virgole, senza
+// elementi vuoti.
+func (o *LayerOptions) Strings(key string) []string {
+	v, ok := o.lookup(key)
+	if !ok {
+		return nil
+	}
+	var out []string
+	for item := range strings.SplitSeq(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// Ints restituisce l'opzione come lista di interi separati da virgole.
+func (o *LayerOptions) Ints(key string) []int {
+	var out []int
+	for _, item := range o.Strings(key) {
+		n, err := strconv.Atoi(item)
+		if err != nil {
+			o.fail(key, err)
+			return nil
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+// Secret legge un segreto dall'opzione key oppure, se assente, dalla
+// variabile d'ambiente indicata in key+"_env", cosi' le credenziali possono
+// restare fuori dal file di configurazione.
+func (o *LayerOptions) Secret(key string) string {
+	v, hasValue := o.lookup(key)
+	name, hasEnv := o.lookup(key + "_env")
+	switch {
+	case hasValue && hasEnv:
+		o.fail(key, fmt.Errorf("cannot be combined with %q", key+"_env"))
+		return ""
+	case hasValue:
+		return v
+	case !hasEnv:
+		return ""
+	}
+	v = os.Getenv(name)
+	if v == "" {
+		o.fail(key+"_env", fmt.Errorf("environment variable %s is empty", name))
+	}
+	return v
+}
+
+// Err restituisce il primo errore di conversione.
+func (o *LayerOptions) Err() error {
+	return o.err
+}
+
+// unused restituisce le opzioni mai lette, in ordine.
+func (o *LayerOptions) unused() []string {
+	var out []string
+	for key := range o.values {
+		if !o.used[key] {
+			out = append(out, key)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+// LayerRegistry associa i tipi di layer alle loro factory.
+type LayerRegistry struct {
+	mu        sync.RWMutex
+	factories map[string]LayerFactory
+}
+
+// NewLayerRegistry crea un registry con i layer predefiniti:
+//
+//   - request_id: header;
+//   - verbose: log_bodies, max_body_bytes, timing (output su stderr);
+//   - logging: log_headers, redact_headers, redact_query, timing;
+//   - retry: max_attempts, status_codes, methods, base_delay, max_delay,
+//     retry_on_error, backoff (constant, exponential, decorrelated_jitter);
+//   - host_limiter: rate (richieste al secondo), burst;
+//   - cache: dir oppure name (sotto la cache dell'utente), methods,
+//     key (method_url, method_url_body), http_semantics, private;
+//   - basic_auth: username, password o password_env;
+//   - bearer_auth: token o token_env;
+//   - sticky_browser: nessuna opzione.
+func NewLayerRegistry() *LayerRegistry {
+	r := &LayerRegistry{factories: make(map[string]LayerFactory)}
+	for name, f := range builtinLayers {
+		r.Register(name, f)
+	}
+	return r
+}
+
+// Register aggiunge o sostituisce il tipo di layer name.
+func (r *LayerRegistry) Register(name string, f LayerFactory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.factories[strings.ToLower(strings.TrimSpace(name))] = f
+}
+
+// Layers restituisce i tipi registrati, in ordine alfabetico.
+func (r *LayerRegistry) Layers() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Sorted(maps.Keys(r.factories))
+}
+
+// Apply aggiunge al builder i layer descritti da cfg. Se il builder e' nil,
+// ne crea uno nuovo; in caso di errore il builder non viene modificato.
+// Sono errori i tipi sconosciuti ([ErrUnknownLayer]), i valori non validi e
+// le opzioni non riconosciute dal layer. In caso di errore le risorse gia'
+// aperte dai layer precedenti, come il file cache, vengono chiuse.
+func (r *LayerRegistry) Apply(b *TransportBuilder, cfg PipelineConfig) (*TransportBuilder, error) {
+	layers := make([]func(http.RoundTripper) http.RoundTripper, 0, len(cfg.Layers))
+	built := make([]*LayerOptions, 0, len(cfg.Layers))
+	for i, lc := range cfg.Layers {
+		layer, opts, err := r.build(lc)
+		if err != nil {
+			for _, o := range built {
+				o.release()
+			}
+			return b, fmt.Errorf("layer %d (%s): %w", i+1, lc.Type, err)
+		}
+		layers = append(layers, layer)
+		built = append(built, opts)
+	}
+
+	if b == nil {
+		b = NewTransportBuilder()
+	}
+	for _, layer := range layers {
+		b = b.Use(layer)
+	}
+	return b, nil
+}
+
+func (r *LayerRegistry) build(lc LayerConfig) (func(http.RoundTripper) http.RoundTripper, *LayerOptions, error) {
+	r.mu.RLock()
+	f, ok := r.factories[strings.ToLower(strings.TrimSpace(lc.Type))]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, nil, ErrUnknownLayer
+	}
+
+	opts := newLayerOptions(lc.Options)
+	layer, err := f(opts)
+	if err == nil {
+		err = opts.Err()
+	}
+	if err == nil {
+		if unused := opts.unused(); len(unused) > 0 {
+			err = fmt.Errorf("unknown option %q", unused[0])
+		}
+	}
+	if err != nil {
+		opts.release()
+		return nil, nil, err
+	}
+	return layer, opts, nil
+}
+
+// BuildPipeline costruisce il transport descritto da cfg con i layer
+// predefiniti di [NewLayerRegistry]. Se qualche layer detiene risorse, come
+// il file cache di "cache", il transport implementa [io.Closer] e va chiuso
+// quando non serve piu'.
+func BuildPipeline(cfg PipelineConfig) (http.RoundTripper, error) {
+	b, err := NewLayerRegistry().Apply(nil, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return b.Build(), nil
+}
+
+var builtinLayers = map[string]LayerFactory{
+	"request_id":     requestIDLayer,
+	"verbose":        verboseLayer,
+	"logging":        loggingLayer,
+	"retry":          retryLayer,
+	"host_limiter":   hostLimiterLayer,
+	"cache":          cacheLayer,
+	"basic_auth":     basicAuthLayer,
+	"bearer_auth":    bearerAuthLayer,
+	"sticky_browser": stickyBrowserLayer,
+}
+
+func requestIDLayer(o *LayerOptions) (func(http.RoundTripper) http.RoundTripper, error) {
+	opts := RequestIDOptions{HeaderName: o.String("header", "")}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RequestIDRoundTripperWithOptions(next, opts)
+	}, nil
+}
+
+func verboseLayer(o *LayerOptions) (func(http.RoundTripper) http.RoundTripper, error) {
+	opts := VerboseOptions{
+		LogBodies:    o.Bool("log_bodies", true),
+		MaxBodyBytes: o.Int("max_body_bytes", DefaultVerboseMaxBodyBytes),
+		Timing:       o.Bool("timing", false),
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return VerboseRoundTripperWithOptions(next, opts)
+	}, nil
+}
+
+func loggingLayer(o *LayerOptions) (func(http.RoundTripper) http.RoundTripper, error) {
+	opts := LoggingOptions{
+		LogHeaders:    o.Bool("log_headers", false),
+		RedactHeaders: o.Strings("redact_headers"),
+		RedactQuery:   o.Strings("redact_query"),
+		Timing:        o.Bool("timing", false),
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return LoggingRoundTripperWithOptions(next, opts)
+	}, nil
+}
+
+func retryLayer(o *LayerOptions) (func(http.RoundTripper) http.RoundTripper, error) {
+	opts := RetryOptions{
+		MaxAttempts:  o.Int("max_attempts", 0),
+		StatusCodes:  o.Ints("status_codes"),
+		Methods:      o.Strings("methods"),
+		BaseDelay:    o.Duration("base_delay", 0),
+		MaxDelay:     o.Duration("max_delay", 0),
+		RetryOnError: o.Bool("retry_on_error", false),
+	}
+	switch backoff := o.String("backoff", "constant"); backoff {
+	case "constant":
+		opts.Backoff = ConstantBackoff
+	case "exponential":
+		opts.Backoff = ExponentialBackoff
+	case "decorrelated_jitter":
+		opts.Backoff = DecorrelatedJitterBackoff
+	default:
+		return nil, fmt.Errorf("option %q: unknown backoff %q", "backoff", backoff)
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RetryRoundTripper(next, opts)
+	}, nil
+}
+
+func hostLimiterLayer(o *LayerOptions) (func(http.RoundTripper) http.RoundTripper, error) {
+	opts := HostLimiterOptions{
+		Rate:  rate.Limit(o.Float("rate", 1)),
+		Burst: o.Int("burst", 1),
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return HostLimiterWithOptions(next, opts)
+	}, nil
+}
+
+// cacheLayer apre il file cache gia' in fase di configurazione, cosi' una
+// directory non valida viene segnalata subito. Il cache appartiene al layer:
+// lo chiude Apply se la configurazione non e' valida, altrimenti il Close del
+// transport costruito ([io.Closer]). I transport costruiti dallo stesso
+// builder condividono il cache, chiuso insieme all'ultimo di essi.
+func cacheLayer(o *LayerOptions) (func(http.RoundTripper) http.RoundTripper, error) {
+	dir, name := o.String("dir", ""), o.String("name", "")
+	opts := FileCacheOptions{
+		Methods:       o.Strings("methods"),
+		HTTPSemantics: o.Bool("http_semantics", false),
+		PrivateCache:  o.Bool("private", false),
+	}
+	switch key := o.String("key", "method_url"); key {
+	case "method_url":
+		opts.KeyFunc = DigestCacheKeyMethodURL
+	case "method_url_body":
+		opts.KeyFunc = DigestCacheKeyMethodURLBody
+	default:
+		return nil, fmt.Errorf("option %q: unknown cache key %q", "key", key)
+	}
+	if o.Err() != nil {
+		return nil, o.Err()
+	}
+
+	switch {
+	case dir != "" && name != "":
+		return nil, errors.New(`options "dir" and "name" are mutually exclusive`)
+	case name != "":
+		var err error
+		if dir, err = filecache.NewCacheDir(name); err != nil {
+			return nil, err
+		}
+	case dir == "":
+		return nil, errors.New(`option "dir" or "name" is required`)
+	}
+
+	fc, err := filecache.New(dir)
+	if err != nil {
+		return nil, err
+	}
+	o.closeOnFailure(fc.Close)
+	cache := &pipelineCache{fc: fc}
+	return func(next http.RoundTripper) http.RoundTripper {
+		cache.acquire()
+		return &pipelineCacheTransport{
+			RoundTripper: FileCacheTransportWithOptions(fc, next, opts),
+			cache:        cache,
+		}
+	}, nil
+}
+
+// pipelineCache conta i transport costruiti che usano il file cache di un
+// layer "cache", cosi' da chiuderlo con l'ultimo.
+type pipelineCache struct {
+	fc   *filecache.FileCacheFS
+	mu   sync.Mutex
+	refs int
+}
+
+func (c *pipelineCache) acquire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refs++
+}
+
+func (c *pipelineCache) release() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refs--
+	if c.refs > 0 {
+		return nil
+	}
+	return c.fc.Close()
+}
+
+// pipelineCacheTransport e' il transport del layer "cache", che a differenza
+// di [FileCacheTransport] possiede il file cache che usa.
+type pipelineCacheTransport struct {
+	http.RoundTripper
+	cache *pipelineCache
+	once  sync.Once
+}
+
+func (t *pipelineCacheTransport) closeOwned() error {
+	var err error
+	t.once.Do(func() { err = t.cache.release() })
+	return err
+}
+
+func basicAuthLayer(o *LayerOptions) (func(http.RoundTripper) http.RoundTripper, error) {
+	user, pass := o.String("username", ""), o.Secret("password")
+	if user == "" {
+		return nil, errors.New(`option "username" is required`)
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return BasicAuthRoundTripper(user, pass, next)
+	}, nil
+}
+
+func bearerAuthLayer(o *LayerOptions) (func(http.RoundTripper) http.RoundTripper, error) {
+	token := o.Secret("token")
+	if token == "" && o.Err() == nil {
+		return nil, errors.New(`option "token" or "token_env" is required`)
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return BearerAuthRoundTripper(token, next)
+	}, nil
+}
+
+func stickyBrowserLayer(*LayerOptions) (func(http.RoundTripper) http.RoundTripper, error) {
+	return StickyBrowserRoundTripper, nil
+}
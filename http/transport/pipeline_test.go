@@ -0,0 +1,221 @@
+package transport_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lucasepe/x/http/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePipelineConfigReadsSectionsInOrder(t *testing.T) {
+	cfg, err := transport.ParsePipelineConfig(strings.NewReader(`
+# pipeline di esempio
+[request_id]
+header = X-Correlation-Id
+
+[retry]
+max_attempts = 4
+status_codes = 429, 503
+
+[api-cache]
+type = cache
+dir = "/tmp/api cache"
+`))
+	require.NoError(t, err)
+
+	assert.Equal(t, []transport.LayerConfig{
+		{Type: "request_id", Options: map[string]string{"header": "X-Correlation-Id"}},
+		{Type: "retry", Options: map[string]string{"max_attempts": "4", "status_codes": "429, 503"}},
+		{Type: "cache", Options: map[string]string{"dir": "/tmp/api cache"}},
+	}, cfg.Layers)
+}
+
+func TestParsePipelineConfigRejectsInvalidLines(t *testing.T) {
+	_, err := transport.ParsePipelineConfig(strings.NewReader("max_attempts = 3\n[retry]\n"))
+	assert.ErrorContains(t, err, "outside of a layer section")
+
+	_, err = transport.ParsePipelineConfig(strings.NewReader("[retry]\nmax_attempts\n"))
+	assert.ErrorContains(t, err, "want key = value")
+}
+
+func TestParsePipelineConfigJSONConvertsScalars(t *testing.T) {
+	cfg, err := transport.ParsePipelineConfigJSON(strings.NewReader(`{"layers": [
+		{"type": "retry", "options": {"max_attempts": 3, "retry_on_error": true, "status_codes": [429, 503], "methods": null}}
+	]}`))
+	require.NoError(t, err)
+
+	require.Len(t, cfg.Layers, 1)
+	assert.Equal(t, map[string]string{
+		"max_attempts":   "3",
+		"retry_on_error": "true",
+		"status_codes":   "429,503",
+	}, cfg.Layers[0].Options)
+}
+
+func TestBuildPipelineAppliesLayersInOrder(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, r.Header.Get("X-Correlation-Id")+" "+r.Header.Get("Authorization"))
+	}))
+	defer srv.Close()
+
+	t.Setenv("PIPELINE_TEST_TOKEN", "s3cr3t")
+	cfg, err := transport.ParsePipelineConfig(strings.NewReader(`
+[request_id]
+header = X-Correlation-Id
+
+[retry]
+max_attempts = 2
+status_codes = 503
+base_delay = 1ms
+
+[bearer_auth]
+token_env = PIPELINE_TEST_TOKEN
+`))
+	require.NoError(t, err)
+
+	rt, err := transport.BuildPipeline(cfg)
+	require.NoError(t, err)
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, srv.URL, nil))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	id, auth, _ := strings.Cut(readBody(t, resp), " ")
+	assert.NotEmpty(t, id)
+	assert.Equal(t, "Bearer s3cr3t", auth)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+}
+
+func TestBuildPipelineCachesResponses(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		io.WriteString(w, "cached")
+	}))
+	defer srv.Close()
+
+	rt, err := transport.BuildPipeline(transport.PipelineConfig{Layers: []transport.LayerConfig{
+		{Type: "cache", Options: map[string]string{"dir": t.TempDir()}},
+	}})
+	require.NoError(t, err)
+
+	for range 2 {
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, srv.URL, nil))
+		require.NoError(t, err)
+		assert.Equal(t, "cached", readBody(t, resp))
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	closer, ok := rt.(io.Closer)
+	require.True(t, ok, "pipeline with a cache layer must implement io.Closer")
+	assert.NoError(t, closer.Close())
+}
+
+func TestBuildPipelineSharesCacheUntilLastClose(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		io.WriteString(w, "cached")
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	cfg := transport.PipelineConfig{Layers: []transport.LayerConfig{
+		{Type: "cache", Options: map[string]string{"dir": dir}},
+	}}
+
+	// un layer non valido dopo il cache fa chiudere il cache gia' aperto
+	_, err := transport.BuildPipeline(transport.PipelineConfig{Layers: append(cfg.Layers,
+		transport.LayerConfig{Type: "retry", Options: map[string]string{"backoff": "random"}})})
+	require.Error(t, err)
+
+	b, err := transport.NewLayerRegistry().Apply(nil, cfg)
+	require.NoError(t, err)
+	first, second := b.Build(), b.Build()
+
+	resp, err := first.RoundTrip(mustRequest(t, http.MethodGet, srv.URL, nil))
+	require.NoError(t, err)
+	assert.Equal(t, "cached", readBody(t, resp))
+	require.NoError(t, first.(io.Closer).Close())
+	require.NoError(t, first.(io.Closer).Close(), "Close ripetuto non rilascia il cache due volte")
+
+	// il cache resta aperto finche' c'e' un transport che lo usa
+	resp, err = second.RoundTrip(mustRequest(t, http.MethodGet, srv.URL, nil))
+	require.NoError(t, err)
+	assert.Equal(t, "cached", readBody(t, resp))
+	require.NoError(t, second.(io.Closer).Close())
+
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+func TestBuildPipelineReportsConfigurationErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		layer transport.LayerConfig
+		want  string
+	}{
+		{"unknown layer", transport.LayerConfig{Type: "teleport"}, "unknown transport layer"},
+		{"unknown option", transport.LayerConfig{Type: "retry", Options: map[string]string{"max_atempts": "3"}}, `unknown option "max_atempts"`},
+		{"invalid value", transport.LayerConfig{Type: "retry", Options: map[string]string{"max_attempts": "three"}}, `option "max_attempts"`},
+		{"invalid backoff", transport.LayerConfig{Type: "retry", Options: map[string]string{"backoff": "linear"}}, `unknown backoff "linear"`},
+		{"missing cache dir", transport.LayerConfig{Type: "cache"}, `option "dir" or "name" is required`},
+		{"missing token", transport.LayerConfig{Type: "bearer_auth"}, `option "token" or "token_env" is required`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := transport.BuildPipeline(transport.PipelineConfig{Layers: []transport.LayerConfig{
+				{Type: "request_id"},
+				tt.layer,
+			}})
+			require.Error(t, err)
+			assert.ErrorContains(t, err, "layer 2 ("+tt.layer.Type+")")
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+
+	_, err := transport.BuildPipeline(transport.PipelineConfig{Layers: []transport.LayerConfig{{Type: "teleport"}}})
+	assert.ErrorIs(t, err, transport.ErrUnknownLayer)
+}
+
+func TestLayerRegistryRegistersCustomLayers(t *testing.T) {
+	var seen *http.Request
+	reg := transport.NewLayerRegistry()
+	reg.Register("static_header", func(o *transport.LayerOptions) (func(http.RoundTripper) http.RoundTripper, error) {
+		name, value := o.String("name", ""), o.String("value", "")
+		if name == "" {
+			return nil, errors.New(`option "name" is required`)
+		}
+		return func(next http.RoundTripper) http.RoundTripper {
+			return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				req = req.Clone(req.Context())
+				req.Header.Set(name, value)
+				return next.RoundTrip(req)
+			})
+		}, nil
+	})
+	assert.Contains(t, reg.Layers(), "static_header")
+
+	b, err := reg.Apply(nil, transport.PipelineConfig{Layers: []transport.LayerConfig{
+		{Type: "static_header", Options: map[string]string{"name": "X-Client", "value": "crawler"}},
+	}})
+	require.NoError(t, err)
+
+	rt := b.Use(func(http.RoundTripper) http.RoundTripper { return captureRequest(&seen) }).Build()
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com", nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "crawler", seen.Header.Get("X-Client"))
+}
@@ -20,6 +20,17 @@ type ScrapingPresetOptions struct {
 	HostRate  rate.Limit
 	HostBurst int
 	Retry     RetryOptions
+	// CircuitBreaker, se valorizzato, aggiunge un circuit breaker per host
+	// come layer piu' esterno del preset.
+	CircuitBreaker *CircuitBreakerOptions
+	// Session, se valorizzato, aggiunge un cookie jar per host subito prima
+	// del profilo browser sticky, cosi' cookie e profilo restano coerenti.
+	Session *SessionOptions
+	// Robots, se valorizzato, rispetta il robots.txt di ogni host. Il layer
+	// viene registrato dopo il profilo browser sticky, cosi' sceglie le regole
+	// con lo user agent effettivamente inviato, e il Crawl-delay rallenta il
+	// limiter per host.
+	Robots *RobotsOptions
 }
 
 // ForDebug applica al builder i layer tipici per debugging e tracing locale:
@@ -89,16 +100,58 @@ func ForScrapingWithOptions(b *TransportBuilder, opts ScrapingPresetOptions) *Tr
 	}
 	opts.Retry = withDefaultScrapingRetryOptions(opts.Retry)
 
-	return b.
+	if opts.CircuitBreaker != nil {
+		// Il breaker sta prima del limiter: con il circuito aperto la richiesta
+		// fallisce subito, senza attendere il proprio turno.
+		cb := *opts.CircuitBreaker
+		b = b.Use(func(next http.RoundTripper) http.RoundTripper {
+			return CircuitBreakerRoundTripper(next, cb)
+		})
+	}
+
+	limiter := HostLimiterOptions{Rate: opts.HostRate, Burst: opts.HostBurst}
+	var robots RobotsOptions
+	if opts.Robots != nil {
+		delays := &crawlDelays{}
+		limiter.HostRate = delays.rate
+
+		robots = *opts.Robots
+		onCrawlDelay := robots.OnCrawlDelay
+		robots.OnCrawlDelay = func(host string, delay time.Duration) {
+			delays.set(host, delay)
+			if onCrawlDelay != nil {
+				onCrawlDelay(host, delay)
+			}
+		}
+	}
+
+	b = b.
 		Use(func(next http.RoundTripper) http.RoundTripper {
-			return HostLimiter(opts.HostRate, opts.HostBurst, next)
+			return HostLimiterWithOptions(next, limiter)
 		}).
 		Use(func(next http.RoundTripper) http.RoundTripper {
 			return RetryRoundTripper(next, opts.Retry)
-		}).
+		})
+
+	if opts.Session != nil {
+		session := *opts.Session
+		b = b.Use(func(next http.RoundTripper) http.RoundTripper {
+			return SessionRoundTripper(next, session)
+		})
+	}
+
+	b = b.
 		Use(func(next http.RoundTripper) http.RoundTripper {
 			return StickyBrowserRoundTripper(next)
 		})
+
+	if opts.Robots != nil {
+		b = b.Use(func(next http.RoundTripper) http.RoundTripper {
+			return RobotsRoundTripper(next, robots)
+		})
+	}
+
+	return b
 }
 
 func withDefaultScrapingRetryOptions(opts RetryOptions) RetryOptions {
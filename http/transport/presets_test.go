@@ -1,7 +1,9 @@
 package transport_test
 
 import (
+	"io"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
@@ -166,3 +168,43 @@ func TestForScrapingWithOptionsSupportsPOSTRetry(t *testing.T) {
 	assert.Equal(t, 2, calls)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 }
+
+func TestForScrapingWithOptionsHonorsRobotsCrawlDelay(t *testing.T) {
+	var (
+		fetched []time.Time
+		delays  []time.Duration
+	)
+	builder := transport.ForScrapingWithOptions(nil, transport.ScrapingPresetOptions{
+		HostRate:  rate.Inf,
+		HostBurst: 10,
+		Robots: &transport.RobotsOptions{
+			OnCrawlDelay: func(_ string, delay time.Duration) { delays = append(delays, delay) },
+		},
+	}).Use(func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody, Request: req}
+			switch req.URL.Path {
+			case "/robots.txt":
+				resp.Body = io.NopCloser(strings.NewReader("User-agent: *\nDisallow: /admin\nCrawl-delay: 0.2\n"))
+			default:
+				assert.NotEmpty(t, req.Header.Get("User-Agent"))
+				fetched = append(fetched, time.Now())
+			}
+			return resp, nil
+		})
+	})
+	rt := builder.Build()
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com"+path, nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	_, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/admin", nil))
+	assert.ErrorIs(t, err, transport.ErrRobotsDisallowed)
+
+	require.Len(t, fetched, 3)
+	assert.Len(t, delays, 4)
+	// La prima richiesta scopre il Crawl-delay, le successive lo rispettano.
+	assert.GreaterOrEqual(t, fetched[2].Sub(fetched[1]), 150*time.Millisecond)
+}
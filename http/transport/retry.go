@@ -2,10 +2,14 @@ package transport
 
 import (
 	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
 	"net/http"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,6 +28,132 @@ type RetryOptions struct {
 	MaxDelay time.Duration
 	// RetryOnError abilita il retry anche sugli errori restituiti dal transport.
 	RetryOnError bool
+	// Backoff calcola il ritardo tra i tentativi quando la risposta non espone
+	// Retry-After. Se nil usa [ConstantBackoff].
+	Backoff BackoffFunc
+	// Budget, se valorizzato, limita i retry rispetto alle richieste. Lo stesso
+	// budget puo' essere condiviso tra piu' transport.
+	Budget *RetryBudget
+	// ShouldRetry, se valorizzato, sostituisce StatusCodes e RetryOnError nel
+	// decidere se un esito merita un nuovo tentativo. Riceve la risposta
+	// oppure l'errore del tentativo.
+	ShouldRetry func(resp *http.Response, err error) bool
+	// OnRetry, se valorizzato, viene invocato prima di ogni attesa.
+	OnRetry func(RetryEvent)
+}
+
+type retryAttemptKey struct{}
+
+// RetryAttempt restituisce il numero del tentativo in corso (da 1) per le
+// richieste inoltrate da [RetryRoundTripper], oppure 0 se la richiesta non
+// passa da un retry. I layer registrati dopo il retry (piu' vicini al
+// transport base) vedono cosi' ogni singolo tentativo.
+func RetryAttempt(ctx context.Context) int {
+	n, _ := ctx.Value(retryAttemptKey{}).(int)
+	return n
+}
+
+// RetryEvent descrive un retry in procinto di essere eseguito.
+type RetryEvent struct {
+	Request *http.Request
+	// Attempt e' il numero del tentativo che sta per partire (da 2 in su).
+	Attempt int
+	// Response e' la risposta che ha causato il retry, con il body gia'
+	// chiuso; nil se il tentativo e' fallito con Err.
+	Response *http.Response
+	Err      error
+	Delay    time.Duration
+}
+
+// BackoffFunc calcola l'attesa prima del tentativo successivo a attempt
+// (1 = richiesta iniziale). prev e' l'attesa usata al giro precedente, zero
+// al primo retry. Il risultato viene comunque limitato a MaxDelay.
+type BackoffFunc func(attempt int, prev, base, maxDelay time.Duration) time.Duration
+
+// ConstantBackoff attende sempre base.
+func ConstantBackoff(_ int, _, base, _ time.Duration) time.Duration {
+	return base
+}
+
+// ExponentialBackoff raddoppia l'attesa a ogni tentativo: base, 2*base,
+// 4*base... fino a maxDelay. Senza maxDelay l'attesa e' comunque limitata
+// alla massima [time.Duration].
+func ExponentialBackoff(attempt int, _, base, maxDelay time.Duration) time.Duration {
+	d := float64(base) * math.Pow(2, float64(attempt-1))
+	if maxDelay > 0 && d > float64(maxDelay) {
+		return maxDelay
+	}
+	if d >= math.MaxInt64 {
+		// la conversione di un float fuori intervallo non e' definita
+		return math.MaxInt64
+	}
+	return time.Duration(d)
+}
+
+// DecorrelatedJitterBackoff sceglie un'attesa casuale tra base e il triplo
+// dell'attesa precedente, evitando che molti client ritentino in sincrono.
+func DecorrelatedJitterBackoff(_ int, prev, base, maxDelay time.Duration) time.Duration {
+	if prev < base {
+		prev = base
+	}
+	upper := 3 * prev
+	if maxDelay > 0 && upper > maxDelay {
+		upper = maxDelay
+	}
+	if upper <= base {
+		return base
+	}
+	return base + rand.N(upper-base)
+}
+
+// RetryBudget e' un token bucket che limita il rapporto tra retry e
+// richieste: ogni richiesta deposita ratio token, ogni retry ne consuma uno.
+// Il bucket parte pieno, cosi' sono ammessi fino a burst retry iniziali.
+type RetryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	burst  float64
+	tokens float64
+}
+
+// NewRetryBudget crea un budget che ammette a regime al massimo ratio retry
+// per richiesta (es. 0.1 = un retry ogni dieci richieste) con una riserva di
+// burst retry. Se burst <= 0 usa 10.
+func NewRetryBudget(ratio float64, burst int) *RetryBudget {
+	if ratio < 0 {
+		ratio = 0
+	}
+	if burst <= 0 {
+		burst = 10
+	}
+	return &RetryBudget{
+		ratio:  ratio,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// Available restituisce i token attualmente disponibili.
+func (b *RetryBudget) Available() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens
+}
+
+func (b *RetryBudget) deposit() {
+	b.mu.Lock()
+	b.tokens = min(b.tokens+b.ratio, b.burst)
+	b.mu.Unlock()
+}
+
+func (b *RetryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
 }
 
 // RetryRoundTripper applica retry configurabili su status code specifici
@@ -46,6 +176,9 @@ func RetryRoundTripper(next http.RoundTripper, opts RetryOptions) http.RoundTrip
 	if opts.MaxDelay <= 0 {
 		opts.MaxDelay = 5 * time.Second
 	}
+	if opts.Backoff == nil {
+		opts.Backoff = ConstantBackoff
+	}
 
 	return &retryTransport{
 		next: next,
@@ -56,6 +189,10 @@ func RetryRoundTripper(next http.RoundTripper, opts RetryOptions) http.RoundTrip
 			BaseDelay:    opts.BaseDelay,
 			MaxDelay:     opts.MaxDelay,
 			RetryOnError: opts.RetryOnError,
+			Backoff:      opts.Backoff,
+			Budget:       opts.Budget,
+			ShouldRetry:  opts.ShouldRetry,
+			OnRetry:      opts.OnRetry,
 		},
 	}
 }
@@ -76,46 +213,64 @@ func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 		return t.next.RoundTrip(req)
 	}
 
-	var lastResp *http.Response
-	var lastErr error
+	if t.opts.Budget != nil {
+		t.opts.Budget.deposit()
+	}
 
-	for attempt := 1; attempt <= t.opts.MaxAttempts; attempt++ {
+	var prevDelay time.Duration
+	for attempt := 1; ; attempt++ {
 		currentReq, err := requestForAttempt(req, attempt)
 		if err != nil {
 			return nil, err
 		}
+		currentReq = currentReq.WithContext(context.WithValue(currentReq.Context(), retryAttemptKey{}, attempt))
 
 		resp, err := t.next.RoundTrip(currentReq)
-		if err != nil {
-			lastErr = err
-			if !t.opts.RetryOnError || attempt == t.opts.MaxAttempts {
-				return nil, err
-			}
-
-			if err := waitForRetry(currentReq.Context(), t.opts.BaseDelay, t.opts.MaxDelay); err != nil {
-				return nil, err
-			}
-			continue
+		if attempt == t.opts.MaxAttempts || !t.shouldRetry(resp, err) {
+			return resp, err
+		}
+		if t.opts.Budget != nil && !t.opts.Budget.withdraw() {
+			// Budget esaurito: restituiamo l'esito cosi' com'e'.
+			return resp, err
 		}
 
-		lastResp = resp
-		lastErr = nil
-
-		if !slices.Contains(t.opts.StatusCodes, resp.StatusCode) || attempt == t.opts.MaxAttempts {
-			return resp, nil
+		delay := retryDelay(resp, 0, t.opts.MaxDelay)
+		if delay <= 0 {
+			delay = min(t.opts.Backoff(attempt, prevDelay, t.opts.BaseDelay, t.opts.MaxDelay), t.opts.MaxDelay)
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if t.opts.OnRetry != nil {
+			t.opts.OnRetry(RetryEvent{
+				Request:  req,
+				Attempt:  attempt + 1,
+				Response: resp,
+				Err:      err,
+				Delay:    delay,
+			})
 		}
 
-		delay := retryDelay(resp, t.opts.BaseDelay, t.opts.MaxDelay)
-		resp.Body.Close()
 		if err := waitForRetry(currentReq.Context(), delay, t.opts.MaxDelay); err != nil {
 			return nil, err
 		}
+		prevDelay = delay
 	}
+}
 
-	if lastResp != nil {
-		return lastResp, nil
+// shouldRetry decide se l'esito di un tentativo merita un retry.
+func (t *retryTransport) shouldRetry(resp *http.Response, err error) bool {
+	if t.opts.ShouldRetry != nil {
+		return t.opts.ShouldRetry(resp, err)
+	}
+	if err != nil {
+		// Con il circuito aperto o un path vietato da robots.txt un retry
+		// immediato fallirebbe allo stesso modo.
+		return t.opts.RetryOnError &&
+			!errors.Is(err, ErrCircuitOpen) &&
+			!errors.Is(err, ErrRobotsDisallowed)
 	}
-	return nil, lastErr
+	return slices.Contains(t.opts.StatusCodes, resp.StatusCode)
 }
 
 func canRetryRequest(req *http.Request) bool {
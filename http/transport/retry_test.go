@@ -2,6 +2,7 @@ package transport_test
 
 import (
 	"io"
+	"math"
 	"net/http"
 	"strings"
 	"sync/atomic"
@@ -92,3 +93,101 @@ func TestRetryRoundTripperDoesNotRetryNonReplayableBody(t *testing.T) {
 	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
 	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
 }
+
+func TestBackoffStrategies(t *testing.T) {
+	base, maxDelay := 100*time.Millisecond, time.Second
+
+	assert.Equal(t, base, transport.ConstantBackoff(3, 0, base, maxDelay))
+
+	assert.Equal(t, 100*time.Millisecond, transport.ExponentialBackoff(1, 0, base, maxDelay))
+	assert.Equal(t, 400*time.Millisecond, transport.ExponentialBackoff(3, 0, base, maxDelay))
+	assert.Equal(t, maxDelay, transport.ExponentialBackoff(10, 0, base, maxDelay))
+	assert.Equal(t, time.Duration(math.MaxInt64), transport.ExponentialBackoff(100, 0, base, 0))
+	assert.Equal(t, time.Duration(math.MaxInt64), transport.ExponentialBackoff(5000, 0, base, 0))
+
+	prev := time.Duration(0)
+	for i := 1; i <= 20; i++ {
+		d := transport.DecorrelatedJitterBackoff(i, prev, base, maxDelay)
+		assert.GreaterOrEqual(t, d, base)
+		assert.LessOrEqual(t, d, maxDelay)
+		assert.LessOrEqual(t, d, 3*max(prev, base))
+		prev = d
+	}
+}
+
+func TestRetryRoundTripperShouldRetryAndOnRetry(t *testing.T) {
+	var calls int32
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"X-Status": {"pending"}},
+				Request:    req,
+				Body:       http.NoBody,
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"X-Status": {"done"}},
+			Request:    req,
+			Body:       http.NoBody,
+		}, nil
+	})
+
+	var events []transport.RetryEvent
+	rt := transport.RetryRoundTripper(upstream, transport.RetryOptions{
+		MaxAttempts: 5,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    10 * time.Millisecond,
+		Backoff:     transport.ExponentialBackoff,
+		ShouldRetry: func(resp *http.Response, err error) bool {
+			return err == nil && resp.Header.Get("X-Status") == "pending"
+		},
+		OnRetry: func(ev transport.RetryEvent) {
+			events = append(events, ev)
+		},
+	})
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com", nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, "done", resp.Header.Get("X-Status"))
+	require.Len(t, events, 2)
+	assert.Equal(t, 2, events[0].Attempt)
+	assert.Equal(t, time.Millisecond, events[0].Delay)
+	assert.Equal(t, 3, events[1].Attempt)
+	assert.Equal(t, 2*time.Millisecond, events[1].Delay)
+}
+
+func TestRetryRoundTripperBudget(t *testing.T) {
+	var calls int32
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     make(http.Header),
+			Request:    req,
+			Body:       http.NoBody,
+		}, nil
+	})
+
+	budget := transport.NewRetryBudget(0, 2)
+	rt := transport.RetryRoundTripper(upstream, transport.RetryOptions{
+		MaxAttempts: 3,
+		StatusCodes: []int{http.StatusServiceUnavailable},
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    time.Millisecond,
+		Budget:      budget,
+	})
+
+	for i := 0; i < 3; i++ {
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com", nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	// 3 richieste iniziali + 2 retry consentiti dal budget
+	assert.Equal(t, int32(5), atomic.LoadInt32(&calls))
+	assert.Equal(t, float64(0), budget.Available())
+}
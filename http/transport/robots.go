@@ -0,0 +1,396 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucasepe/x/log"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// robotsMaxSize e' il limite di parsing imposto da RFC 9309.
+	robotsMaxSize = 500 << 10
+	// robotsMaxRedirects e' il numero di redirect seguiti per robots.txt.
+	robotsMaxRedirects = 5
+	// robotsErrorTTL e' quanto resta in cache un robots.txt irraggiungibile
+	// prima di un nuovo tentativo.
+	robotsErrorTTL = time.Minute
+)
+
+// ErrRobotsDisallowed e' l'errore sentinella restituito (tramite
+// [*RobotsDisallowedError]) quando robots.txt vieta la URL richiesta.
+var ErrRobotsDisallowed = errors.New("disallowed by robots.txt")
+
+// RobotsDisallowedError descrive una richiesta bloccata senza contattare
+// l'host. Soddisfa errors.Is(err, ErrRobotsDisallowed).
+type RobotsDisallowedError struct {
+	URL string
+	// UserAgent e' lo user agent usato per scegliere il gruppo di regole.
+	UserAgent string
+}
+
+func (e *RobotsDisallowedError) Error() string {
+	return fmt.Sprintf("%s: %v (user agent %q)", e.URL, ErrRobotsDisallowed, e.UserAgent)
+}
+
+func (e *RobotsDisallowedError) Unwrap() error {
+	return ErrRobotsDisallowed
+}
+
+// RobotsOptions configura [RobotsRoundTripper].
+type RobotsOptions struct {
+	// UserAgent, se valorizzato, e' il token usato per scegliere il gruppo di
+	// regole. Se vuoto usa lo User-Agent della richiesta.
+	UserAgent string
+	// TTL e' quanto resta in cache il robots.txt di un host. Se <= 0 usa 24h.
+	TTL time.Duration
+	// OnCrawlDelay, se valorizzato, riceve il Crawl-delay del gruppo scelto
+	// per l'host a ogni richiesta che ne ha uno.
+	OnCrawlDelay func(host string, delay time.Duration)
+}
+
+// RobotsRoundTripper scarica, interpreta e tiene in cache il robots.txt di
+// ogni host (RFC 9309) e blocca con [*RobotsDisallowedError] le URL vietate.
+// Un robots.txt assente (4xx) consente tutto; uno irraggiungibile (5xx o
+// errore di rete) vieta tutto finche' non viene riscaricato.
+//
+// Il gruppo di regole e' quello il cui user-agent compare, senza distinzione
+// tra maiuscole e minuscole, nello User-Agent della richiesta (vince il
+// token piu' lungo), altrimenti il gruppo "*". Registrato dopo
+// [StickyBrowserRoundTripper] usa quindi lo user agent del profilo scelto.
+func RobotsRoundTripper(next http.RoundTripper, opts RobotsOptions) http.RoundTripper {
+	if next == nil {
+		next = Default()
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 24 * time.Hour
+	}
+
+	return &robotsTransport{
+		next:    next,
+		opts:    opts,
+		entries: make(map[string]*robotsEntry),
+	}
+}
+
+type robotsTransport struct {
+	next http.RoundTripper
+	opts RobotsOptions
+
+	mu      sync.Mutex
+	entries map[string]*robotsEntry // origin -> robots.txt
+}
+
+// robotsEntry e' il robots.txt di un'origine; done viene chiuso quando il
+// download e' terminato.
+type robotsEntry struct {
+	done    chan struct{}
+	file    *robotsFile
+	expires time.Time
+}
+
+func (t *robotsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path == "/robots.txt" {
+		return t.next.RoundTrip(req)
+	}
+
+	userAgent := t.opts.UserAgent
+	if userAgent == "" {
+		userAgent = req.Header.Get("User-Agent")
+	}
+
+	file, err := t.robotsFor(req, userAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	group := file.group(userAgent)
+	if group.crawlDelay > 0 && t.opts.OnCrawlDelay != nil {
+		t.opts.OnCrawlDelay(req.URL.Host, group.crawlDelay)
+	}
+	if !group.allowed(robotsPath(req)) {
+		return nil, &RobotsDisallowedError{URL: req.URL.Redacted(), UserAgent: userAgent}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// robotsFor restituisce il robots.txt dell'origine della richiesta,
+// scaricandolo una sola volta anche con richieste concorrenti.
+func (t *robotsTransport) robotsFor(req *http.Request, userAgent string) (*robotsFile, error) {
+	origin := req.URL.Scheme + "://" + req.URL.Host
+
+	t.mu.Lock()
+	e, ok := t.entries[origin]
+	if !ok || (!e.expires.IsZero() && time.Now().After(e.expires)) {
+		e = &robotsEntry{done: make(chan struct{})}
+		t.entries[origin] = e
+		t.mu.Unlock()
+
+		// Il download non dipende dal context del singolo chiamante: altre
+		// richieste potrebbero attenderne l'esito.
+		go t.fetch(context.WithoutCancel(req.Context()), origin, userAgent, e)
+	} else {
+		t.mu.Unlock()
+	}
+
+	select {
+	case <-e.done:
+		return e.file, nil
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+}
+
+func (t *robotsTransport) fetch(ctx context.Context, origin, userAgent string, e *robotsEntry) {
+	file, ttl := t.download(ctx, origin, userAgent)
+
+	t.mu.Lock()
+	e.file = file
+	e.expires = time.Now().Add(ttl)
+	t.mu.Unlock()
+	close(e.done)
+}
+
+// download scarica robots.txt seguendo i redirect e restituisce le regole
+// con la relativa durata in cache.
+func (t *robotsTransport) download(ctx context.Context, origin, userAgent string) (*robotsFile, time.Duration) {
+	target := origin + "/robots.txt"
+
+	for range robotsMaxRedirects + 1 {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return unreachableRobots(target, err)
+		}
+		if userAgent != "" {
+			req.Header.Set("User-Agent", userAgent)
+		}
+
+		resp, err := t.next.RoundTrip(req)
+		if err != nil {
+			return unreachableRobots(target, err)
+		}
+
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			data, err := io.ReadAll(io.LimitReader(resp.Body, robotsMaxSize))
+			resp.Body.Close()
+			if err != nil {
+				return unreachableRobots(target, err)
+			}
+			return parseRobots(data), t.opts.TTL
+
+		case resp.StatusCode >= 300 && resp.StatusCode < 400:
+			loc, err := resp.Location()
+			resp.Body.Close()
+			if err != nil {
+				return &robotsFile{}, t.opts.TTL
+			}
+			target = loc.String()
+
+		case resp.StatusCode >= 400 && resp.StatusCode < 500:
+			resp.Body.Close()
+			return &robotsFile{}, t.opts.TTL
+
+		default:
+			resp.Body.Close()
+			return unreachableRobots(target, fmt.Errorf("unexpected status %d", resp.StatusCode))
+		}
+	}
+
+	// Troppi redirect: RFC 9309 tratta il file come non disponibile.
+	return &robotsFile{}, t.opts.TTL
+}
+
+// unreachableRobots vieta tutto, come richiesto da RFC 9309 quando il file
+// non e' raggiungibile, per un periodo breve.
+func unreachableRobots(target string, err error) (*robotsFile, time.Duration) {
+	log.E("unable to fetch robots.txt",
+		log.String("url", target),
+		log.Err("err", err),
+	)
+	return &robotsFile{
+		groups: []robotsGroup{{
+			agents: []string{"*"},
+			rules:  []robotsRule{{pattern: "/"}},
+		}},
+	}, robotsErrorTTL
+}
+
+// robotsPath restituisce path e query usati per il confronto con le regole.
+func robotsPath(req *http.Request) string {
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if req.URL.RawQuery != "" {
+		path += "?" + req.URL.RawQuery
+	}
+	return path
+}
+
+type robotsFile struct {
+	groups []robotsGroup
+}
+
+type robotsGroup struct {
+	agents     []string // token in minuscolo
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+// parseRobots interpreta robots.txt in modo tollerante: le righe non
+// riconosciute vengono ignorate.
+func parseRobots(data []byte) *robotsFile {
+	f := &robotsFile{}
+	current := -1
+	inAgents := false
+
+	for line := range strings.SplitSeq(string(data), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			// Righe user-agent consecutive appartengono allo stesso gruppo.
+			if !inAgents {
+				f.groups = append(f.groups, robotsGroup{})
+				current = len(f.groups) - 1
+			}
+			f.groups[current].agents = append(f.groups[current].agents, strings.ToLower(value))
+			inAgents = true
+
+		case "allow", "disallow":
+			inAgents = false
+			if current < 0 || value == "" {
+				continue
+			}
+			f.groups[current].rules = append(f.groups[current].rules, robotsRule{
+				allow:   key == "allow",
+				pattern: value,
+			})
+
+		case "crawl-delay":
+			inAgents = false
+			if current < 0 {
+				continue
+			}
+			if secs, err := strconv.ParseFloat(value, 64); err == nil && secs > 0 {
+				f.groups[current].crawlDelay = time.Duration(secs * float64(time.Second))
+			}
+		}
+	}
+	return f
+}
+
+// group unisce i gruppi che valgono per lo user agent.
+func (f *robotsFile) group(userAgent string) robotsGroup {
+	userAgent = strings.ToLower(userAgent)
+
+	best := "*"
+	for _, g := range f.groups {
+		for _, agent := range g.agents {
+			if agent != "*" && agent != "" && strings.Contains(userAgent, agent) &&
+				(best == "*" || len(agent) > len(best)) {
+				best = agent
+			}
+		}
+	}
+
+	var out robotsGroup
+	for _, g := range f.groups {
+		if !slices.Contains(g.agents, best) {
+			continue
+		}
+		out.rules = append(out.rules, g.rules...)
+		out.crawlDelay = max(out.crawlDelay, g.crawlDelay)
+	}
+	return out
+}
+
+// allowed applica la regola piu' specifica (pattern piu' lungo); a parita'
+// vince Allow.
+func (g robotsGroup) allowed(path string) bool {
+	allow, best := true, -1
+	for _, r := range g.rules {
+		if !robotsMatch(r.pattern, path) {
+			continue
+		}
+		if n := len(r.pattern); n > best || (n == best && r.allow) {
+			allow, best = r.allow, n
+		}
+	}
+	return allow
+}
+
+// robotsMatch confronta un pattern con i caratteri speciali '*' (qualsiasi
+// sequenza) e '$' (fine del path).
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = pattern[:len(pattern)-1]
+	}
+
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	pos := len(parts[0])
+
+	for i, part := range parts[1:] {
+		if anchored && i == len(parts)-2 {
+			return len(path)-pos >= len(part) && strings.HasSuffix(path, part)
+		}
+		j := strings.Index(path[pos:], part)
+		if j < 0 {
+			return false
+		}
+		pos += j + len(part)
+	}
+	return !anchored || pos == len(path)
+}
+
+// crawlDelays raccoglie i Crawl-delay per host e li espone come rate per
+// [HostLimiterOptions.HostRate].
+type crawlDelays struct {
+	mu     sync.Mutex
+	delays map[string]time.Duration
+}
+
+func (c *crawlDelays) set(host string, delay time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.delays == nil {
+		c.delays = make(map[string]time.Duration)
+	}
+	c.delays[host] = delay
+}
+
+func (c *crawlDelays) rate(host string) rate.Limit {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d := c.delays[host]; d > 0 {
+		return rate.Every(d)
+	}
+	return 0
+}
@@ -0,0 +1,151 @@
+package transport_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lucasepe/x/http/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// robotsUpstream serve robots.txt con lo stato e il contenuto indicati e
+// risponde 200 a ogni altra richiesta.
+func robotsUpstream(status int, body string, fetches *int32) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/robots.txt" {
+			return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+		}
+		if fetches != nil {
+			atomic.AddInt32(fetches, 1)
+		}
+		return &http.Response{
+			StatusCode: status,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    req,
+		}, nil
+	})
+}
+
+func robotsGet(rt http.RoundTripper, t *testing.T, url, userAgent string) error {
+	req := mustRequest(t, http.MethodGet, url, nil)
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	resp, err := rt.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+const robotsExample = `# example
+User-agent: *
+Disallow: /private/
+Allow: /private/public*
+Disallow: /*.pdf$
+Disallow: /search?q=
+
+User-agent: scraperbot
+User-agent: otherbot
+Disallow: /
+Crawl-delay: 2.5
+`
+
+func TestRobotsRoundTripperAppliesRules(t *testing.T) {
+	rt := transport.RobotsRoundTripper(robotsUpstream(http.StatusOK, robotsExample, nil), transport.RobotsOptions{})
+
+	cases := map[string]bool{
+		"https://example.com/":                      true,
+		"https://example.com/private/data":          false,
+		"https://example.com/private/public/a.html": true,
+		"https://example.com/docs/manual.pdf":       false,
+		"https://example.com/docs/manual.pdf?x=1":   true,
+		"https://example.com/search?q=go":           false,
+		"https://example.com/search":                true,
+	}
+	for url, allowed := range cases {
+		err := robotsGet(rt, t, url, "Mozilla/5.0")
+		if allowed {
+			assert.NoError(t, err, url)
+			continue
+		}
+		var disallowed *transport.RobotsDisallowedError
+		require.ErrorAs(t, err, &disallowed, url)
+		assert.ErrorIs(t, err, transport.ErrRobotsDisallowed)
+		assert.Equal(t, url, disallowed.URL)
+	}
+}
+
+func TestRobotsRoundTripperMatchesUserAgentGroup(t *testing.T) {
+	var delays []time.Duration
+	rt := transport.RobotsRoundTripper(robotsUpstream(http.StatusOK, robotsExample, nil), transport.RobotsOptions{
+		OnCrawlDelay: func(host string, delay time.Duration) {
+			assert.Equal(t, "example.com", host)
+			delays = append(delays, delay)
+		},
+	})
+
+	assert.ErrorIs(t, robotsGet(rt, t, "https://example.com/", "Mozilla/5.0 (compatible; ScraperBot/1.0)"), transport.ErrRobotsDisallowed)
+	assert.NoError(t, robotsGet(rt, t, "https://example.com/", "Mozilla/5.0 (X11; Linux x86_64)"))
+	assert.Equal(t, []time.Duration{2500 * time.Millisecond}, delays)
+
+	pinned := transport.RobotsRoundTripper(robotsUpstream(http.StatusOK, robotsExample, nil), transport.RobotsOptions{
+		UserAgent: "otherbot",
+	})
+	assert.ErrorIs(t, robotsGet(pinned, t, "https://example.com/", "Mozilla/5.0"), transport.ErrRobotsDisallowed)
+}
+
+func TestRobotsRoundTripperMissingAndUnreachableFiles(t *testing.T) {
+	missing := transport.RobotsRoundTripper(robotsUpstream(http.StatusNotFound, "", nil), transport.RobotsOptions{})
+	assert.NoError(t, robotsGet(missing, t, "https://example.com/anything", ""))
+
+	broken := transport.RobotsRoundTripper(robotsUpstream(http.StatusServiceUnavailable, "", nil), transport.RobotsOptions{})
+	assert.ErrorIs(t, robotsGet(broken, t, "https://example.com/anything", ""), transport.ErrRobotsDisallowed)
+
+	failing := transport.RobotsRoundTripper(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	}), transport.RobotsOptions{})
+	assert.ErrorIs(t, robotsGet(failing, t, "https://example.com/anything", ""), transport.ErrRobotsDisallowed)
+}
+
+func TestRobotsRoundTripperFollowsRedirects(t *testing.T) {
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		header := make(http.Header)
+		switch req.URL.Host + req.URL.Path {
+		case "example.com/robots.txt":
+			header.Set("Location", "https://www.example.com/robots.txt")
+			return &http.Response{StatusCode: http.StatusMovedPermanently, Header: header, Body: http.NoBody, Request: req}, nil
+		case "www.example.com/robots.txt":
+			return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(strings.NewReader("User-agent: *\nDisallow: /admin")), Request: req}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: header, Body: http.NoBody, Request: req}, nil
+	})
+
+	rt := transport.RobotsRoundTripper(upstream, transport.RobotsOptions{})
+	assert.ErrorIs(t, robotsGet(rt, t, "https://example.com/admin/users", ""), transport.ErrRobotsDisallowed)
+	assert.NoError(t, robotsGet(rt, t, "https://example.com/home", ""))
+}
+
+func TestRobotsRoundTripperFetchesOncePerOrigin(t *testing.T) {
+	var fetches int32
+	rt := transport.RobotsRoundTripper(robotsUpstream(http.StatusOK, robotsExample, &fetches), transport.RobotsOptions{})
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			assert.NoError(t, robotsGet(rt, t, "https://example.com/", ""))
+		})
+	}
+	wg.Wait()
+	require.NoError(t, robotsGet(rt, t, "http://example.com/", ""))
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches), "one fetch per scheme and host")
+}
@@ -0,0 +1,458 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucasepe/x/filecache"
+	"github.com/lucasepe/x/log"
+	"golang.org/x/net/publicsuffix"
+)
+
+// SessionOptions controlla dove il transport di sessione persiste cookie e
+// identita' dei singoli host. Se sia Dir sia Cache sono vuoti la sessione
+// vive solo in memoria.
+type SessionOptions struct {
+	// Dir e' la directory in cui salvare un file JSON per dominio.
+	Dir string
+	// Cache, in alternativa a Dir, salva i dati nel file cache con chiavi
+	// "session:<dominio>". I file del cache hanno i permessi decisi dal
+	// package filecache e possono essere leggibili da altri utenti: per
+	// conservare cookie di autenticazione usare Dir, che scrive con 0600.
+	Cache *filecache.FileCacheFS
+	// PublicSuffixList impedisce i cookie con Domain uguale a un suffisso
+	// pubblico (es. "co.uk"), che altrimenti verrebbero inviati a tutti i
+	// siti sotto quel suffisso. Se nil usa publicsuffix.List di
+	// golang.org/x/net.
+	PublicSuffixList cookiejar.PublicSuffixList
+}
+
+// SessionRoundTripper mantiene un cookie jar per host, come farebbe un
+// browser: i cookie ricevuti con Set-Cookie vengono rimandati alle richieste
+// successive verso lo stesso host (o i suoi sottodomini, per i cookie con
+// attributo Domain), anche tra i salti di un redirect gestito da
+// [http.Client]. Con Dir o Cache il jar sopravvive al processo.
+//
+// La sessione ricorda anche lo User-Agent usato con ogni host e lo
+// ripropone alle richieste che non ne hanno uno: registrata prima di
+// [StickyBrowserRoundTripper], fa si' che un host ritrovi lo stesso profilo
+// browser insieme ai propri cookie anche dopo un riavvio.
+//
+// Il client non deve avere un proprio Jar, altrimenti i cookie verrebbero
+// gestiti due volte.
+func SessionRoundTripper(next http.RoundTripper, opts SessionOptions) http.RoundTripper {
+	if next == nil {
+		next = Default()
+	}
+
+	var store sessionStore = memorySessionStore{}
+	switch {
+	case opts.Cache != nil:
+		store = cacheSessionStore{cache: opts.Cache}
+	case opts.Dir != "":
+		store = dirSessionStore{dir: opts.Dir}
+	}
+
+	psl := opts.PublicSuffixList
+	if psl == nil {
+		psl = publicsuffix.List
+	}
+
+	return &sessionTransport{
+		next:    next,
+		store:   store,
+		psl:     psl,
+		records: make(map[string]*sessionRecord),
+	}
+}
+
+// sessionCookie e' la forma persistita di un cookie.
+type sessionCookie struct {
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Path     string    `json:"path"`
+	HostOnly bool      `json:"host_only,omitempty"`
+	Secure   bool      `json:"secure,omitempty"`
+	HttpOnly bool      `json:"http_only,omitempty"`
+	Expires  time.Time `json:"expires,omitzero"`
+}
+
+func (c *sessionCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !now.Before(c.Expires)
+}
+
+// sessionRecord raccoglie i dati di un dominio: i cookie con quel dominio e,
+// se il dominio e' stato contattato direttamente, lo User-Agent usato.
+type sessionRecord struct {
+	UserAgent string          `json:"user_agent,omitempty"`
+	Cookies   []sessionCookie `json:"cookies,omitempty"`
+
+	// saveMu serializza i salvataggi del record, cosi' l'ultimo a scrivere
+	// e' sempre lo stato piu' recente.
+	saveMu sync.Mutex
+}
+
+type sessionTransport struct {
+	next  http.RoundTripper
+	store sessionStore
+	psl   cookiejar.PublicSuffixList
+
+	// mu protegge solo la mappa in memoria: letture e scritture dello store
+	// avvengono fuori dal lock, per non serializzare le richieste verso host
+	// diversi.
+	mu      sync.Mutex
+	records map[string]*sessionRecord // dominio -> record, caricati lazy
+}
+
+func (t *sessionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := canonicalCookieHost(req.URL.Hostname())
+	domains := t.cookieDomains(host)
+	t.load(domains)
+
+	req = cloneRequest(req)
+	t.mu.Lock()
+	if cookie := t.cookieHeaderLocked(req.URL, host, domains); cookie != "" {
+		if prev := req.Header.Get("Cookie"); prev != "" {
+			cookie = prev + "; " + cookie
+		}
+		req.Header.Set("Cookie", cookie)
+	}
+	if req.Header.Get("User-Agent") == "" {
+		if ua := t.recordLocked(host).UserAgent; ua != "" {
+			req.Header.Set("User-Agent", ua)
+		}
+	}
+	t.mu.Unlock()
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// resp.Request e' la richiesta arrivata al transport base: contiene lo
+	// User-Agent eventualmente scelto dai layer successivi.
+	sent := req
+	if resp.Request != nil {
+		sent = resp.Request
+	}
+
+	t.mu.Lock()
+	changed := t.setCookiesLocked(req.URL, host, resp.Cookies())
+	if ua := sent.Header.Get("User-Agent"); ua != "" {
+		if rec := t.recordLocked(host); rec.UserAgent != ua {
+			rec.UserAgent = ua
+			changed[host] = true
+		}
+	}
+	t.mu.Unlock()
+
+	for domain := range changed {
+		t.save(domain)
+	}
+	return resp, nil
+}
+
+// load carica dallo store i record dei domini non ancora in memoria. La
+// lettura avviene fuori dal lock; se due richieste caricano lo stesso
+// dominio vince la prima.
+func (t *sessionTransport) load(domains []string) {
+	for _, domain := range domains {
+		t.mu.Lock()
+		_, ok := t.records[domain]
+		t.mu.Unlock()
+		if ok {
+			continue
+		}
+
+		rec, err := t.store.load(domain)
+		if err != nil {
+			log.E("unable to load session",
+				log.String("domain", domain),
+				log.Err("err", err),
+			)
+		}
+		if rec == nil {
+			rec = &sessionRecord{}
+		}
+
+		t.mu.Lock()
+		if _, ok := t.records[domain]; !ok {
+			t.records[domain] = rec
+		}
+		t.mu.Unlock()
+	}
+}
+
+// save persiste una copia del record del dominio, fuori dal lock globale.
+func (t *sessionTransport) save(domain string) {
+	t.mu.Lock()
+	rec := t.records[domain]
+	t.mu.Unlock()
+
+	rec.saveMu.Lock()
+	defer rec.saveMu.Unlock()
+
+	t.mu.Lock()
+	snapshot := &sessionRecord{UserAgent: rec.UserAgent, Cookies: slices.Clone(rec.Cookies)}
+	t.mu.Unlock()
+
+	if err := t.store.save(domain, snapshot); err != nil {
+		log.E("unable to persist session",
+			log.String("domain", domain),
+			log.Err("err", err),
+		)
+	}
+}
+
+// recordLocked restituisce il record del dominio, gia' caricato da
+// [sessionTransport.load].
+func (t *sessionTransport) recordLocked(domain string) *sessionRecord {
+	rec, ok := t.records[domain]
+	if !ok {
+		rec = &sessionRecord{}
+		t.records[domain] = rec
+	}
+	return rec
+}
+
+// cookieHeaderLocked costruisce l'header Cookie per la URL, dal path piu'
+// specifico al meno specifico.
+func (t *sessionTransport) cookieHeaderLocked(u *url.URL, host string, domains []string) string {
+	now := time.Now()
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	var matched []sessionCookie
+	for _, domain := range domains {
+		for _, c := range t.recordLocked(domain).Cookies {
+			switch {
+			case c.HostOnly && domain != host:
+			case c.Secure && u.Scheme != "https":
+			case c.expired(now):
+			case !cookiePathMatch(path, c.Path):
+			default:
+				matched = append(matched, c)
+			}
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return len(matched[i].Path) > len(matched[j].Path)
+	})
+
+	parts := make([]string, len(matched))
+	for i, c := range matched {
+		parts[i] = (&http.Cookie{Name: c.Name, Value: c.Value}).String()
+	}
+	return strings.Join(parts, "; ")
+}
+
+// setCookiesLocked applica i Set-Cookie ricevuti e restituisce i domini
+// modificati.
+func (t *sessionTransport) setCookiesLocked(u *url.URL, host string, cookies []*http.Cookie) map[string]bool {
+	changed := make(map[string]bool)
+	now := time.Now()
+
+	for _, hc := range cookies {
+		domain, hostOnly, ok := t.cookieDomain(host, hc.Domain)
+		if !ok {
+			continue
+		}
+		c := sessionCookie{
+			Name:     hc.Name,
+			Value:    hc.Value,
+			Path:     hc.Path,
+			HostOnly: hostOnly,
+			Secure:   hc.Secure,
+			HttpOnly: hc.HttpOnly,
+		}
+		if c.Path == "" || c.Path[0] != '/' {
+			c.Path = defaultCookiePath(u.EscapedPath())
+		}
+		switch {
+		case hc.MaxAge < 0:
+			c.Expires = now
+		case hc.MaxAge > 0:
+			c.Expires = now.Add(time.Duration(hc.MaxAge) * time.Second)
+		case !hc.Expires.IsZero():
+			c.Expires = hc.Expires
+		}
+
+		rec := t.recordLocked(domain)
+		kept := rec.Cookies[:0]
+		for _, old := range rec.Cookies {
+			// Sostituiamo il cookie con stesso nome e path; scartiamo gli scaduti.
+			if (old.Name == c.Name && old.Path == c.Path) || old.expired(now) {
+				continue
+			}
+			kept = append(kept, old)
+		}
+		if !c.expired(now) {
+			kept = append(kept, c)
+		}
+		rec.Cookies = kept
+		changed[domain] = true
+	}
+	return changed
+}
+
+// canonicalCookieHost normalizza l'host in minuscolo.
+func canonicalCookieHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// cookieDomain valida l'attributo Domain rispetto all'host che ha inviato il
+// cookie (RFC 6265, sezione 5.3) e restituisce il dominio del cookie.
+func (t *sessionTransport) cookieDomain(host, attr string) (string, bool, bool) {
+	attr = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(attr), "."))
+	if attr == "" {
+		return host, true, true
+	}
+	if attr == host {
+		// Un suffisso pubblico che e' anche l'host stesso vale solo per
+		// l'host (RFC 6265, passo 5 della sezione 5.3).
+		return host, t.isPublicSuffix(host), true
+	}
+	if net.ParseIP(host) != nil || !strings.Contains(attr, ".") || t.isPublicSuffix(attr) {
+		// Niente cookie di dominio per indirizzi IP, domini di primo livello
+		// o suffissi pubblici come "co.uk".
+		return "", false, false
+	}
+	if !strings.HasSuffix(host, "."+attr) {
+		return "", false, false
+	}
+	return attr, false, true
+}
+
+// cookieDomains elenca i domini i cui cookie possono valere per host: host
+// stesso e i suoi domini padre con almeno due etichette che non sono
+// suffissi pubblici.
+func (t *sessionTransport) cookieDomains(host string) []string {
+	out := []string{host}
+	if net.ParseIP(host) != nil {
+		return out
+	}
+	for d := host; ; {
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+		if !strings.Contains(d, ".") || t.isPublicSuffix(d) {
+			break
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+func (t *sessionTransport) isPublicSuffix(domain string) bool {
+	return t.psl.PublicSuffix(domain) == domain
+}
+
+func cookiePathMatch(reqPath, cookiePath string) bool {
+	if reqPath == cookiePath {
+		return true
+	}
+	if !strings.HasPrefix(reqPath, cookiePath) {
+		return false
+	}
+	return strings.HasSuffix(cookiePath, "/") || reqPath[len(cookiePath)] == '/'
+}
+
+func defaultCookiePath(path string) string {
+	i := strings.LastIndexByte(path, '/')
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+// sessionStore persiste i record di sessione per dominio.
+type sessionStore interface {
+	load(domain string) (*sessionRecord, error)
+	save(domain string, rec *sessionRecord) error
+}
+
+type memorySessionStore struct{}
+
+func (memorySessionStore) load(string) (*sessionRecord, error) { return nil, nil }
+func (memorySessionStore) save(string, *sessionRecord) error   { return nil }
+
+type dirSessionStore struct {
+	dir string
+}
+
+func (s dirSessionStore) path(domain string) string {
+	return filepath.Join(s.dir, url.PathEscape(domain)+".json")
+}
+
+func (s dirSessionStore) load(domain string) (*sessionRecord, error) {
+	data, err := os.ReadFile(s.path(domain))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec sessionRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s dirSessionStore) save(domain string, rec *sessionRecord) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return err
+	}
+	// I cookie sono credenziali: il file resta leggibile solo dal proprietario.
+	tmp := s.path(domain) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(domain))
+}
+
+type cacheSessionStore struct {
+	cache *filecache.FileCacheFS
+}
+
+func (s cacheSessionStore) load(domain string) (*sessionRecord, error) {
+	data, err := s.cache.Get("session:" + domain)
+	if errors.Is(err, filecache.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec sessionRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s cacheSessionStore) save(domain string, rec *sessionRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.cache.Put("session:"+domain, data)
+}
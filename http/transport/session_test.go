@@ -0,0 +1,196 @@
+package transport_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	xfilecache "github.com/lucasepe/x/filecache"
+	"github.com/lucasepe/x/http/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cookieUpstream registra l'header Cookie ricevuto e risponde con i
+// Set-Cookie indicati per path.
+func cookieUpstream(seen *[]string, setCookies map[string][]string) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		*seen = append(*seen, req.Header.Get("Cookie"))
+		header := make(http.Header)
+		for _, c := range setCookies[req.URL.Host+req.URL.Path] {
+			header.Add("Set-Cookie", c)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: header, Body: http.NoBody, Request: req}, nil
+	})
+}
+
+func TestSessionRoundTripperSendsCookiesBack(t *testing.T) {
+	var seen []string
+	rt := transport.SessionRoundTripper(cookieUpstream(&seen, map[string][]string{
+		"shop.example.com/login": {"sid=abc; Path=/", "cart=1; Path=/cart"},
+	}), transport.SessionOptions{})
+
+	for _, u := range []string{
+		"https://shop.example.com/login",
+		"https://shop.example.com/",
+		"https://shop.example.com/cart/items",
+		"https://other.example.com/",
+	} {
+		req := mustRequest(t, http.MethodGet, u, nil)
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, []string{"", "sid=abc", "cart=1; sid=abc", ""}, seen)
+}
+
+func TestSessionRoundTripperKeepsExistingCookieHeader(t *testing.T) {
+	var seen []string
+	rt := transport.SessionRoundTripper(cookieUpstream(&seen, map[string][]string{
+		"example.com/": {"sid=abc"},
+	}), transport.SessionOptions{})
+
+	for range 2 {
+		req := mustRequest(t, http.MethodGet, "https://example.com/", nil)
+		req.Header.Set("Cookie", "consent=yes")
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, []string{"consent=yes", "consent=yes; sid=abc"}, seen)
+}
+
+func TestSessionRoundTripperSharesDomainCookiesAcrossRedirects(t *testing.T) {
+	var seen []string
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		seen = append(seen, req.URL.Host+" "+req.Header.Get("Cookie"))
+		header := make(http.Header)
+		status := http.StatusOK
+		if req.URL.Host == "login.example.com" {
+			header.Add("Set-Cookie", "sso=token; Domain=example.com; Path=/")
+			header.Add("Set-Cookie", "local=1")
+			header.Set("Location", "https://www.example.com/home")
+			status = http.StatusFound
+		}
+		return &http.Response{StatusCode: status, Header: header, Body: http.NoBody, Request: req}, nil
+	})
+
+	client := &http.Client{Transport: transport.SessionRoundTripper(upstream, transport.SessionOptions{})}
+	resp, err := client.Get("https://login.example.com/")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, []string{
+		"login.example.com ",
+		"www.example.com sso=token",
+	}, seen)
+}
+
+func TestSessionRoundTripperRejectsForeignDomains(t *testing.T) {
+	var seen []string
+	rt := transport.SessionRoundTripper(cookieUpstream(&seen, map[string][]string{
+		"evil.com/": {"a=1; Domain=example.com", "b=2; Domain=com"},
+	}), transport.SessionOptions{})
+
+	for _, u := range []string{"https://evil.com/", "https://example.com/", "https://evil.com/x"} {
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, u, nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, []string{"", "", ""}, seen)
+}
+
+func TestSessionRoundTripperDeletesCookiesWithMaxAge(t *testing.T) {
+	var seen []string
+	rt := transport.SessionRoundTripper(cookieUpstream(&seen, map[string][]string{
+		"example.com/login":  {"sid=abc"},
+		"example.com/logout": {"sid=; Max-Age=0"},
+	}), transport.SessionOptions{})
+
+	for _, p := range []string{"/login", "/", "/logout", "/"} {
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com"+p, nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, []string{"", "sid=abc", "sid=abc", ""}, seen)
+}
+
+func TestSessionRoundTripperPersistsToDir(t *testing.T) {
+	dir := t.TempDir()
+
+	var seen []string
+	upstream := cookieUpstream(&seen, map[string][]string{
+		"example.com/login": {"sid=abc; Max-Age=3600"},
+	})
+
+	first := transport.SessionRoundTripper(upstream, transport.SessionOptions{Dir: dir})
+	req := mustRequest(t, http.MethodGet, "https://example.com/login", nil)
+	req.Header.Set("User-Agent", "scraper/1.0")
+	resp, err := first.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	info, err := os.Stat(filepath.Join(dir, "example.com.json"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	var sentUA string
+	second := transport.SessionRoundTripper(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sentUA = req.Header.Get("User-Agent")
+		return upstream.RoundTrip(req)
+	}), transport.SessionOptions{Dir: dir})
+	resp, err = second.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/", nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, []string{"", "sid=abc"}, seen)
+	assert.Equal(t, "scraper/1.0", sentUA)
+}
+
+func TestSessionRoundTripperRejectsPublicSuffixDomains(t *testing.T) {
+	var seen []string
+	rt := transport.SessionRoundTripper(cookieUpstream(&seen, map[string][]string{
+		"evil.co.uk/":         {"a=1; Domain=co.uk"},
+		"shop.example.co.uk/": {"b=2; Domain=example.co.uk"},
+	}), transport.SessionOptions{})
+
+	for _, u := range []string{
+		"https://evil.co.uk/",
+		"https://bank.co.uk/",
+		"https://shop.example.co.uk/",
+		"https://www.example.co.uk/",
+	} {
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, u, nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, []string{"", "", "", "b=2"}, seen)
+}
+
+func TestSessionRoundTripperPersistsToFileCache(t *testing.T) {
+	cache, err := xfilecache.New(t.TempDir())
+	require.NoError(t, err)
+
+	var seen []string
+	upstream := cookieUpstream(&seen, map[string][]string{
+		"example.com/login": {"sid=abc"},
+	})
+
+	for range 2 {
+		rt := transport.SessionRoundTripper(upstream, transport.SessionOptions{Cache: cache})
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/login", nil))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	assert.Equal(t, []string{"", "sid=abc"}, seen)
+
+	_, err = cache.Get("session:example.com")
+	assert.NoError(t, err)
+}
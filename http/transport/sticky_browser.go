@@ -12,6 +12,9 @@ import (
 // Il primo accesso a un host sceglie casualmente un profilo desktop; le
 // richieste successive verso lo stesso host riutilizzano sempre lo stesso set
 // di header per simulare un client "stabile".
+// Se la prima richiesta verso un host porta gia' lo User-Agent di uno dei
+// profili noti (ad esempio ripristinato da [SessionRoundTripper]), viene
+// adottato quel profilo.
 func StickyBrowserRoundTripper(upstream http.RoundTripper) http.RoundTripper {
 	if upstream == nil {
 		upstream = Default()
@@ -83,7 +86,7 @@ type stickyBrowserTransport struct {
 	rnd     *rand.Rand
 }
 
-func (h *stickyBrowserTransport) profileForHost(host string) browserProfile {
+func (h *stickyBrowserTransport) profileForHost(host, userAgent string) browserProfile {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
@@ -91,13 +94,20 @@ func (h *stickyBrowserTransport) profileForHost(host string) browserProfile {
 		return profile
 	}
 
+	for _, profile := range desktopProfiles {
+		if userAgent != "" && profile.UserAgent == userAgent {
+			h.perHost[host] = profile
+			return profile
+		}
+	}
+
 	profile := desktopProfiles[h.rnd.Intn(len(desktopProfiles))]
 	h.perHost[host] = profile
 	return profile
 }
 
 func (h *stickyBrowserTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	profile := h.profileForHost(req.URL.Host)
+	profile := h.profileForHost(req.URL.Host, req.Header.Get("User-Agent"))
 
 	// Cloniamo la request prima di mutare gli header, cosi' il chiamante puo'
 	// riusare la request senza side effect.
@@ -97,3 +97,29 @@ func TestStickyBrowserRoundTripperClonesRequestAndClearsChromeHintsForNonChromeP
 	assert.Equal(t, "\"Android\"", req.Header.Get("Sec-CH-UA-Platform"))
 	assert.Empty(t, req.Header.Get("User-Agent"))
 }
+
+func TestStickyBrowserRoundTripperAdoptsKnownUserAgent(t *testing.T) {
+	var seen []string
+	upstream := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		seen = append(seen, req.Header.Get("User-Agent"))
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody, Request: req}, nil
+	})
+
+	rt := StickyBrowserRoundTripper(upstream)
+	pinned := desktopProfiles[len(desktopProfiles)-1].UserAgent
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	require.NoError(t, err)
+	req.Header.Set("User-Agent", pinned)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	req, err = http.NewRequest(http.MethodGet, "https://example.com/next", nil)
+	require.NoError(t, err)
+	resp, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, []string{pinned, pinned}, seen)
+}
@@ -2,8 +2,12 @@ package transport
 
 import (
 	"net/http"
+	"net/url"
 )
 
+// redactedValue sostituisce i valori sensibili in log e cassette.
+const redactedValue = "REDACTED"
+
 // cloneRequest crea una copia shallow della request e una copia deep degli
 // header, cosi' i middleware possono modificarli senza effetti collaterali.
 func cloneRequest(req *http.Request) *http.Request {
@@ -28,3 +32,22 @@ func cloneHeader(in http.Header) http.Header {
 	}
 	return out
 }
+
+// redactURL restituisce la URL con i valori dei parametri di query indicati
+// sostituiti da un segnaposto.
+func redactURL(u *url.URL, names []string) string {
+	if len(names) == 0 || u.RawQuery == "" {
+		return u.String()
+	}
+	q := u.Query()
+	for _, name := range names {
+		if values, ok := q[name]; ok {
+			for i := range values {
+				values[i] = redactedValue
+			}
+		}
+	}
+	out := *u
+	out.RawQuery = q.Encode()
+	return out.String()
+}
@@ -0,0 +1,213 @@
+package transport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucasepe/x/log"
+)
+
+// RequestTiming scompone la durata di una richiesta nelle sue fasi. Le fasi
+// non avvenute (ad esempio DNS e Connect su una connessione riusata) valgono
+// zero.
+type RequestTiming struct {
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	// Server va dalla scrittura completa della richiesta al primo byte della
+	// risposta: approssima il tempo di elaborazione del server.
+	Server time.Duration
+	// TTFB va dall'inizio della richiesta al primo byte della risposta.
+	TTFB time.Duration
+	// Transfer va dal primo byte alla fine (o chiusura) del body.
+	Transfer time.Duration
+	Total    time.Duration
+	// ConnReused indica una connessione presa dal pool; IdleTime e' da
+	// quanto era inattiva.
+	ConnReused bool
+	IdleTime   time.Duration
+	RemoteAddr string
+}
+
+// String restituisce la scomposizione in forma compatta, ad esempio
+// "dns=3ms connect=12ms tls=25ms server=40ms ttfb=80ms transfer=5ms
+// total=85ms reused=false".
+func (t RequestTiming) String() string {
+	var b strings.Builder
+	for _, p := range t.phases() {
+		fmt.Fprintf(&b, "%s=%s ", p.name, p.d)
+	}
+	fmt.Fprintf(&b, "reused=%t", t.ConnReused)
+	return b.String()
+}
+
+// logFields restituisce la scomposizione come campi del package log.
+func (t RequestTiming) logFields() []log.Field {
+	var fields []log.Field
+	for _, p := range t.phases() {
+		fields = append(fields, log.String(p.name, p.d.String()))
+	}
+	return append(fields, log.Bool("conn_reused", t.ConnReused))
+}
+
+type timingPhase struct {
+	name string
+	d    time.Duration
+}
+
+// phases elenca le fasi avvenute, seguite da ttfb, transfer e total.
+func (t RequestTiming) phases() []timingPhase {
+	var out []timingPhase
+	for _, p := range []timingPhase{{"dns", t.DNS}, {"connect", t.Connect}, {"tls", t.TLS}, {"server", t.Server}} {
+		if p.d > 0 {
+			out = append(out, p)
+		}
+	}
+	return append(out,
+		timingPhase{"ttfb", t.TTFB},
+		timingPhase{"transfer", t.Transfer},
+		timingPhase{"total", t.Total},
+	)
+}
+
+// TimingRoundTripper misura le fasi di ogni richiesta tramite
+// net/http/httptrace e passa il risultato a onTiming quando il body della
+// risposta e' stato letto fino in fondo o chiuso (subito in caso di errore).
+// Per includere la scomposizione nel log strutturato o nel dump di debug
+// vedi LoggingOptions.Timing e VerboseOptions.Timing.
+func TimingRoundTripper(next http.RoundTripper, onTiming func(req *http.Request, timing RequestTiming)) http.RoundTripper {
+	if next == nil {
+		next = Default()
+	}
+
+	return &timingTransport{
+		next:     next,
+		onTiming: onTiming,
+	}
+}
+
+type timingTransport struct {
+	next     http.RoundTripper
+	onTiming func(req *http.Request, timing RequestTiming)
+}
+
+func (t *timingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	traced, rec := traceRequest(req)
+
+	resp, err := t.next.RoundTrip(traced)
+	if err != nil {
+		if t.onTiming != nil {
+			t.onTiming(req, rec.timing())
+		}
+		return nil, err
+	}
+	if t.onTiming == nil {
+		return resp, nil
+	}
+
+	body := &loggingBody{rc: resp.Body}
+	body.done = func(error) { t.onTiming(req, rec.timing()) }
+	if resp.Body == nil || resp.Body == http.NoBody {
+		body.finish(nil)
+		return resp, nil
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// timingRecorder raccoglie gli istanti degli eventi httptrace, che possono
+// arrivare da goroutine diverse.
+type timingRecorder struct {
+	mu sync.Mutex
+
+	start, dnsStart, dnsDone, connectStart, connectDone time.Time
+	tlsStart, tlsDone, wroteRequest, firstByte          time.Time
+
+	reused     bool
+	idleTime   time.Duration
+	remoteAddr string
+}
+
+// traceRequest restituisce una copia della richiesta con gli hook httptrace
+// collegati a un nuovo recorder. Gli eventuali trace gia' presenti nel
+// context continuano a ricevere gli eventi.
+func traceRequest(req *http.Request) (*http.Request, *timingRecorder) {
+	rec := &timingRecorder{start: time.Now()}
+
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { rec.mark(&rec.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { rec.mark(&rec.dnsDone) },
+		ConnectStart: func(string, string) {
+			// Con Happy Eyeballs partono piu' tentativi: teniamo il primo.
+			rec.markOnce(&rec.connectStart)
+		},
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				rec.markOnce(&rec.connectDone)
+			}
+		},
+		TLSHandshakeStart: func() { rec.mark(&rec.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { rec.mark(&rec.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			rec.reused = info.Reused
+			rec.idleTime = info.IdleTime
+			// httputil.DumpRequestOut usa una connessione finta senza
+			// indirizzo remoto.
+			if info.Conn != nil && info.Conn.RemoteAddr() != nil {
+				rec.remoteAddr = info.Conn.RemoteAddr().String()
+			}
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { rec.mark(&rec.wroteRequest) },
+		GotFirstResponseByte: func() { rec.mark(&rec.firstByte) },
+	}
+
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), rec
+}
+
+func (r *timingRecorder) mark(t *time.Time) {
+	r.mu.Lock()
+	*t = time.Now()
+	r.mu.Unlock()
+}
+
+func (r *timingRecorder) markOnce(t *time.Time) {
+	r.mu.Lock()
+	if t.IsZero() {
+		*t = time.Now()
+	}
+	r.mu.Unlock()
+}
+
+// timing calcola la scomposizione fino a questo istante.
+func (r *timingRecorder) timing() RequestTiming {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	return RequestTiming{
+		DNS:        timeBetween(r.dnsStart, r.dnsDone),
+		Connect:    timeBetween(r.connectStart, r.connectDone),
+		TLS:        timeBetween(r.tlsStart, r.tlsDone),
+		Server:     timeBetween(r.wroteRequest, r.firstByte),
+		TTFB:       timeBetween(r.start, r.firstByte),
+		Transfer:   timeBetween(r.firstByte, now),
+		Total:      now.Sub(r.start),
+		ConnReused: r.reused,
+		IdleTime:   r.idleTime,
+		RemoteAddr: r.remoteAddr,
+	}
+}
+
+func timeBetween(from, to time.Time) time.Duration {
+	if from.IsZero() || to.IsZero() || to.Before(from) {
+		return 0
+	}
+	return to.Sub(from)
+}
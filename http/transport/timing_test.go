@@ -0,0 +1,115 @@
+package transport_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucasepe/x/http/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimingRoundTripperMeasuresPhasesAndReuse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		io.WriteString(w, "hello")
+	}))
+	defer srv.Close()
+
+	var (
+		mu      sync.Mutex
+		timings []transport.RequestTiming
+	)
+	rt := transport.TimingRoundTripper(srv.Client().Transport, func(_ *http.Request, timing transport.RequestTiming) {
+		mu.Lock()
+		timings = append(timings, timing)
+		mu.Unlock()
+	})
+
+	for range 2 {
+		resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, srv.URL, nil))
+		require.NoError(t, err)
+		assert.Equal(t, "hello", readBody(t, resp))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, timings, 2)
+
+	first, second := timings[0], timings[1]
+	assert.False(t, first.ConnReused)
+	assert.Positive(t, first.Connect)
+	assert.GreaterOrEqual(t, first.TTFB, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, first.Server, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, first.Total, first.TTFB)
+	assert.NotEmpty(t, first.RemoteAddr)
+
+	assert.True(t, second.ConnReused)
+	assert.Zero(t, second.Connect)
+	assert.Contains(t, second.String(), "reused=true")
+	assert.NotContains(t, second.String(), "connect=")
+}
+
+func TestTimingRoundTripperMeasuresTLSHandshake(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	var got transport.RequestTiming
+	rt := transport.TimingRoundTripper(srv.Client().Transport, func(_ *http.Request, timing transport.RequestTiming) {
+		got = timing
+	})
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, srv.URL, nil))
+	require.NoError(t, err)
+	readBody(t, resp)
+
+	assert.Positive(t, got.TLS)
+	assert.Contains(t, got.String(), "tls=")
+}
+
+func TestTimingRoundTripperReportsOnError(t *testing.T) {
+	boom := errors.New("boom")
+	called := false
+	rt := transport.TimingRoundTripper(roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, boom
+	}), func(_ *http.Request, timing transport.RequestTiming) {
+		called = true
+		assert.Zero(t, timing.TTFB)
+	})
+
+	_, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com", nil))
+	assert.ErrorIs(t, err, boom)
+	assert.True(t, called)
+}
+
+func TestLoggingAndVerboseIncludeTiming(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	var logged, dumped bytes.Buffer
+	rt := transport.LoggingRoundTripperWithOptions(
+		transport.VerboseRoundTripperWithOptions(srv.Client().Transport, transport.VerboseOptions{
+			Output: &dumped,
+			Timing: true,
+		}),
+		transport.LoggingOptions{Output: &logged, Timing: true},
+	)
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, srv.URL, nil))
+	require.NoError(t, err)
+	assert.Equal(t, "ok", readBody(t, resp))
+
+	assert.Contains(t, logged.String(), "connect=")
+	assert.Contains(t, logged.String(), "ttfb=")
+	assert.Contains(t, logged.String(), "conn_reused=false")
+	assert.Contains(t, dumped.String(), "* timing: ")
+	assert.Contains(t, dumped.String(), "reused=false")
+}
@@ -19,6 +19,12 @@ const DefaultVerboseMaxBodyBytes = 8 * 1024
 type VerboseOptions struct {
 	LogBodies    bool
 	MaxBodyBytes int
+	// Output riceve il dump; se nil usa os.Stderr.
+	Output io.Writer
+	// Timing aggiunge in coda al dump la scomposizione della durata, vedi
+	// [RequestTiming]. E' stampata quando il body della risposta e' stato
+	// letto fino in fondo o chiuso, quindi dopo l'eventuale anteprima.
+	Timing bool
 }
 
 // VerboseRoundTripper stampa richiesta e risposta su stderr in forma leggibile.
@@ -54,20 +60,27 @@ type verboseRoundTripper struct {
 }
 
 func (vt *verboseRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	out := vt.output()
+
 	reqBody, reqBodyTruncated, err := previewRequestBody(req, vt.opts.MaxBodyBytes, vt.opts.LogBodies)
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(out)
 
 	dumpReq, _ := httputil.DumpRequestOut(req, false)
-	addPrefixToLines(os.Stderr, dumpReq, "> ")
+	addPrefixToLines(out, dumpReq, "> ")
 
 	if vt.opts.LogBodies {
-		printBodyPreview(reqBody, reqBodyTruncated, req.Header.Get("Content-Type"))
+		printBodyPreview(out, reqBody, reqBodyTruncated, req.Header.Get("Content-Type"))
+	}
+	fmt.Fprint(out, "\n\n")
+
+	var rec *timingRecorder
+	if vt.opts.Timing {
+		req, rec = traceRequest(req)
 	}
-	fmt.Fprint(os.Stderr, "\n\n")
 
 	resp, err := vt.next.RoundTrip(req)
 	if err != nil {
@@ -91,24 +104,45 @@ func (vt *verboseRoundTripper) RoundTrip(req *http.Request) (*http.Response, err
 
 	if !vt.opts.LogBodies || isPrintable(contentType) {
 		dumpResp, _ := httputil.DumpResponse(resp, false)
-		addPrefixToLines(os.Stderr, dumpResp, "< ")
+		addPrefixToLines(out, dumpResp, "< ")
 
 		if vt.opts.LogBodies {
-			printBodyPreview(respBody, respBodyTruncated, contentType)
+			printBodyPreview(out, respBody, respBodyTruncated, contentType)
 		}
 	}
+	if rec == nil {
+		return resp, nil
+	}
 
+	// La durata comprende il trasferimento del body: la stampiamo quando il
+	// chiamante lo ha letto fino in fondo o lo ha chiuso.
+	body := &loggingBody{rc: resp.Body}
+	body.done = func(error) { fmt.Fprintf(out, "* timing: %s\n", rec.timing()) }
+	if resp.Body == nil || resp.Body == http.NoBody {
+		body.finish(nil)
+		return resp, nil
+	}
+	resp.Body = body
 	return resp, nil
 }
 
-func prettyPrintJSON(body []byte) {
+// output restituisce la destinazione del dump. os.Stderr viene letto a ogni
+// chiamata, cosi' resta possibile redirigerlo dopo la creazione del transport.
+func (vt *verboseRoundTripper) output() io.Writer {
+	if vt.opts.Output != nil {
+		return vt.opts.Output
+	}
+	return os.Stderr
+}
+
+func prettyPrintJSON(w io.Writer, body []byte) {
 	var out bytes.Buffer
 	err := json.Indent(&out, body, "", "  ")
 	if err != nil {
-		fmt.Fprintln(os.Stderr, string(body))
+		fmt.Fprintln(w, string(body))
 		return
 	}
-	fmt.Fprintln(os.Stderr, out.String())
+	fmt.Fprintln(w, out.String())
 }
 
 func addPrefixToLines(w io.Writer, data []byte, prefix string) {
@@ -121,19 +155,19 @@ func addPrefixToLines(w io.Writer, data []byte, prefix string) {
 	}
 }
 
-func printBodyPreview(body []byte, truncated bool, contentType string) {
+func printBodyPreview(w io.Writer, body []byte, truncated bool, contentType string) {
 	if len(body) == 0 {
 		return
 	}
 
-	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(w)
 	if !truncated && strings.Contains(strings.ToLower(contentType), "application/json") {
-		prettyPrintJSON(body)
+		prettyPrintJSON(w, body)
 	} else {
-		fmt.Fprintln(os.Stderr, string(body))
+		fmt.Fprintln(w, string(body))
 	}
 	if truncated {
-		fmt.Fprintf(os.Stderr, "[body truncated to %d bytes]\n", len(body))
+		fmt.Fprintf(w, "[body truncated to %d bytes]\n", len(body))
 	}
 }
 
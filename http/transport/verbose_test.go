@@ -61,3 +61,56 @@ func TestVerboseRoundTripperWithOptionsTruncatesPreviewAndPreservesBody(t *testi
 	assert.Equal(t, `{"abcdefgh":"ijklmnop"}`, string(body))
 	assert.Contains(t, logged, "[body truncated to 8 bytes]")
 }
+
+func TestVerboseRoundTripperWritesToConfiguredOutput(t *testing.T) {
+	var out bytes.Buffer
+
+	rt := transport.VerboseRoundTripperWithOptions(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Status:     "200 OK",
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	}), transport.VerboseOptions{Output: &out})
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/path", nil))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Contains(t, out.String(), "> GET /path HTTP/1.1")
+	assert.Contains(t, out.String(), "< HTTP/1.1 200 OK")
+}
+
+func TestVerboseRoundTripperPrintsTimingAfterBody(t *testing.T) {
+	var out bytes.Buffer
+
+	rt := transport.VerboseRoundTripperWithOptions(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Status:     "200 OK",
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       io.NopCloser(strings.NewReader("hello")),
+			Request:    req,
+		}, nil
+	}), transport.VerboseOptions{Output: &out, LogBodies: true, MaxBodyBytes: 2, Timing: true})
+
+	resp, err := rt.RoundTrip(mustRequest(t, http.MethodGet, "https://example.com/path", nil))
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), "< HTTP/1.1 200 OK")
+	assert.NotContains(t, out.String(), "* timing:", "timing prima della lettura del body")
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	resp.Body.Close()
+
+	assert.Equal(t, 1, strings.Count(out.String(), "* timing:"))
+}